@@ -0,0 +1,236 @@
+// Package archive extracts the files partners bundle in zip, gzip and tar.gz archives.
+// Extraction stops at a limit on the number of files and on their total size, so an
+// archive that expands to far more than it weighs can't fill the disk.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reconconverter/config"
+	"strings"
+)
+
+// used when a channel doesn't configure its own limits
+const (
+	defaultMaxMembers = 100
+	defaultMaxSizeMB  = 1024
+)
+
+// extensions of archives, optionally followed by the extension of an encrypted file
+var (
+	archiveExtensions   = []string{".zip", ".tar.gz", ".tgz", ".gz"}
+	encryptedExtensions = []string{".pgp", ".gpg", ".asc"}
+)
+
+// Member is a file extracted from an archive
+type Member struct {
+	// the base name of the file in the archive
+	Name string
+	// where it is extracted
+	Path string
+}
+
+// Limits bound what an archive may expand to
+type Limits struct {
+	MaxMembers int
+	MaxSize    int64
+}
+
+// NewLimits returns the limits of a channel
+func NewLimits(cfg config.Archive) (Limits, error) {
+	if cfg.MaxMembers < 0 || cfg.MaxSizeMB < 0 {
+		return Limits{}, fmt.Errorf("archive limits must not be negative")
+	}
+	limits := Limits{MaxMembers: cfg.MaxMembers, MaxSize: int64(cfg.MaxSizeMB) << 20}
+	if limits.MaxMembers == 0 {
+		limits.MaxMembers = defaultMaxMembers
+	}
+	if limits.MaxSize == 0 {
+		limits.MaxSize = defaultMaxSizeMB << 20
+	}
+	return limits, nil
+}
+
+// IsArchive reports whether name is the name of an archive, encrypted or not
+func IsArchive(name string) bool {
+	return extension(name) != ""
+}
+
+// extension returns the archive extension of name, empty for other files
+func extension(name string) string {
+	name = strings.ToLower(name)
+	for _, encrypted := range encryptedExtensions {
+		name = strings.TrimSuffix(name, encrypted)
+	}
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(name, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// Extract extracts the files of the archive at src, named name, to dir. Directories are
+// flattened, members are named by their base name. A gzip file that is not a tar archive
+// holds a single file named like the archive without .gz.
+func Extract(src string, name string, dir string, limits Limits) ([]Member, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	extractor := &extractor{dir: dir, limits: limits, names: make(map[string]bool)}
+	var err error
+	if extension(name) == ".zip" {
+		err = extractor.zip(src)
+	} else {
+		err = extractor.gzip(src, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(extractor.members) == 0 {
+		return nil, fmt.Errorf("archive %v has no files", name)
+	}
+	return extractor.members, nil
+}
+
+type extractor struct {
+	dir     string
+	limits  Limits
+	members []Member
+	names   map[string]bool
+	// bytes extracted so far
+	size int64
+}
+
+func (e *extractor) zip(src string) error {
+	archive, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	// the count is known before anything is extracted
+	files := 0
+	for _, file := range archive.File {
+		if !file.FileInfo().IsDir() {
+			files++
+		}
+	}
+	if files > e.limits.MaxMembers {
+		return fmt.Errorf("archive has %d files, more than %d", files, e.limits.MaxMembers)
+	}
+
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		// bit 0 of the flags marks an encrypted member
+		if file.Flags&0x1 != 0 {
+			return fmt.Errorf("%v is encrypted, encrypted zip files are not supported", file.Name)
+		}
+		r, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("%v: %v", file.Name, err)
+		}
+		err = e.add(file.Name, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *extractor) gzip(src string, name string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	buffered := bufio.NewReader(gz)
+	// a tar header has "ustar" at offset 257
+	if head, _ := buffered.Peek(262); len(head) == 262 && bytes.Equal(head[257:262], []byte("ustar")) {
+		return e.tar(buffered)
+	}
+	if extension(name) != ".gz" {
+		return fmt.Errorf("%v is not a tar archive", name)
+	}
+
+	base := path.Base(filepath.ToSlash(name))
+	for _, encrypted := range encryptedExtensions {
+		if strings.HasSuffix(strings.ToLower(base), encrypted) {
+			base = base[:len(base)-len(encrypted)]
+		}
+	}
+	return e.add(base[:len(base)-len(".gz")], buffered)
+}
+
+func (e *extractor) tar(r io.Reader) error {
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if len(e.members) == e.limits.MaxMembers {
+			return fmt.Errorf("archive has more than %d files", e.limits.MaxMembers)
+		}
+		if err := e.add(header.Name, archive); err != nil {
+			return err
+		}
+	}
+}
+
+// add extracts a member, counting its size against the limit as it is written, the sizes
+// an archive declares can't be trusted
+func (e *extractor) add(name string, r io.Reader) error {
+	base := path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if base == "." || base == "/" || base == ".." {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	if e.names[base] {
+		return fmt.Errorf("archive has more than one file named %v", base)
+	}
+	e.names[base] = true
+
+	member := Member{Name: base, Path: filepath.Join(e.dir, base)}
+	out, err := os.Create(member.Path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	remaining := e.limits.MaxSize - e.size
+	n, err := io.Copy(out, io.LimitReader(r, remaining+1))
+	if err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	if n > remaining {
+		return fmt.Errorf("archive expands to more than %d MB", e.limits.MaxSize>>20)
+	}
+	e.size += n
+	e.members = append(e.members, member)
+	return out.Close()
+}
@@ -0,0 +1,263 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reconconverter/config"
+	"strings"
+	"testing"
+)
+
+// file is a member written to a test archive
+type file struct {
+	name string
+	data []byte
+}
+
+func writeZip(t *testing.T, files ...file) string {
+	t.Helper()
+	var buffer bytes.Buffer
+	w := zip.NewWriter(&buffer)
+	for _, f := range files {
+		out, err := w.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := out.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return writeFile(t, "settlement.zip", buffer.Bytes())
+}
+
+func writeTarGz(t *testing.T, files ...file) string {
+	t.Helper()
+	var buffer bytes.Buffer
+	gz := gzip.NewWriter(&buffer)
+	w := tar.NewWriter(gz)
+	for _, f := range files {
+		if err := w.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return writeFile(t, "settlement.tar.gz", buffer.Bytes())
+}
+
+func writeGz(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	var buffer bytes.Buffer
+	gz := gzip.NewWriter(&buffer)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return writeFile(t, name, buffer.Bytes())
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func memberNames(members []Member) []string {
+	names := make([]string, 0, len(members))
+	for _, member := range members {
+		names = append(names, member.Name)
+	}
+	return names
+}
+
+var limits = Limits{MaxMembers: 3, MaxSize: 1 << 20}
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive func(t *testing.T) string
+	}{
+		{"settlement.zip", func(t *testing.T) string {
+			return writeZip(t, file{"2024/03/a.csv", []byte("a")}, file{"b.xlsx", []byte("bb")})
+		}},
+		{"settlement.tar.gz", func(t *testing.T) string {
+			return writeTarGz(t, file{"2024/03/a.csv", []byte("a")}, file{"b.xlsx", []byte("bb")})
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "extracted")
+			members, err := Extract(test.archive(t), test.name, dir, limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// folders are flattened
+			if names := memberNames(members); strings.Join(names, ",") != "a.csv,b.xlsx" {
+				t.Fatalf("extracted %v", names)
+			}
+			for _, member := range members {
+				if filepath.Dir(member.Path) != dir {
+					t.Errorf("%v extracted to %v", member.Name, member.Path)
+				}
+			}
+			if data, _ := os.ReadFile(members[1].Path); string(data) != "bb" {
+				t.Errorf("extracted %q", data)
+			}
+		})
+	}
+}
+
+func TestExtractGzip(t *testing.T) {
+	members, err := Extract(writeGz(t, "settlement.csv.gz.pgp", []byte("a;b")), "settlement.csv.gz.pgp", t.TempDir(), limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].Name != "settlement.csv" {
+		t.Fatalf("extracted %v", memberNames(members))
+	}
+
+	// a .tgz must hold a tar archive
+	if _, err := Extract(writeGz(t, "settlement.tgz", []byte("a;b")), "settlement.tgz", t.TempDir(), limits); err == nil {
+		t.Errorf("extracted a tgz that is not a tar archive")
+	}
+}
+
+func TestExtractMaxMembers(t *testing.T) {
+	files := []file{{"a.csv", []byte("a")}, {"b.csv", []byte("b")}, {"c.csv", []byte("c")}, {"d.csv", []byte("d")}}
+
+	zipPath := writeZip(t, files...)
+	if _, err := Extract(zipPath, "settlement.zip", t.TempDir(), limits); err == nil || !strings.Contains(err.Error(), "more than 3") {
+		t.Errorf("zip of 4 files: %v", err)
+	}
+	tarPath := writeTarGz(t, files...)
+	if _, err := Extract(tarPath, "settlement.tar.gz", t.TempDir(), limits); err == nil || !strings.Contains(err.Error(), "more than 3") {
+		t.Errorf("tar.gz of 4 files: %v", err)
+	}
+
+	// folders are not counted
+	dir := t.TempDir()
+	members, err := Extract(writeZip(t, file{"2024/", nil}, files[0], files[1], files[2]), "settlement.zip", dir, limits)
+	if err != nil || len(members) != 3 {
+		t.Errorf("zip of 3 files in a folder: %v, %v", memberNames(members), err)
+	}
+}
+
+func TestExtractMaxSize(t *testing.T) {
+	// compresses to a few KB
+	bomb := bytes.Repeat([]byte{'0'}, 4<<20)
+
+	tests := []struct {
+		name string
+		path func(t *testing.T) string
+	}{
+		{"settlement.zip", func(t *testing.T) string { return writeZip(t, file{"bomb.csv", bomb}) }},
+		{"settlement.tar.gz", func(t *testing.T) string { return writeTarGz(t, file{"bomb.csv", bomb}) }},
+		{"bomb.csv.gz", func(t *testing.T) string { return writeGz(t, "bomb.csv.gz", bomb) }},
+		// the limit is on the total of the files
+		{"settlement.zip", func(t *testing.T) string {
+			half := bomb[:600<<10]
+			return writeZip(t, file{"a.csv", half}, file{"b.csv", half})
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_, err := Extract(test.path(t), test.name, dir, limits)
+			if err == nil || !strings.Contains(err.Error(), "more than 1 MB") {
+				t.Fatalf("extracted a bomb: %v", err)
+			}
+			// extraction stops at the limit
+			var written int64
+			entries, _ := os.ReadDir(dir)
+			for _, entry := range entries {
+				info, _ := entry.Info()
+				written += info.Size()
+			}
+			if written > limits.MaxSize+1 {
+				t.Errorf("wrote %d bytes before stopping", written)
+			}
+		})
+	}
+}
+
+func TestExtractDuplicateNames(t *testing.T) {
+	path := writeZip(t, file{"march/settlement.csv", []byte("a")}, file{"april/settlement.csv", []byte("b")})
+	if _, err := Extract(path, "settlement.zip", t.TempDir(), limits); err == nil || !strings.Contains(err.Error(), "more than one file named settlement.csv") {
+		t.Errorf("duplicate names: %v", err)
+	}
+}
+
+func TestExtractInvalidNames(t *testing.T) {
+	// members can't be written outside the folder
+	members, err := Extract(writeTarGz(t, file{"../../settlement.csv", []byte("a")}), "settlement.tar.gz", t.TempDir(), limits)
+	if err != nil || len(members) != 1 || members[0].Name != "settlement.csv" {
+		t.Errorf("extracted %v, %v", memberNames(members), err)
+	}
+	if _, err := Extract(writeTarGz(t, file{"..", []byte("a")}), "settlement.tar.gz", t.TempDir(), limits); err == nil {
+		t.Errorf("extracted a file named ..")
+	}
+	if _, err := Extract(writeZip(t, file{"2024/", nil}), "settlement.zip", t.TempDir(), limits); err == nil {
+		t.Errorf("extracted an archive without files")
+	}
+}
+
+// archives in archives are extracted as files, the handler rejects them
+func TestExtractNested(t *testing.T) {
+	inner, err := os.ReadFile(writeZip(t, file{"a.csv", []byte("a")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, err := Extract(writeZip(t, file{"inner.zip", inner}), "settlement.zip", t.TempDir(), limits)
+	if err != nil || len(members) != 1 || members[0].Name != "inner.zip" || !IsArchive(members[0].Name) {
+		t.Errorf("extracted %v, %v", memberNames(members), err)
+	}
+}
+
+func TestNewLimits(t *testing.T) {
+	defaults, err := NewLimits(config.Archive{})
+	if err != nil || defaults.MaxMembers != defaultMaxMembers || defaults.MaxSize != defaultMaxSizeMB<<20 {
+		t.Errorf("defaults %+v, %v", defaults, err)
+	}
+	if limits, err := NewLimits(config.Archive{MaxMembers: 5, MaxSizeMB: 2}); err != nil || limits.MaxMembers != 5 || limits.MaxSize != 2<<20 {
+		t.Errorf("limits %+v, %v", limits, err)
+	}
+	if _, err := NewLimits(config.Archive{MaxSizeMB: -1}); err == nil {
+		t.Errorf("accepted a negative limit")
+	}
+}
+
+func TestIsArchive(t *testing.T) {
+	for name, want := range map[string]bool{
+		"settlement.zip":        true,
+		"settlement.ZIP":        true,
+		"settlement.tar.gz":     true,
+		"settlement.tgz":        true,
+		"settlement.csv.gz.gpg": true,
+		"settlement.zip.pgp":    true,
+		"settlement.xlsx":       false,
+		"settlement.xlsx.pgp":   false,
+	} {
+		if got := IsArchive(name); got != want {
+			t.Errorf("IsArchive(%q) = %v", name, got)
+		}
+	}
+}
@@ -1,36 +1,22 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
 	"strings"
 
 	"github.com/go-yaml/yaml"
 )
 
 type Config struct {
-	Ovo struct {
-		Interval        int    `yaml:"interval"`
-		SourcePath      string `yaml:"sourcePath"`
-		DestinationPath string `yaml:"destinationPath"`
-		SftpSource      Sftp   `yaml:"sftpSource"`
-		SftpDestination Sftp   `yaml:"sftpDestination"`
-		BackupPath      string `yaml:"backupPath"`
-	} `yaml:"ovo"`
-	Indodana struct {
-		Interval        int    `yaml:"interval"`
-		SourcePath      string `yaml:"sourcePath"`
-		DestinationPath string `yaml:"destinationPath"`
-		SftpSource      Sftp   `yaml:"sftpSource"`
-		SftpDestination Sftp   `yaml:"sftpDestination"`
-		BackupPath      string `yaml:"backupPath"`
-	} `yaml:"indodana"`
-	Sftp struct {
-		Host     string `yaml:"host"`
-		Port     int    `yaml:"port"`
-		User     string `yaml:"user"`
-		Password string `yaml:"password"`
-	} `yaml:"sftp"`
-	TempFolder string `yaml:"tempFolder"`
+	Ovo      Channel `yaml:"ovo"`
+	Indodana Channel `yaml:"indodana"`
+	// Sftp is used by channels that don't configure their own sftpSource or sftpDestination
+	Sftp       Sftp     `yaml:"sftp"`
+	SftpPool   SftpPool `yaml:"sftpPool"`
+	TempFolder string   `yaml:"tempFolder"`
+	LedgerFile string   `yaml:"ledgerFile"`
 	Smtp       struct {
 		Host     string `yaml:"host"`
 		Port     int    `yaml:"port"`
@@ -42,6 +28,209 @@ type Config struct {
 	MailReceivers []string
 	Cron          string `yaml:"cron"`
 	JobLoopDelay  int    `yaml:"jobLoopDelay"`
+	// number of files processed in parallel across all channels
+	MaxWorkers int `yaml:"maxWorkers"`
+}
+
+type Channel struct {
+	Interval        int    `yaml:"interval"`
+	SourcePath      string `yaml:"sourcePath"`
+	DestinationPath string `yaml:"destinationPath"`
+	// SourceType and DestinationType select the transport: sftp (default), ftp, s3 or local
+	SourceType      string `yaml:"sourceType"`
+	DestinationType string `yaml:"destinationType"`
+	SftpSource      Sftp   `yaml:"sftpSource"`
+	SftpDestination Sftp   `yaml:"sftpDestination"`
+	FtpSource       Ftp    `yaml:"ftpSource"`
+	FtpDestination  Ftp    `yaml:"ftpDestination"`
+	S3Source        S3     `yaml:"s3Source"`
+	S3Destination   S3     `yaml:"s3Destination"`
+	// ArchiveType moves processed source files to another store (s3 or local) below BackupPath
+	// instead of renaming them on the source
+	ArchiveType  string       `yaml:"archiveType"`
+	S3Archive    S3           `yaml:"s3Archive"`
+	BackupPath   string       `yaml:"backupPath"`
+	FilenameRule FilenameRule `yaml:"filenameRule"`
+	// Include and Exclude are glob patterns, or regexes when prefixed with "regex:"
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+	// a file is picked up once two listings at least StableSeconds apart saw the same size
+	// and mtime, never on the listing that first sees it
+	StableSeconds int `yaml:"stableSeconds"`
+	// when set, a file is only picked up after the partner uploads <name><DoneMarker>
+	DoneMarker string `yaml:"doneMarker"`
+	// process files even when the ledger already has a file with the same content
+	AllowDuplicates bool `yaml:"allowDuplicates"`
+	// number of files of this channel processed in parallel
+	Workers int `yaml:"workers"`
+	// Watch processes a local source as soon as files arrive instead of on the cron.
+	// Bursts of events are collapsed until nothing changed for DebounceSeconds.
+	Watch           bool `yaml:"watch"`
+	DebounceSeconds int  `yaml:"debounceSeconds"`
+	// Input tells how text files are read, spreadsheets are recognized by their content
+	Input Input `yaml:"input"`
+	// Sheet selects the sheets holding the transactions, by default the first sheet for ovo
+	// and the sheet named Ledger for indodana
+	Sheet Sheet `yaml:"sheet"`
+	// Preamble finds the header below the title rows partners put above it and captures
+	// values of those rows
+	Preamble Preamble `yaml:"preamble"`
+	// WorkbookPassword opens password protected xlsx workbooks
+	WorkbookPassword Secret `yaml:"workbookPassword"`
+	// Pgp decrypts the files of the channel and holds the key outputs are signed with
+	Pgp Pgp `yaml:"pgp"`
+	// Archive limits what the zip, gz and tar.gz files of the channel may expand to
+	Archive Archive `yaml:"archive"`
+	// Schema overrides the default normalization of the channel's columns
+	Schema Schema `yaml:"schema"`
+	// Outputs are the files delivered for every source file. Without outputs the channel
+	// delivers a single ";" separated csv to its destination.
+	Outputs []Output `yaml:"outputs"`
+}
+
+// Secret is a value kept out of the config file, read from File or from the environment
+// variable Env when the value is needed.
+type Secret struct {
+	File string `yaml:"file"`
+	Env  string `yaml:"env"`
+}
+
+// IsSet reports whether the secret is configured
+func (secret Secret) IsSet() bool {
+	return secret.File != "" || secret.Env != ""
+}
+
+// Load returns the value of the secret. The trailing newline of a secret file is not part of it.
+func (secret Secret) Load() (string, error) {
+	switch {
+	case secret.File != "" && secret.Env != "":
+		return "", fmt.Errorf("secret has both a file and an env")
+	case secret.File != "":
+		raw, err := ioutil.ReadFile(secret.File)
+		if err != nil {
+			return "", err
+		}
+		value := strings.TrimRight(string(raw), "\r\n")
+		if value == "" {
+			return "", fmt.Errorf("secret file %v is empty", secret.File)
+		}
+		return value, nil
+	case secret.Env != "":
+		value, ok := os.LookupEnv(secret.Env)
+		if !ok || value == "" {
+			return "", fmt.Errorf("environment variable %v is not set", secret.Env)
+		}
+		return value, nil
+	}
+	return "", nil
+}
+
+// Pgp holds the OpenPGP keys of a channel. PrivateKeyring is our keyring file, armored or binary,
+// unlocked with Passphrase. With Decrypt every source file must be a message encrypted to it.
+// When VerifyKeyring is set, the partner's keyring, the message must also be signed by one of
+// its keys, otherwise signatures are recorded but not checked.
+type Pgp struct {
+	Decrypt        bool   `yaml:"decrypt"`
+	PrivateKeyring string `yaml:"privateKeyring"`
+	Passphrase     Secret `yaml:"passphrase"`
+	VerifyKeyring  string `yaml:"verifyKeyring"`
+}
+
+// PgpEncrypt encrypts an output to the keys of Keyring. Sign signs it with the private key of
+// the channel's pgp settings. Armor writes ASCII armor, the file gets .asc instead of .pgp.
+type PgpEncrypt struct {
+	Keyring string `yaml:"keyring"`
+	Sign    bool   `yaml:"sign"`
+	Armor   bool   `yaml:"armor"`
+}
+
+// Archive limits the extraction of an archive to MaxMembers files (100 by default) of
+// MaxSizeMB in total (1024 by default).
+type Archive struct {
+	MaxMembers int `yaml:"maxMembers"`
+	MaxSizeMB  int `yaml:"maxSizeMb"`
+}
+
+// Sheet selects the sheets of a workbook by exactly one of Name, Pattern (a regex on the
+// name), Index (1 is the first sheet) or Header, the sheets having the header the channel
+// expects, on their first row or among the rows the Preamble scans. IgnoreCase compares Name ignoring case and leading, trailing and repeated
+// spaces. With Concat the rows of every matching sheet are delivered as one file, the sheets must
+// have the same header, otherwise more than one matching sheet is an error.
+type Sheet struct {
+	Name       string `yaml:"name"`
+	IgnoreCase bool   `yaml:"ignoreCase"`
+	Pattern    string `yaml:"pattern"`
+	Index      int    `yaml:"index"`
+	Header     bool   `yaml:"header"`
+	Concat     bool   `yaml:"concat"`
+}
+
+// Preamble is the rows above the header. The header is the row among the first ScanRows rows
+// of a sheet with the most cells named like the columns of the header the channel expects,
+// without ScanRows it is the first row. Fields capture values of the rows above it.
+type Preamble struct {
+	ScanRows int             `yaml:"scanRows"`
+	Fields   []PreambleField `yaml:"fields"`
+}
+
+// PreambleField captures a value of the rows above the header, e.g. the period of a report
+// titled "Periode: 27-03-2024". Pattern is a regex matched against the non-empty cells of
+// each row joined by a space, the value is its first capture group. The value is available to
+// the filename template as {{.meta.<Name>}} and recorded in the ledger. When DateLayout is set
+// the value is parsed with it so the template can reformat it. A file without the value is
+// invalid.
+type PreambleField struct {
+	Name       string `yaml:"name"`
+	Pattern    string `yaml:"pattern"`
+	DateLayout string `yaml:"dateLayout"`
+}
+
+// Input is how csv files of a channel are read. Delimiter is detected from the header line
+// when empty, one of ";", ",", tab or "|". Encoding is an IANA charset name, utf-8 by default.
+type Input struct {
+	Delimiter string `yaml:"delimiter"`
+	Encoding  string `yaml:"encoding"`
+}
+
+// Output is a file delivered for every source file. Format is csv (default), fixedwidth,
+// jsonl or xlsx. The output goes to the channel's destination unless DestinationType is set,
+// DestinationPath defaults to the channel's. Extension replaces the extension of the output
+// filename, which defaults by format.
+type Output struct {
+	Format          string `yaml:"format"`
+	Extension       string `yaml:"extension"`
+	DestinationType string `yaml:"destinationType"`
+	DestinationPath string `yaml:"destinationPath"`
+	SftpDestination Sftp   `yaml:"sftpDestination"`
+	FtpDestination  Ftp    `yaml:"ftpDestination"`
+	S3Destination   S3     `yaml:"s3Destination"`
+	// Header writes the column names first, by default for csv and xlsx only
+	Header *bool `yaml:"header"`
+	// LineEnding is lf (default) or crlf
+	LineEnding string `yaml:"lineEnding"`
+	// Encoding is an IANA charset name such as windows-1252, utf-8 by default.
+	// BOM writes a byte order mark in that encoding first.
+	Encoding string `yaml:"encoding"`
+	BOM      bool   `yaml:"bom"`
+	// csv: Delimiter defaults to ";", Quote is minimal (default), all or none
+	Delimiter string `yaml:"delimiter"`
+	Quote     string `yaml:"quote"`
+	// fixedwidth: the columns of a record in order
+	Fields []FixedWidthField `yaml:"fields"`
+	// xlsx: Sheet defaults to Sheet1, NumberColumns are written as numbers instead of text
+	Sheet         string   `yaml:"sheet"`
+	NumberColumns []string `yaml:"numberColumns"`
+	// Encrypt delivers the output as an OpenPGP message
+	Encrypt PgpEncrypt `yaml:"encrypt"`
+}
+
+// FixedWidthField is a column of a fixed width record. Values are padded with Pad (a space by
+// default) on the right, or on the left when Align is right. Longer values are an error.
+type FixedWidthField struct {
+	Name  string `yaml:"name"`
+	Width int    `yaml:"width"`
+	Align string `yaml:"align"`
+	Pad   string `yaml:"pad"`
 }
 
 type Sftp struct {
@@ -51,6 +240,168 @@ type Sftp struct {
 	Password string `yaml:"password"`
 }
 
+// Ftp is a plain FTP server, or FTPS with explicit TLS when TLS is set.
+// Transfers use passive mode; DisableEPSV falls back to PASV for servers that don't support EPSV.
+type Ftp struct {
+	Host               string `yaml:"host"`
+	Port               int    `yaml:"port"`
+	User               string `yaml:"user"`
+	Password           string `yaml:"password"`
+	TLS                bool   `yaml:"tls"`
+	CAFile             string `yaml:"caFile"`
+	CertFile           string `yaml:"certFile"`
+	KeyFile            string `yaml:"keyFile"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+	DisableEPSV        bool   `yaml:"disableEpsv"`
+	Timeout            int    `yaml:"timeout"`
+}
+
+// S3 is a bucket of an S3 compatible object storage. Keys are Prefix joined with the channel paths.
+type S3 struct {
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	AccessKey string `yaml:"accessKey"`
+	SecretKey string `yaml:"secretKey"`
+	UseSSL    bool   `yaml:"useSsl"`
+	PathStyle bool   `yaml:"pathStyle"`
+}
+
+// SftpPool tunes the connections shared between channels. Durations are in seconds.
+type SftpPool struct {
+	MaxSessions int `yaml:"maxSessions"`
+	IdleTimeout int `yaml:"idleTimeout"`
+	KeepAlive   int `yaml:"keepAlive"`
+	WaitTimeout int `yaml:"waitTimeout"`
+}
+
+// FilenameRule maps a source filename to the output filename.
+// Pattern is a regex with named captures, Template is a text/template
+// rendered with the captures plus channel, seq, source and name, and meta, the
+// values captured from the preamble of the file. seq numbers the files of a run
+// in name order from 1, the files of an archive are numbered among themselves.
+// When DateLayout is set, the "date" capture is parsed with it so the
+// template can reformat it, e.g. {{.date | format "20060102"}}. An empty
+// capture, of an optional date group, stays empty. Without DateLayout the date
+// is text, which format rejects.
+type FilenameRule struct {
+	Pattern    string `yaml:"pattern"`
+	Template   string `yaml:"template"`
+	DateLayout string `yaml:"dateLayout"`
+}
+
+// Schema describes how the values of a workbook are normalized before they are written.
+// Columns are matched by header name, so they keep working when the partner inserts a column.
+// Header replaces the header the channel expects from the partner. Its columns are found by name
+// or by the Aliases of the column, ignoring case, spaces and punctuation, in any order, and
+// delivered in the order of Header under its names. Other columns of the partner are reported as
+// unexpected, or left out with IgnoreUnknownColumns. The last column of Header may have any name
+// when the file has as many columns as Header, as before Header was matched by name.
+// StrictHeader requires the names of Header in its order instead, except the last one, and no
+// other columns. Transforms and DropWhen are
+// expr-lang expressions evaluated per row after the columns are normalized, see Transform.
+// When Output is set, the csv has exactly the Output columns in that order instead of the
+// partner's columns.
+type Schema struct {
+	Header       []string `yaml:"header"`
+	StrictHeader bool     `yaml:"strictHeader"`
+	// IgnoreUnknownColumns leaves out the columns no layout knows instead of rejecting the file
+	IgnoreUnknownColumns bool `yaml:"ignoreUnknownColumns"`
+	// Versions are other layouts of the partner's file, delivered in the layout of Header
+	Versions   []SchemaVersion `yaml:"versions"`
+	Columns    []Column        `yaml:"columns"`
+	Transforms []Transform     `yaml:"transforms"`
+	// rows for which any of the conditions is true are not delivered
+	DropWhen []string       `yaml:"dropWhen"`
+	Output   []OutputColumn `yaml:"output"`
+}
+
+// SchemaVersion is a layout of the partner's file in effect from EffectiveFrom (2006-01-02),
+// or always without it. EffectiveFrom is compared with the date of the file: the first preamble
+// field with a dateLayout, else the date of the filename rule, else the day it is processed. A
+// version stays in effect once a newer one takes effect, so late files in the older layout are
+// still read. Its Header has columns of the schema Header, by name or alias, the columns it
+// doesn't have are delivered empty. A file matching neither the schema Header nor a version in
+// effect is reported as a new format, compared with the closest layout. A new format is reported
+// for the first file that has it and recorded in the ledger, later files with the same header
+// fail without another report.
+type SchemaVersion struct {
+	Name          string   `yaml:"name"`
+	EffectiveFrom string   `yaml:"effectiveFrom"`
+	Header        []string `yaml:"header"`
+}
+
+// Transform sets Column, an existing or a new one, to the result of Expr. Expressions see the
+// columns of the row by name, with any character that is not a letter, digit or underscore
+// replaced by "_" (or as $env["TRANSACTION TYPE"]), and the file as file.channel, file.source,
+// file.output and file.runId. Number columns are numbers, other columns are strings.
+// A number set to a column of type number is written with the Decimals and DecimalSeparator of
+// the column. Transforms run in order, so later ones see the columns set by earlier ones.
+type Transform struct {
+	Column string `yaml:"column"`
+	Expr   string `yaml:"expr"`
+}
+
+// OutputColumn is a column of the delivered csv. Its value is taken From a column of the
+// partner's file, is the constant Value, a Field of the file (channel, source, output or runId)
+// or the Concat of other values joined with Separator. Name defaults to From, and a column with
+// only a Name is taken From the column of that name. An empty column is an empty Value ("").
+type OutputColumn struct {
+	Name      string         `yaml:"name"`
+	From      string         `yaml:"from"`
+	Value     *string        `yaml:"value"`
+	Field     string         `yaml:"field"`
+	Concat    []OutputColumn `yaml:"concat"`
+	Separator string         `yaml:"separator"`
+}
+
+// Column normalizes the values of the column Name. Type number writes the raw cell value
+// without thousands separators, with Decimals decimal places (as read when unset) and
+// DecimalSeparator ("." by default). Numbers stored in cells are read as they are, text values
+// and the values of text files have the decimal separator InputDecimalSeparator, "." with ","
+// separating thousands by default, or "," with "." separating thousands. Thousands may also be
+// separated by spaces. Thousands must be grouped by three, other values like 1,5 or 1 5 are
+// rejected. Type text, or no type, leaves the values as read.
+//
+// Types date, time and datetime parse the value with the first matching of Layouts, or as an
+// Excel serial date, in Timezone (WIB, WITA, WIT, UTC or an IANA name, WIB by default) and write
+// it with Layout in OutputTimezone (Timezone by default). A date column with TimeColumn set is
+// merged with the time of that column, read with the Layouts of the time column when it has type
+// time, into an ISO-8601 value and the time column is dropped.
+// Aliases are other names the partner uses for the column in the header.
+type Column struct {
+	Name                  string   `yaml:"name"`
+	Aliases               []string `yaml:"aliases"`
+	Type                  string   `yaml:"type"`
+	Decimals              *int     `yaml:"decimals"`
+	DecimalSeparator      string   `yaml:"decimalSeparator"`
+	InputDecimalSeparator string   `yaml:"inputDecimalSeparator"`
+	Layouts               []string `yaml:"layouts"`
+	Layout                string   `yaml:"layout"`
+	Timezone              string   `yaml:"timezone"`
+	OutputTimezone        string   `yaml:"outputTimezone"`
+	TimeColumn            string   `yaml:"timeColumn"`
+}
+
+// Channels returns the channel configs by channel name.
+func (c *Config) Channels() map[string]Channel {
+	channels := map[string]Channel{
+		"ovo":      c.Ovo,
+		"indodana": c.Indodana,
+	}
+	for name, channel := range channels {
+		if channel.SftpSource.Host == "" {
+			channel.SftpSource = c.Sftp
+		}
+		if channel.SftpDestination.Host == "" {
+			channel.SftpDestination = c.Sftp
+		}
+		channels[name] = channel
+	}
+	return channels
+}
+
 func (c *Config) LoadYAML(filename *string) error {
 	raw, err := ioutil.ReadFile(*filename)
 	if err != nil {
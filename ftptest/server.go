@@ -0,0 +1,456 @@
+// Package ftptest runs an in-process FTP server on the local filesystem, in passive mode and
+// optionally with explicit TLS, so the FTP transport can be exercised without a partner server.
+package ftptest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"reconconverter/config"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	User     = "recon"
+	Password = "recon"
+)
+
+// Server serves Root over FTP on a random local port
+type Server struct {
+	Root string
+
+	listener net.Listener
+	tls      *tls.Config
+	// the client config of a TLS server
+	ca, cert, key string
+	wg            sync.WaitGroup
+
+	mu       sync.Mutex
+	commands []string
+}
+
+// NewServer starts serving root over plain FTP
+func NewServer(root string) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := &Server{Root: root, listener: listener}
+	server.wg.Add(1)
+	go server.serve()
+	return server, nil
+}
+
+// NewTLSServer starts serving root with explicit TLS. Its certificates are issued by a CA of
+// its own, written to dir with a client certificate the server requires.
+func NewTLSServer(root string, dir string) (*Server, error) {
+	ca, caKey, err := newCertificate(nil, nil, "ftptest CA")
+	if err != nil {
+		return nil, err
+	}
+	serverCert, serverKey, err := newCertificate(ca, caKey, "127.0.0.1")
+	if err != nil {
+		return nil, err
+	}
+	clientCert, clientKey, err := newCertificate(ca, caKey, User)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		Root: root,
+		ca:   filepath.Join(dir, "ca.pem"),
+		cert: filepath.Join(dir, "client.pem"),
+		key:  filepath.Join(dir, "client-key.pem"),
+	}
+	if err := writePEM(server.ca, "CERTIFICATE", ca.Raw); err != nil {
+		return nil, err
+	}
+	if err := writePEM(server.cert, "CERTIFICATE", clientCert.Raw); err != nil {
+		return nil, err
+	}
+	if err := writeKey(server.key, clientKey); err != nil {
+		return nil, err
+	}
+
+	clients := x509.NewCertPool()
+	clients.AddCert(ca)
+	server.tls = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clients,
+	}
+
+	server.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server.wg.Add(1)
+	go server.serve()
+	return server, nil
+}
+
+// Ftp returns the config a channel uses to connect to the server
+func (server *Server) Ftp() config.Ftp {
+	return config.Ftp{
+		Host:     "127.0.0.1",
+		Port:     server.listener.Addr().(*net.TCPAddr).Port,
+		User:     User,
+		Password: Password,
+		TLS:      server.tls != nil,
+		CAFile:   server.ca,
+		CertFile: server.cert,
+		KeyFile:  server.key,
+		Timeout:  5,
+	}
+}
+
+// Commands returns the verbs of the commands received so far, in order
+func (server *Server) Commands() []string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return append([]string(nil), server.commands...)
+}
+
+// Close stops accepting connections. Open connections end with their clients.
+func (server *Server) Close() error {
+	err := server.listener.Close()
+	server.wg.Wait()
+	return err
+}
+
+func (server *Server) serve() {
+	defer server.wg.Done()
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.handleConn(conn)
+	}
+}
+
+// session is the state of a control connection
+type session struct {
+	server   *Server
+	conn     net.Conn
+	reader   *bufio.Reader
+	user     string
+	loggedIn bool
+	private  bool
+	passive  net.Listener
+	renaming string
+}
+
+func (server *Server) handleConn(conn net.Conn) {
+	s := &session{server: server, conn: conn, reader: bufio.NewReader(conn)}
+	defer func() {
+		s.closePassive()
+		s.conn.Close()
+	}()
+
+	s.reply(220, "ftptest ready")
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		verb = strings.ToUpper(verb)
+
+		server.mu.Lock()
+		server.commands = append(server.commands, verb)
+		server.mu.Unlock()
+
+		if verb == "QUIT" {
+			s.reply(221, "bye")
+			return
+		}
+		if !s.handle(verb, arg) {
+			return
+		}
+	}
+}
+
+// handle answers a command, it returns false when the connection can't go on
+func (s *session) handle(verb string, arg string) bool {
+	switch verb {
+	case "AUTH":
+		if s.server.tls == nil || strings.ToUpper(arg) != "TLS" {
+			s.reply(502, "TLS not available")
+			return true
+		}
+		s.reply(234, "AUTH TLS successful")
+		conn := tls.Server(s.conn, s.server.tls)
+		if err := conn.Handshake(); err != nil {
+			logrus.Errorf("ftptest: handshake failed: %v", err)
+			return false
+		}
+		s.conn, s.reader = conn, bufio.NewReader(conn)
+		return true
+	case "USER":
+		if s.server.tls != nil {
+			if _, ok := s.conn.(*tls.Conn); !ok {
+				s.reply(530, "TLS required")
+				return true
+			}
+		}
+		s.user = arg
+		s.reply(331, "password required")
+		return true
+	case "PASS":
+		if s.user != User || arg != Password {
+			s.reply(530, "login incorrect")
+			return true
+		}
+		s.loggedIn = true
+		s.reply(230, "logged in")
+		return true
+	case "FEAT":
+		s.write("211-Features:\r\n EPSV\r\n PASV\r\n UTF8\r\n211 End\r\n")
+		return true
+	}
+
+	if !s.loggedIn {
+		s.reply(530, "not logged in")
+		return true
+	}
+
+	switch verb {
+	case "TYPE", "OPTS":
+		s.reply(200, "ok")
+	case "PBSZ":
+		s.reply(200, "PBSZ=0")
+	case "PROT":
+		s.private = strings.ToUpper(arg) == "P"
+		s.reply(200, "protection level set")
+	case "PASV":
+		port, err := s.listenPassive()
+		if err != nil {
+			s.reply(425, err.Error())
+			break
+		}
+		s.reply(227, fmt.Sprintf("Entering Passive Mode (127,0,0,1,%d,%d)", port/256, port%256))
+	case "EPSV":
+		port, err := s.listenPassive()
+		if err != nil {
+			s.reply(425, err.Error())
+			break
+		}
+		s.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+	case "LIST":
+		s.list(arg)
+	case "RETR":
+		s.retrieve(arg)
+	case "STOR":
+		s.store(arg)
+	case "RNFR":
+		if _, err := os.Stat(s.resolve(arg)); err != nil {
+			s.reply(550, "no such file")
+			break
+		}
+		s.renaming = arg
+		s.reply(350, "ready for RNTO")
+	case "RNTO":
+		from := s.renaming
+		s.renaming = ""
+		if from == "" {
+			s.reply(503, "RNFR required first")
+		} else if err := os.Rename(s.resolve(from), s.resolve(arg)); err != nil {
+			s.reply(550, err.Error())
+		} else {
+			s.reply(250, "renamed")
+		}
+	case "DELE":
+		if err := os.Remove(s.resolve(arg)); err != nil {
+			s.reply(550, err.Error())
+		} else {
+			s.reply(250, "deleted")
+		}
+	default:
+		s.reply(502, "command not implemented")
+	}
+	return true
+}
+
+// resolve maps a client path below Root, the working directory is Root
+func (s *session) resolve(name string) string {
+	return filepath.Join(s.server.Root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (s *session) listenPassive() (int, error) {
+	s.closePassive()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	s.passive = listener
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (s *session) closePassive() {
+	if s.passive != nil {
+		s.passive.Close()
+		s.passive = nil
+	}
+}
+
+// transfer runs fn on the data connection of the last PASV or EPSV and reports the result
+func (s *session) transfer(fn func(data net.Conn) error) {
+	if s.passive == nil {
+		s.reply(425, "use PASV or EPSV first")
+		return
+	}
+	s.passive.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
+	data, err := s.passive.Accept()
+	s.closePassive()
+	if err != nil {
+		s.reply(425, err.Error())
+		return
+	}
+	s.reply(150, "opening data connection")
+	if s.private {
+		// handshake before an empty transfer closes the connection
+		conn := tls.Server(data, s.server.tls)
+		if err = conn.Handshake(); err != nil {
+			data.Close()
+			s.reply(425, err.Error())
+			return
+		}
+		data = conn
+	}
+	// the client may hang up first once it has read everything
+	err = fn(data)
+	data.Close()
+	if err != nil {
+		s.reply(426, err.Error())
+		return
+	}
+	s.reply(226, "transfer complete")
+}
+
+func (s *session) list(arg string) {
+	dir := s.resolve(arg)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		s.reply(550, err.Error())
+		return
+	}
+	s.transfer(func(data net.Conn) error {
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			mode := "-rw-r--r--"
+			if info.IsDir() {
+				mode = "drwxr-xr-x"
+			}
+			line := fmt.Sprintf("%s 1 %s %s %d %s %s\r\n", mode, User, User, info.Size(), info.ModTime().Format("Jan _2 15:04"), info.Name())
+			if _, err := io.WriteString(data, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *session) retrieve(name string) {
+	file, err := os.Open(s.resolve(name))
+	if err != nil {
+		s.reply(550, err.Error())
+		return
+	}
+	defer file.Close()
+	s.transfer(func(data net.Conn) error {
+		_, err := io.Copy(data, file)
+		return err
+	})
+}
+
+func (s *session) store(name string) {
+	file, err := os.Create(s.resolve(name))
+	if err != nil {
+		s.reply(553, err.Error())
+		return
+	}
+	defer file.Close()
+	s.transfer(func(data net.Conn) error {
+		_, err := io.Copy(file, data)
+		return err
+	})
+}
+
+func (s *session) reply(code int, message string) {
+	s.write(fmt.Sprintf("%d %s\r\n", code, message))
+}
+
+func (s *session) write(text string) {
+	if _, err := io.WriteString(s.conn, text); err != nil {
+		logrus.Errorf("ftptest: failed to reply: %v", err)
+	}
+}
+
+// newCertificate issues a certificate for name, self-signed without a parent
+func newCertificate(parent *x509.Certificate, parentKey *ecdsa.PrivateKey, name string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(raw)
+	return cert, key, err
+}
+
+func writePEM(path string, blockType string, data []byte) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600)
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	raw, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "EC PRIVATE KEY", raw)
+}
@@ -0,0 +1,139 @@
+// Package golden converts a corpus of workbooks and compares the result byte for byte
+// with the expected output kept next to each workbook, so a change to the reading or
+// writing of files can prove it does not change what recon receives.
+package golden
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reconconverter/config"
+	"reconconverter/handler"
+	"reconconverter/output"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-yaml/yaml"
+)
+
+var update = flag.Bool("update", false, "rewrite the expected files of the golden corpus from the current output")
+
+var channelNames = []string{"ovo", "indodana"}
+
+// sources of the corpus. Text sources end in .input, their extension would clash with the expected csv.
+var sourcePatterns = []string{"*.xlsx", "*.xls", "*.ods", "*.input", "*.pgp"}
+
+// TestGolden converts every workbook and text file of testdata/golden/<channel>. A converted workbook is
+// compared with the first output of the same name, e.g. the .csv, a rejected one with the .err holding the
+// notification reason. A .yaml of the same name holds the channel config of the workbook, the defaults are
+// used without it. Relative secret and keyring files in it are relative to the directory of the workbook.
+// With -update the expected files are rewritten instead.
+func TestGolden(t *testing.T) {
+	found := 0
+	for _, channelName := range channelNames {
+		var sources []string
+		for _, pattern := range sourcePatterns {
+			matches, err := filepath.Glob(filepath.Join("..", "testdata", "golden", channelName, pattern))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sources = append(sources, matches...)
+		}
+		sort.Strings(sources)
+		found += len(sources)
+
+		for _, source := range sources {
+			t.Run(channelName+"/"+filepath.Base(source), func(t *testing.T) {
+				check(t, channelName, source)
+			})
+		}
+	}
+	if found == 0 {
+		t.Fatal("no workbooks found in testdata/golden")
+	}
+}
+
+func check(t *testing.T, channelName string, source string) {
+	base := strings.TrimSuffix(source, filepath.Ext(source))
+
+	channel := config.Channel{}
+	if raw, err := os.ReadFile(base + ".yaml"); err == nil {
+		if err := yaml.Unmarshal(raw, &channel); err != nil {
+			t.Fatalf("%v.yaml: %v", base, err)
+		}
+	} else if !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	// secret and key files of a case are kept next to it
+	for _, path := range []*string{&channel.WorkbookPassword.File, &channel.Pgp.Passphrase.File, &channel.Pgp.PrivateKeyring, &channel.Pgp.VerifyKeyring} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(filepath.Dir(source), *path)
+		}
+	}
+
+	// the first output is compared, a workbook can't be expected next to the source workbook
+	writer, err := output.New(output.Outputs(channel)[0])
+	if err != nil {
+		t.Fatalf("%v.yaml: %v", base, err)
+	}
+	if writer.Extension == ".xlsx" {
+		t.Fatalf("%v.yaml: the first output can't be xlsx", base)
+	}
+
+	actual := new(bytes.Buffer)
+	expectedFile, stale := base+writer.Extension, base+".err"
+	if err := handler.Convert(channelName, channel, source, actual); err != nil {
+		actual.Reset()
+		actual.WriteString(handler.ErrorReason(err) + "\n")
+		expectedFile, stale = stale, expectedFile
+	}
+
+	if *update {
+		if err := os.WriteFile(expectedFile, actual.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(stale); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		t.Logf("updated %v", filepath.Base(expectedFile))
+		return
+	}
+
+	expected, err := os.ReadFile(expectedFile)
+	if os.IsNotExist(err) {
+		t.Fatalf("%v does not exist, run with -update to create it", filepath.Base(expectedFile))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := diff(expected, actual.Bytes()); d != "" {
+		t.Errorf("%v: %v", filepath.Base(expectedFile), d)
+	}
+}
+
+// diff describes the first line that differs, or returns empty when both are equal
+func diff(expected []byte, actual []byte) string {
+	if bytes.Equal(expected, actual) {
+		return ""
+	}
+
+	expectedLines := strings.SplitAfter(string(expected), "\n")
+	actualLines := strings.SplitAfter(string(actual), "\n")
+	for i := 0; i < len(expectedLines) || i < len(actualLines); i++ {
+		var want, got string
+		if i < len(expectedLines) {
+			want = expectedLines[i]
+		}
+		if i < len(actualLines) {
+			got = actualLines[i]
+		}
+		if want != got {
+			return fmt.Sprintf("line %d\n  expected: %q\n  actual:   %q", i+1, want, got)
+		}
+	}
+
+	return "content differs"
+}
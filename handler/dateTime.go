@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Indonesian time zones have no daylight saving, fixed offsets don't depend on the tz database
+var timezones = map[string]*time.Location{
+	"WIB":  time.FixedZone("WIB", 7*60*60),
+	"WITA": time.FixedZone("WITA", 8*60*60),
+	"WIT":  time.FixedZone("WIT", 9*60*60),
+	"UTC":  time.UTC,
+}
+
+// layouts accepted when a column doesn't configure its own
+var defaultLayouts = map[string][]string{
+	ColumnDate: {
+		"2006-01-02", "02/01/2006", "02-01-2006", "2006/01/02", "20060102",
+		"2006-01-02 15:04:05", "02/01/2006 15:04:05", "02-01-2006 15:04:05", time.RFC3339,
+	},
+	ColumnTime:     {"15:04:05", "15:04", "15.04.05", "3:04:05 PM"},
+	ColumnDateTime: {time.RFC3339, "2006-01-02 15:04:05", "02/01/2006 15:04:05", "02-01-2006 15:04:05", "2006-01-02T15:04:05"},
+}
+
+// output layouts when a column doesn't configure its own
+var defaultOutputLayouts = map[string]string{
+	ColumnDate:     "2006-01-02",
+	ColumnTime:     "15:04:05",
+	ColumnDateTime: time.RFC3339,
+}
+
+// 9999-12-31, larger numbers are text like 20240327
+const maxExcelSerial = 2958465
+
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		name = "WIB"
+	}
+	if loc, ok := timezones[strings.ToUpper(name)]; ok {
+		return loc, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// parseTime reads a cell as a date or time in loc. Numbers are Excel serial dates,
+// where the fraction is the time of day.
+func parseTime(value string, layouts []string, loc *time.Location, date1904 bool) (time.Time, error) {
+	if serial, err := strconv.ParseFloat(value, 64); err == nil && serial >= 0 && serial <= maxExcelSerial {
+		if serial < 1 {
+			// a time without date
+			seconds := math.Round(serial * 24 * 60 * 60)
+			return time.Date(0, 1, 1, 0, 0, 0, 0, loc).Add(time.Duration(seconds) * time.Second), nil
+		}
+		t, err := excelize.ExcelDateToTime(serial, date1904)
+		if err != nil {
+			return time.Time{}, err
+		}
+		t = t.Round(time.Second)
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc), nil
+	}
+
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q does not match any of %v", value, layouts)
+}
+
+// withTimeOf returns date at the time of day of clock
+func withTimeOf(date time.Time, clock time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), clock.Hour(), clock.Minute(), clock.Second(), clock.Nanosecond(), date.Location())
+}
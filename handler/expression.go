@@ -0,0 +1,258 @@
+package handler
+
+import (
+	"fmt"
+	"reconconverter/config"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// expressions are limited so a bad config can't make a run crawl
+const maxExpressionNodes = 1000
+
+var notIdentifier = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// identifier returns the name of a column in expressions
+func identifier(column string) string {
+	return notIdentifier.ReplaceAllString(column, "_")
+}
+
+// rowScope is what the expressions of a schema can see of a row
+type rowScope struct {
+	columns []string
+	// a value of the type of every column, for type checking at config load
+	samples map[string]interface{}
+	// the decimal separator of every number column
+	numbers map[string]string
+	rules   map[string]columnRule
+}
+
+func newRowScope(columns []string, rules map[string]columnRule) *rowScope {
+	scope := &rowScope{samples: make(map[string]interface{}), numbers: make(map[string]string), rules: rules}
+	for _, name := range columns {
+		rule := rules[name]
+		if rule.kind == ColumnNumber {
+			scope.numbers[name] = rule.decimalSeparator
+			scope.add(name, float64(0))
+		} else {
+			scope.add(name, "")
+		}
+	}
+	return scope
+}
+
+func (scope *rowScope) add(name string, sample interface{}) {
+	if indexOf(scope.columns, name) < 0 {
+		scope.columns = append(scope.columns, name)
+	}
+	scope.samples[name] = sample
+}
+
+func (scope *rowScope) env(values map[string]interface{}, fields FileFields) map[string]interface{} {
+	env := make(map[string]interface{}, 2*len(values)+1)
+	for name, value := range values {
+		env[name] = value
+		env[identifier(name)] = value
+	}
+	env["file"] = map[string]string{
+		FieldChannel: fields.Channel,
+		FieldSource:  fields.Source,
+		FieldOutput:  fields.Output,
+		FieldRunID:   fields.RunID,
+	}
+	return env
+}
+
+func (scope *rowScope) compile(code string, options ...expr.Option) (*vm.Program, error) {
+	options = append([]expr.Option{expr.Env(scope.env(scope.samples, FileFields{})), expr.MaxNodes(maxExpressionNodes)}, options...)
+	return expr.Compile(code, options...)
+}
+
+// values returns the typed values of a row. Empty number cells are 0.
+func (scope *rowScope) values(row []string) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(scope.columns))
+	for col, name := range scope.columns {
+		var value string
+		if col < len(row) {
+			value = row[col]
+		}
+
+		separator, ok := scope.numbers[name]
+		if !ok {
+			values[name] = value
+			continue
+		}
+		if value == "" {
+			values[name] = float64(0)
+			continue
+		}
+		number, err := strconv.ParseFloat(strings.Replace(value, separator, ".", 1), 64)
+		if err != nil {
+			return nil, fmt.Errorf("column %v: %q is not a number", name, value)
+		}
+		values[name] = number
+	}
+	return values, nil
+}
+
+type transformRule struct {
+	column  string
+	program *vm.Program
+}
+
+// compileTransforms type checks the transforms and adds the columns they set to scope
+func compileTransforms(transforms []config.Transform, scope *rowScope) ([]transformRule, error) {
+	var compiled []transformRule
+	for _, transform := range transforms {
+		if transform.Column == "" {
+			return nil, fmt.Errorf("transform %q has no column", transform.Expr)
+		}
+		program, err := scope.compile(transform.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("transform of %v: %v", transform.Column, err)
+		}
+
+		// later expressions see the type of the result
+		var sample interface{}
+		switch resultType := program.Node().Type(); {
+		case resultType == nil:
+		case isNumber(resultType.Kind()):
+			sample = float64(0)
+			if _, ok := scope.numbers[transform.Column]; !ok {
+				scope.numbers[transform.Column] = "."
+				if rule, ok := scope.rules[transform.Column]; ok && rule.kind == ColumnNumber {
+					scope.numbers[transform.Column] = rule.decimalSeparator
+				}
+			}
+		case resultType.Kind() == reflect.String:
+			sample = ""
+			delete(scope.numbers, transform.Column)
+		case resultType.Kind() == reflect.Bool:
+			sample = false
+		}
+		scope.add(transform.Column, sample)
+
+		compiled = append(compiled, transformRule{column: transform.Column, program: program})
+	}
+	return compiled, nil
+}
+
+func isNumber(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func compileConditions(conditions []string, scope *rowScope) ([]*vm.Program, error) {
+	var compiled []*vm.Program
+	for _, condition := range conditions {
+		program, err := scope.compile(condition, expr.AsBool())
+		if err != nil {
+			return nil, fmt.Errorf("dropWhen %q: %v", condition, err)
+		}
+		compiled = append(compiled, program)
+	}
+	return compiled, nil
+}
+
+// evaluate runs the transforms on the rows of content and removes the dropped rows.
+// content starts with the header, columns set by transforms are appended to it.
+func evaluate(scope *rowScope, transforms []transformRule, dropWhen []*vm.Program, content [][]string, fields FileFields) ([][]string, error) {
+	header := append([]string{}, content[0]...)
+	for _, transform := range transforms {
+		if indexOf(header, transform.column) < 0 {
+			header = append(header, transform.column)
+		}
+	}
+
+	kept := [][]string{header}
+	for idx := 1; idx < len(content); idx++ {
+		row := make([]string, len(header))
+		copy(row, content[idx])
+
+		values, err := scope.values(row)
+		if err != nil {
+			return nil, fmt.Errorf("row %d %v", idx+1, err)
+		}
+		env := scope.env(values, fields)
+
+		for _, transform := range transforms {
+			value, err := expr.Run(transform.program, env)
+			if err != nil {
+				return nil, fmt.Errorf("row %d transform of %v: %v", idx+1, transform.column, err)
+			}
+			env[transform.column] = value
+			env[identifier(transform.column)] = value
+			row[indexOf(header, transform.column)] = scope.format(transform.column, value)
+		}
+
+		dropped := false
+		for _, condition := range dropWhen {
+			drop, err := expr.Run(condition, env)
+			if err != nil {
+				return nil, fmt.Errorf("row %d dropWhen: %v", idx+1, err)
+			}
+			if drop.(bool) {
+				dropped = true
+				break
+			}
+		}
+		if !dropped {
+			kept = append(kept, row)
+		}
+	}
+	return kept, nil
+}
+
+// format writes the result of an expression as a cell of column, a number with the decimals of
+// the number column of that name
+func (scope *rowScope) format(column string, value interface{}) string {
+	decimals := -1
+	if rule, ok := scope.rules[column]; ok && rule.kind == ColumnNumber {
+		decimals = rule.decimals
+	}
+	return formatValue(value, decimals, scope.numbers[column])
+}
+
+// formatValue writes the result of an expression as a cell. Negative decimals keep the digits of
+// the number.
+func formatValue(value interface{}, decimals int, decimalSeparator string) string {
+	if decimalSeparator == "" {
+		decimalSeparator = "."
+	}
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return formatNumber(v, decimals, decimalSeparator)
+	case float32:
+		return formatNumber(float64(v), decimals, decimalSeparator)
+	case int:
+		if decimals < 0 {
+			return strconv.Itoa(v)
+		}
+		return formatNumber(float64(v), decimals, decimalSeparator)
+	case int64:
+		if decimals < 0 {
+			return strconv.FormatInt(v, 10)
+		}
+		return formatNumber(float64(v), decimals, decimalSeparator)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"reconconverter/config"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// used when a channel doesn't configure its own patterns
+var (
+	defaultInclude = []string{"*.xlsx", "*.xls", "*.ods", "*.csv", "*.pgp", "*.gpg", "*.asc", "*.zip", "*.gz", "*.tgz"}
+	defaultExclude = []string{".*", "*.tmp", "*.part", "*.filepart", "*:Zone.Identifier"}
+)
+
+type nameMatcher func(name string) bool
+
+type fileObservation struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// FileFilter decides which files of a source directory are ready to be processed.
+type FileFilter struct {
+	include    []nameMatcher
+	exclude    []nameMatcher
+	stableFor  time.Duration
+	doneMarker string
+
+	mu       sync.Mutex
+	observed map[string]fileObservation
+	// whether the last Select held back files that were still changing
+	unstable bool
+	// the files the last Select held back, with the reason
+	held []string
+	now  func() time.Time
+}
+
+func NewFileFilter(channel config.Channel) (*FileFilter, error) {
+	include, exclude := channel.Include, channel.Exclude
+	if len(include) == 0 {
+		include = defaultInclude
+	}
+	if len(exclude) == 0 {
+		exclude = defaultExclude
+	}
+
+	filter := &FileFilter{
+		stableFor:  time.Duration(channel.StableSeconds) * time.Second,
+		doneMarker: channel.DoneMarker,
+		observed:   make(map[string]fileObservation),
+		now:        time.Now,
+	}
+
+	var err error
+	if filter.include, err = compileMatchers(include); err != nil {
+		return nil, err
+	}
+	if filter.exclude, err = compileMatchers(exclude); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+func compileMatchers(patterns []string) ([]nameMatcher, error) {
+	var matchers []nameMatcher
+	for _, pattern := range patterns {
+		if expr, ok := strings.CutPrefix(pattern, "regex:"); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %v: %v", pattern, err)
+			}
+			matchers = append(matchers, re.MatchString)
+			continue
+		}
+
+		glob := strings.ToLower(pattern)
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %v: %v", pattern, err)
+		}
+		matchers = append(matchers, func(name string) bool {
+			matched, _ := path.Match(glob, strings.ToLower(name))
+			return matched
+		})
+	}
+	return matchers, nil
+}
+
+func matchAny(matchers []nameMatcher, name string) bool {
+	for _, match := range matchers {
+		if match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches reports whether name matches the include patterns and none of the exclude patterns
+func (filter *FileFilter) Matches(name string) bool {
+	return matchAny(filter.include, name) && !matchAny(filter.exclude, name)
+}
+
+// Select returns the files that match the patterns, are not done markers themselves,
+// have their done marker uploaded and are stable: seen with the same size and mtime by
+// selections at least stableFor apart. A file is never stable the first time it is seen, its
+// mtime alone can't be trusted, some clients set it before the upload completes.
+func (filter *FileFilter) Select(files []os.FileInfo) []os.FileInfo {
+	names := make(map[string]bool)
+	for _, file := range files {
+		names[file.Name()] = true
+	}
+
+	now := filter.now()
+	var selected []os.FileInfo
+
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+
+	seen := make(map[string]fileObservation)
+	filter.unstable = false
+	filter.held = nil
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !filter.Matches(name) {
+			continue
+		}
+		if filter.doneMarker != "" {
+			if strings.HasSuffix(name, filter.doneMarker) {
+				continue
+			}
+			if !names[name+filter.doneMarker] {
+				filter.held = append(filter.held, name+" is waiting for its done marker")
+				continue
+			}
+		}
+
+		observation := fileObservation{size: file.Size(), modTime: file.ModTime(), since: now}
+		if previous, ok := filter.observed[name]; ok && previous.size == observation.size && previous.modTime.Equal(observation.modTime) {
+			observation.since = previous.since
+		}
+		seen[name] = observation
+
+		if filter.stableFor > 0 && now.Sub(observation.since) < filter.stableFor {
+			filter.unstable = true
+			filter.held = append(filter.held, name+" is not stable yet")
+			continue
+		}
+
+		selected = append(selected, file)
+	}
+	// forget files that are gone from the directory
+	filter.observed = seen
+
+	return selected
+}
+
+// Unstable reports whether the last Select held back files that were still changing.
+func (filter *FileFilter) Unstable() bool {
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+	return filter.unstable
+}
+
+// Held describes the files the last Select held back, not yet stable or waiting for their done
+// marker
+func (filter *FileFilter) Held() []string {
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+	return filter.held
+}
+
+// DoneMarker returns the marker filename of name, or empty when the channel doesn't use markers.
+func (filter *FileFilter) DoneMarker(name string) string {
+	if filter.doneMarker == "" {
+		return ""
+	}
+	return name + filter.doneMarker
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"os"
+	"reconconverter/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (f fileInfo) Name() string       { return f.name }
+func (f fileInfo) Size() int64        { return f.size }
+func (f fileInfo) Mode() os.FileMode  { return 0644 }
+func (f fileInfo) ModTime() time.Time { return f.modTime }
+func (f fileInfo) IsDir() bool        { return false }
+func (f fileInfo) Sys() interface{}   { return nil }
+
+func selectedNames(files []os.FileInfo) []string {
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	return names
+}
+
+func TestFileFilterStability(t *testing.T) {
+	filter, err := NewFileFilter(config.Channel{StableSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 28, 1, 0, 0, 0, time.UTC)
+	filter.now = func() time.Time { return now }
+
+	// the mtime of an upload in progress may already be old
+	old := now.Add(-time.Hour)
+	file := fileInfo{name: "a.xlsx", size: 100, modTime: old}
+
+	if got := filter.Select([]os.FileInfo{file}); len(got) != 0 {
+		t.Fatalf("first sight selected %v", selectedNames(got))
+	}
+	if !filter.Unstable() {
+		t.Errorf("first sight is not reported as unstable")
+	}
+	if held := filter.Held(); len(held) != 1 || !strings.HasPrefix(held[0], "a.xlsx ") {
+		t.Errorf("held %v, want a.xlsx", held)
+	}
+
+	// still growing
+	now = now.Add(90 * time.Second)
+	file.size = 200
+	if got := filter.Select([]os.FileInfo{file}); len(got) != 0 {
+		t.Fatalf("growing file selected %v", selectedNames(got))
+	}
+
+	// unchanged, but not for long enough
+	now = now.Add(30 * time.Second)
+	if got := filter.Select([]os.FileInfo{file}); len(got) != 0 {
+		t.Fatalf("file unchanged for 30s selected %v", selectedNames(got))
+	}
+
+	now = now.Add(30 * time.Second)
+	if got := filter.Select([]os.FileInfo{file}); len(got) != 1 {
+		t.Fatalf("file unchanged for 60s not selected")
+	}
+	if filter.Unstable() {
+		t.Errorf("stable file reported as unstable")
+	}
+	if held := filter.Held(); len(held) != 0 {
+		t.Errorf("held %v after the file was selected", held)
+	}
+}
+
+func TestFileFilterWithoutStability(t *testing.T) {
+	filter, err := NewFileFilter(config.Channel{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []os.FileInfo{
+		fileInfo{name: "a.xlsx", size: 1},
+		fileInfo{name: ".hidden.xlsx", size: 1},
+		fileInfo{name: "notes.txt", size: 1},
+		fileInfo{name: "b.xlsx.part", size: 1},
+	}
+	got := selectedNames(filter.Select(files))
+	if len(got) != 1 || got[0] != "a.xlsx" {
+		t.Errorf("got %v, want [a.xlsx]", got)
+	}
+}
+
+func TestFileFilterDoneMarker(t *testing.T) {
+	filter, err := NewFileFilter(config.Channel{DoneMarker: ".done", Include: []string{"*.xlsx", "*.done"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []os.FileInfo{
+		fileInfo{name: "a.xlsx"},
+		fileInfo{name: "a.xlsx.done"},
+		fileInfo{name: "b.xlsx"},
+	}
+	got := selectedNames(filter.Select(files))
+	if len(got) != 1 || got[0] != "a.xlsx" {
+		t.Errorf("got %v, want [a.xlsx]", got)
+	}
+	if held := filter.Held(); len(held) != 1 || !strings.HasPrefix(held[0], "b.xlsx ") {
+		t.Errorf("held %v, want b.xlsx", held)
+	}
+}
@@ -0,0 +1,306 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"reconconverter/config"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// default rules keep the naming the converter used before rules were configurable, an ovo file
+// without a date keeps its name
+var defaultFilenameRules = map[string]config.FilenameRule{
+	"ovo": {
+		Pattern:    `^(?P<prefix>.*?)(?:(?P<date>\d{2}-\d{2}-\d{4})(?P<suffix>.*?))?(\.(?:xlsx|xls|ods|csv))?(\.(?:pgp|gpg|asc))?$`,
+		Template:   `{{.prefix}}{{.date | format "20060102"}}{{.suffix}}.csv`,
+		DateLayout: "02-01-2006",
+	},
+	"indodana": {
+		Pattern:  `^(?P<base>.*?)(\.(?:xlsx|xls|ods|csv))?(\.(?:pgp|gpg|asc))?$`,
+		Template: `{{.base | replace "_yokke-ptp" ""}}.csv`,
+	},
+}
+
+var filenameFuncs = template.FuncMap{
+	"format": func(layout string, value interface{}) (string, error) {
+		switch v := value.(type) {
+		case time.Time:
+			return v.Format(layout), nil
+		case string:
+			// the capture of an optional date the filename doesn't have
+			if v == "" {
+				return "", nil
+			}
+			return "", fmt.Errorf("cannot format %q, it is not a date, set the dateLayout of the filename rule", v)
+		}
+		return "", fmt.Errorf("cannot format %v", value)
+	},
+	"replace": func(old, new string, value interface{}) string {
+		return strings.ReplaceAll(fmt.Sprint(value), old, new)
+	},
+}
+
+type FilenameRule struct {
+	channelName string
+	pattern     *regexp.Regexp
+	template    *template.Template
+	dateLayout  string
+	// the template uses the values captured from the preamble, known once the file is read
+	usesMeta bool
+}
+
+// NewFilenameRule compiles the rule of a channel. An empty rule falls back to the channel default.
+func NewFilenameRule(channelName string, rule config.FilenameRule) (*FilenameRule, error) {
+	if rule.Pattern == "" && rule.Template == "" {
+		rule = defaultFilenameRules[channelName]
+	}
+	if rule.Pattern == "" || rule.Template == "" {
+		return nil, fmt.Errorf("filename rule of %v needs both pattern and template", channelName)
+	}
+
+	re, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filename pattern of %v: %v", channelName, err)
+	}
+
+	tmpl, err := template.New(channelName).Funcs(filenameFuncs).Option("missingkey=error").Parse(rule.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filename template of %v: %v", channelName, err)
+	}
+
+	return &FilenameRule{
+		channelName: channelName,
+		pattern:     re,
+		template:    tmpl,
+		dateLayout:  rule.DateLayout,
+		usesMeta:    usesField(tmpl, "meta"),
+	}, nil
+}
+
+// usesField reports whether the templates of tmpl may read the field name of their data. A
+// template passing its data on as a whole, like {{index . "meta"}}, may read any field.
+func usesField(tmpl *template.Template, name string) bool {
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil && nodeUsesField(t.Tree.Root, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeUsesField(node parse.Node, name string) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if nodeUsesField(child, name) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeUsesField(n.Pipe, name)
+	case *parse.IfNode:
+		return nodeUsesField(n.Pipe, name) || nodeUsesField(n.List, name) || nodeUsesField(n.ElseList, name)
+	case *parse.RangeNode:
+		return nodeUsesField(n.Pipe, name) || nodeUsesField(n.List, name) || nodeUsesField(n.ElseList, name)
+	case *parse.WithNode:
+		return nodeUsesField(n.Pipe, name) || nodeUsesField(n.List, name) || nodeUsesField(n.ElseList, name)
+	case *parse.TemplateNode:
+		return nodeUsesField(n.Pipe, name)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if nodeUsesField(cmd, name) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if nodeUsesField(arg, name) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return nodeUsesField(n.Node, name)
+	case *parse.FieldNode:
+		return n.Ident[0] == name
+	case *parse.VariableNode:
+		// $ is the data, other variables hold what the template read
+		return n.Ident[0] == "$" && (len(n.Ident) == 1 || n.Ident[1] == name)
+	case *parse.DotNode:
+		return true
+	}
+	return false
+}
+
+// UsesMeta reports whether output names can only be rendered once the file is read
+func (rule *FilenameRule) UsesMeta() bool {
+	return rule.usesMeta
+}
+
+// Date returns the date captured from the filename source, when the rule has a DateLayout
+func (rule *FilenameRule) Date(source string) (time.Time, bool) {
+	index := rule.pattern.SubexpIndex("date")
+	match := rule.pattern.FindStringSubmatch(source)
+	if rule.dateLayout == "" || index < 0 || match == nil || match[index] == "" {
+		return time.Time{}, false
+	}
+	date, err := time.Parse(rule.dateLayout, match[index])
+	return date, err == nil
+}
+
+// Apply renders the output filename of source. seq is the number Sequence gives the file, meta
+// the values captured from the preamble of the file.
+func (rule *FilenameRule) Apply(source string, seq int, meta map[string]interface{}) (string, error) {
+	match := rule.pattern.FindStringSubmatch(source)
+	if match == nil {
+		return "", fmt.Errorf("filename %v does not match pattern %v", source, rule.pattern)
+	}
+
+	fields := map[string]interface{}{
+		"channel": rule.channelName,
+		"seq":     seq,
+		"source":  source,
+		"name":    strings.TrimSuffix(source, path.Ext(source)),
+		"meta":    meta,
+	}
+	if meta == nil {
+		fields["meta"] = map[string]interface{}{}
+	}
+	for i, name := range rule.pattern.SubexpNames() {
+		if name != "" {
+			fields[name] = match[i]
+		}
+	}
+
+	// an optional date the filename doesn't have stays empty
+	if date, ok := fields["date"].(string); ok && date != "" && rule.dateLayout != "" {
+		parsed, err := time.Parse(rule.dateLayout, date)
+		if err != nil {
+			return "", fmt.Errorf("invalid date %v in filename %v: %v", date, source, err)
+		}
+		fields["date"] = parsed
+	}
+
+	buf := new(bytes.Buffer)
+	if err := rule.template.Execute(buf, fields); err != nil {
+		return "", err
+	}
+
+	newFilename := buf.String()
+	if newFilename == "" || strings.ContainsAny(newFilename, "/\\") {
+		return "", fmt.Errorf("invalid output filename %q for %v", newFilename, source)
+	}
+
+	return newFilename, nil
+}
+
+// RenameResult is the mapping of a single source file.
+type RenameResult struct {
+	Source    string
+	Output    string
+	Err       error
+	Collision bool
+}
+
+// Sequence numbers files by their name, 1 for the first in name order, whatever order they are
+// listed or processed in. The files of a run are numbered together, archives included, and the
+// files of an archive among themselves.
+func Sequence(files []string) map[string]int {
+	sorted := append([]string{}, files...)
+	sort.Strings(sorted)
+	seqs := make(map[string]int, len(sorted))
+	for i, file := range sorted {
+		seqs[file] = i + 1
+	}
+	return seqs
+}
+
+// MapFilenames applies the rule to every source, numbered by seqs, and flags the sources sharing
+// an output name.
+func (rule *FilenameRule) MapFilenames(sources []string, seqs map[string]int) []RenameResult {
+	results := make([]RenameResult, len(sources))
+	byOutput := make(map[string][]int)
+	for i, source := range sources {
+		output, err := rule.Apply(source, seqs[source], nil)
+		results[i] = RenameResult{Source: source, Output: output, Err: err}
+		if err == nil {
+			byOutput[output] = append(byOutput[output], i)
+		}
+	}
+
+	for _, idx := range byOutput {
+		if len(idx) > 1 {
+			for _, i := range idx {
+				results[i].Collision = true
+			}
+		}
+	}
+
+	return results
+}
+
+// Collisions returns the colliding sources grouped by output name.
+func Collisions(results []RenameResult) map[string][]string {
+	collisions := make(map[string][]string)
+	for _, result := range results {
+		if result.Collision {
+			collisions[result.Output] = append(collisions[result.Output], result.Source)
+		}
+	}
+	for _, sources := range collisions {
+		sort.Strings(sources)
+	}
+	return collisions
+}
+
+// claimedNames are the output names of a run rendered once the files are read. A name belongs
+// to the first file it is rendered for, so files rendering the same name still collide.
+type claimedNames struct {
+	mu      sync.Mutex
+	sources map[string]string
+}
+
+func newClaimedNames() *claimedNames {
+	return &claimedNames{sources: make(map[string]string)}
+}
+
+// claim renders the output name of source with rule and claims it for file, source as named in
+// the run summary, numbered seq by Sequence.
+func (claimed *claimedNames) claim(rule *FilenameRule, source string, file string, seq int, meta map[string]interface{}) (string, error) {
+	claimed.mu.Lock()
+	defer claimed.mu.Unlock()
+
+	output, err := rule.Apply(source, seq, meta)
+	if err != nil {
+		return "", failure("filenameError", err)
+	}
+	return output, claimed.add(output, file)
+}
+
+// reserve claims an output name mapped before the file is read for file
+func (claimed *claimedNames) reserve(output string, file string) error {
+	claimed.mu.Lock()
+	defer claimed.mu.Unlock()
+	return claimed.add(output, file)
+}
+
+// add claims output for file unless another file has it. claimed.mu must be held.
+func (claimed *claimedNames) add(output string, file string) error {
+	if other, ok := claimed.sources[output]; ok && other != file {
+		return failure("collisionError", fmt.Errorf("%v and %v map to %v", other, file, output))
+	}
+	claimed.sources[output] = file
+	return nil
+}
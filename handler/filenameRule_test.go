@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"reconconverter/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultFilenameRules(t *testing.T) {
+	cases := []struct {
+		channel string
+		source  string
+		output  string
+	}{
+		{"ovo", "YOKKE_0700010411960_27-03-2024.xlsx", "YOKKE_0700010411960_20240327.csv"},
+		{"ovo", "report_27-03-2024_v2.xls", "report_20240327_v2.csv"},
+		// the baseline delivered files without a date under their own name
+		{"ovo", "YOKKE_0700010411960.xlsx", "YOKKE_0700010411960.csv"},
+		{"ovo", "settlement.xlsx.pgp", "settlement.csv"},
+		{"indodana", "settlement_yokke-ptp_20240327.xlsx", "settlement_20240327.csv"},
+	}
+	for _, c := range cases {
+		rule, err := NewFilenameRule(c.channel, config.FilenameRule{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := rule.Apply(c.source, 1, nil)
+		if err != nil {
+			t.Errorf("%v %v: %v", c.channel, c.source, err)
+			continue
+		}
+		if output != c.output {
+			t.Errorf("%v %v: got %v, want %v", c.channel, c.source, output, c.output)
+		}
+	}
+}
+
+func TestFilenameRuleInvalidDate(t *testing.T) {
+	rule, err := NewFilenameRule("ovo", config.FilenameRule{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rule.Apply("YOKKE_32-13-2024.xlsx", 1, nil); err == nil {
+		t.Errorf("expected an error for an invalid date")
+	}
+}
+
+func TestFilenameRuleFormat(t *testing.T) {
+	rule := config.FilenameRule{Pattern: `^(?P<date>\d{2}-\d{2}-\d{4})?.*$`, Template: `{{.date | format "20060102"}}{{.seq}}.csv`}
+	compiled, err := NewFilenameRule("ovo", rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without a date layout the date is text
+	if output, err := compiled.Apply("27-03-2024.xlsx", 1, nil); err == nil || !strings.Contains(err.Error(), "dateLayout") {
+		t.Errorf("formatted text: %v, %v", output, err)
+	}
+	// an optional date the filename doesn't have stays empty
+	if output, err := compiled.Apply("settlement.xlsx", 1, nil); err != nil || output != "1.csv" {
+		t.Errorf("without a date: %v, %v", output, err)
+	}
+
+	rule.DateLayout = "02-01-2006"
+	if compiled, err = NewFilenameRule("ovo", rule); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := compiled.Apply("27-03-2024.xlsx", 1, nil); err != nil || output != "202403271.csv" {
+		t.Errorf("with a date layout: %v, %v", output, err)
+	}
+
+	// dates of the preamble are formatted without a date layout
+	rule = config.FilenameRule{Pattern: `^.*$`, Template: `{{.meta.period | format "2006-01"}}.csv`}
+	if compiled, err = NewFilenameRule("ovo", rule); err != nil {
+		t.Fatal(err)
+	}
+	meta := map[string]interface{}{"period": time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}
+	if output, err := compiled.Apply("settlement.xlsx", 1, meta); err != nil || output != "2024-03.csv" {
+		t.Errorf("preamble date: %v, %v", output, err)
+	}
+}
+
+func TestFilenameRuleUsesMeta(t *testing.T) {
+	for template, want := range map[string]bool{
+		`{{.name}}.csv`:                false,
+		`{{.name}}_metadata.csv`:       false,
+		`{{/* .meta */}}{{.name}}.csv`: false,
+		`{{.meta.period}}.csv`:         true,
+		`{{.name}}{{if .meta.period}}_{{.meta.period}}{{end}}.csv`:    true,
+		`{{with $m := .meta}}{{$m.period}}{{end}}.csv`:                true,
+		`{{$.meta.period}}.csv`:                                       true,
+		`{{index . "meta"}}.csv`:                                      true,
+		`{{define "p"}}{{.meta.period}}{{end}}{{template "p" .}}.csv`: true,
+	} {
+		rule, err := NewFilenameRule("ovo", config.FilenameRule{Pattern: `^(?P<base>.*)$`, Template: template})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rule.UsesMeta(); got != want {
+			t.Errorf("%v uses meta: got %v", template, got)
+		}
+	}
+}
+
+// the seq of a file depends on its name only, not on the order files are listed in
+func TestSequence(t *testing.T) {
+	rule, err := NewFilenameRule("ovo", config.FilenameRule{Pattern: `^(?P<base>.*)\.xlsx$`, Template: `{{.base}}_{{.seq}}.csv`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, files := range [][]string{{"b.xlsx", "a.xlsx", "c.zip"}, {"c.zip", "b.xlsx", "a.xlsx"}} {
+		// archives are numbered, their files are mapped once extracted
+		var sources []string
+		for _, file := range files {
+			if strings.HasSuffix(file, ".xlsx") {
+				sources = append(sources, file)
+			}
+		}
+		results := rule.MapFilenames(sources, Sequence(files))
+		outputs := map[string]string{}
+		for _, result := range results {
+			outputs[result.Source] = result.Output
+		}
+		if outputs["a.xlsx"] != "a_1.csv" || outputs["b.xlsx"] != "b_2.csv" {
+			t.Errorf("%v mapped to %v", files, outputs)
+		}
+	}
+}
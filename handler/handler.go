@@ -2,30 +2,49 @@ package handler
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
-	"encoding/csv"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"reconconverter/archive"
 	"reconconverter/config"
+	"reconconverter/input"
+	"reconconverter/ledger"
 	"reconconverter/mail"
-	"regexp"
+	"reconconverter/output"
+	"reconconverter/pgp"
+	"reconconverter/transport"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/pkg/sftp"
 	"github.com/sirupsen/logrus"
-	"github.com/xuri/excelize/v2"
-	"golang.org/x/crypto/ssh"
 	"gopkg.in/gomail.v2"
 )
 
 type Handler struct {
-	Config     *config.Config
-	Client     *ssh.Client
-	MailSender mail.Sender
-	Assets     *mail.Assets
+	Config        *config.Config
+	MailSender    mail.Sender
+	Assets        *mail.Assets
+	FilenameRules map[string]*FilenameRule
+	FileFilters   map[string]*FileFilter
+	Schemas       map[string]*Schema
+	Sheets        map[string]*SheetSelector
+	Preambles     map[string]*Preamble
+	Outputs       map[string][]*Output
+	PgpKeys       map[string]*pgp.Keys
+	ArchiveLimits map[string]archive.Limits
+	Ledger        *ledger.Ledger
+	Transports    *transport.Dialer
+
+	// limits the files processed at the same time across all channels
+	workers      chan struct{}
+	channelLocks map[string]*sync.Mutex
 }
 
 var reasonsMap = map[string]string{
@@ -35,6 +54,12 @@ var reasonsMap = map[string]string{
 	"unknownError":     "Unknown Error",
 	"directoryError":   "Directory Error",
 	"internalError":    "Internal Error",
+	"filenameError":    "Nama file tidak sesuai aturan penamaan",
+	"collisionError":   "Beberapa file menghasilkan nama output yang sama",
+	"duplicateError":   "File duplikat, isi file sudah pernah diproses",
+	"encryptedError":   "File terenkripsi, password tidak ada atau salah",
+	"pgpError":         "Dekripsi atau verifikasi tanda tangan PGP gagal",
+	"newFormatError":   "Format file baru terdeteksi, header tidak cocok dengan versi skema mana pun",
 }
 
 var indodanaFormat []string = []string{"NO", "MERCHANT NAME", "TRANSACTION DATE", "TRANSIDMERCHANT", "CUSTOMER NAME", "AMOUNT", "FEE", "TAX", "MERCHANT SUPPORT", "PAY TO MERCHANT", "PAY OUT DATE", "TRANSACTION TYPE", "TENURE"}
@@ -55,529 +80,1133 @@ func NewHandler(config *config.Config, assets *mail.Assets) *Handler {
 
 	logrus.Info("Connected to smtp")
 
-	return &Handler{
-		Config:     config,
-		Assets:     assets,
-		MailSender: dialer,
-	}
+	return NewHandlerWithSender(config, assets, dialer)
 }
 
-func (handler *Handler) OvoHandler() {
-	channelName := "ovo"
-	logrus.Printf("Job Running... Ovo")
-	conn, client, err := handler.CreateClient(handler.Config.Ovo.SftpSource)
+// NewHandlerWithSender creates a handler that sends its notifications with sender
+func NewHandlerWithSender(config *config.Config, assets *mail.Assets, sender mail.Sender) *Handler {
+	rules, err := NewFilenameRules(config)
 	if err != nil {
-		logrus.Fatalf("Failed to create client: %v", err)
-		if client != nil {
-			client.Close()
-		}
-		if conn != nil {
-			conn.Close()
-		}
-		return
+		logrus.Fatalf("failed to load filename rules: %v", err)
 	}
 
-	defer client.Close()
-	defer conn.Close()
+	filters := make(map[string]*FileFilter)
+	for channelName, channel := range config.Channels() {
+		filters[channelName], err = NewFileFilter(channel)
+		if err != nil {
+			logrus.Fatalf("failed to load file filter of %v: %v", channelName, err)
+		}
+	}
 
-	files, err := client.ReadDir(handler.Config.Ovo.SourcePath)
+	schemas, err := NewSchemas(config)
 	if err != nil {
-		logrus.Fatalf("Failed to read directory: %v", err)
-		return
+		logrus.Fatalf("failed to load schemas: %v", err)
 	}
-	if len(files) == 0 {
-		logrus.Errorf("No file to process %v", err)
-		handler.OnErrorHandler("notExistsError", channelName, err)
-		return
+
+	sheets, err := NewSheetSelectors(config)
+	if err != nil {
+		logrus.Fatalf("failed to load sheet selection: %v", err)
 	}
 
-	connDest, clientDest, err := handler.CreateClient(handler.Config.Ovo.SftpDestination)
+	preambles, err := NewPreambles(config)
 	if err != nil {
-		logrus.Printf("Failed to create client: %v", err)
-		if client != nil {
-			client.Close()
+		logrus.Fatalf("failed to load preambles: %v", err)
+	}
+
+	limits := make(map[string]archive.Limits)
+	for channelName, channel := range config.Channels() {
+		if limits[channelName], err = archive.NewLimits(channel.Archive); err != nil {
+			logrus.Fatalf("failed to load archive limits of %v: %v", channelName, err)
 		}
-		if conn != nil {
-			conn.Close()
+		if err := input.Check(channel.Input); err != nil {
+			logrus.Fatalf("failed to load input of %v: %v", channelName, err)
+		}
+		if _, err := channel.WorkbookPassword.Load(); err != nil {
+			logrus.Fatalf("failed to load workbook password of %v: %v", channelName, err)
 		}
-		return
 	}
-	defer func() {
-		clientDest.Close()
-		connDest.Close()
-	}()
 
-	for _, file := range files {
-		var err error
-		if file.IsDir() {
-			continue // skip subdirectories
-		}
+	keys, err := NewPgpKeys(config)
+	if err != nil {
+		logrus.Fatalf("failed to load pgp keys: %v", err)
+	}
 
-		remoteFileSourcePath := handler.Config.Ovo.SourcePath + "/" + file.Name()
-		remoteFile, err := client.Open(remoteFileSourcePath)
-		if err != nil {
-			logrus.Printf("Failed to open file %s: %v", file.Name(), err)
-			handler.OnErrorHandler("internalError", channelName, err)
-			continue
-		}
+	outputs, err := NewOutputs(config, keys)
+	if err != nil {
+		logrus.Fatalf("failed to load outputs: %v", err)
+	}
 
-		defer remoteFile.Close()
+	channelLocks := make(map[string]*sync.Mutex)
+	for _, channelName := range channelNames {
+		channelLocks[channelName] = &sync.Mutex{}
+	}
 
-		localPathBefore := handler.Config.TempFolder + "/before/" + channelName + "/"
+	maxWorkers := config.MaxWorkers
+	if maxWorkers < 1 {
+		maxWorkers = 4
+	}
 
-		if err := os.MkdirAll(localPathBefore, 0755); err != nil {
-			logrus.Errorf("Error when create directory %v", err)
-			handler.OnErrorHandler("directoryError", channelName, err)
-			continue
-		}
-		localPathBefore = localPathBefore + file.Name()
-		localFileBefore, err := os.Create(localPathBefore)
-		if err != nil {
-			logrus.Printf("Failed to create local file %s: %v", file.Name(), err)
-			handler.OnErrorHandler("internalError", channelName, err)
-			continue
-		}
+	ledgerFile := config.LedgerFile
+	if ledgerFile == "" {
+		ledgerFile = config.TempFolder + "/ledger.jsonl"
+	}
+	processed, err := ledger.Open(ledgerFile)
+	if err != nil {
+		logrus.Fatalf("failed to open ledger %v: %v", ledgerFile, err)
+	}
 
-		defer localFileBefore.Close()
+	return &Handler{
+		Config:        config,
+		Assets:        assets,
+		MailSender:    sender,
+		FilenameRules: rules,
+		FileFilters:   filters,
+		Schemas:       schemas,
+		Sheets:        sheets,
+		Preambles:     preambles,
+		Outputs:       outputs,
+		PgpKeys:       keys,
+		ArchiveLimits: limits,
+		Ledger:        processed,
+		Transports:    transport.NewDialer(config),
+		workers:       make(chan struct{}, maxWorkers),
+		channelLocks:  channelLocks,
+	}
+}
 
-		_, err = io.Copy(localFileBefore, remoteFile)
+// NewFilenameRules compiles the filename rule of every channel.
+func NewFilenameRules(cfg *config.Config) (map[string]*FilenameRule, error) {
+	rules := make(map[string]*FilenameRule)
+	for channelName, channel := range cfg.Channels() {
+		rule, err := NewFilenameRule(channelName, channel.FilenameRule)
 		if err != nil {
-			logrus.Errorf("Failed to copy file %s: %v", file.Name(), err)
-			handler.OnErrorHandler("internalError", channelName, err)
+			return nil, err
+		}
+		rules[channelName] = rule
+	}
+	return rules, nil
+}
+
+// mapOutputNames maps the files of a run to their output names. Archives have no output name
+// of their own, their files are mapped once they are extracted. Names using the preamble of
+// the file are left empty and rendered once the file is read.
+// Files that don't match the rule or collide with another file are left out and reported.
+// seqs numbers the files, see Sequence.
+func (handler *Handler) mapOutputNames(channelName string, files []string, seqs map[string]int) map[string]string {
+	outputNames := make(map[string]string)
+	rule := handler.FilenameRules[channelName]
+	var sources []string
+	for _, file := range files {
+		if archive.IsArchive(file) || rule.UsesMeta() {
+			outputNames[file] = ""
 			continue
-		} else {
-			logrus.Infof("Downloaded: %v", file.Name())
 		}
+		sources = append(sources, file)
+	}
 
-		f, err := excelize.OpenFile(localFileBefore.Name())
-		if err != nil {
-			logrus.Fatalf("Got error %v", err)
-			handler.OnErrorHandler("internalError", channelName, err)
+	results := rule.MapFilenames(sources, seqs)
+	for _, result := range results {
+		if result.Err != nil {
+			logrus.Errorf("Failed to map filename %v: %v", result.Source, result.Err)
+			handler.OnErrorHandler("filenameError", channelName, result.Err)
 			continue
 		}
+		if !result.Collision {
+			outputNames[result.Source] = result.Output
+		}
+	}
 
-		styleID, err := f.NewStyle(&excelize.Style{
-			NumFmt: 0, // 0 = General
-		})
-		sheetList := f.GetSheetList()
+	for output, colliding := range Collisions(results) {
+		logrus.Errorf("Files %v map to the same output %v. Skipping these files", colliding, output)
+		handler.OnErrorHandler("collisionError", channelName, fmt.Errorf("%v map to %v", colliding, output))
+	}
 
-		sheet := sheetList[0]
+	return outputNames
+}
 
-		f.SetColStyle(sheet, "M:AC", styleID)
-		f.SetColStyle(sheet, "AK:AM", styleID)
+// channelSpec holds what differs between the channels when reading a workbook
+type channelSpec struct {
+	// the sheet holding the transactions when the channel doesn't configure one
+	sheet config.Sheet
+	// rows at the end of each sheet that are not transactions
+	footerRows int
+	// every row must have as many columns as the header
+	strictColumns bool
+}
 
-		// var header []string
-		var content [][]string
+var channelSpecs = map[string]channelSpec{
+	"ovo": {
+		sheet:         config.Sheet{Index: 1},
+		footerRows:    1,
+		strictColumns: true,
+	},
+	"indodana": {
+		sheet: config.Sheet{Name: "Ledger", IgnoreCase: true},
+	},
+}
 
-		rows, err := f.GetRows(sheet)
+// channelNames is the order in which channels are started in a run
+var channelNames = []string{"indodana", "ovo"}
+
+type channel struct {
+	name   string
+	config config.Channel
+	spec   channelSpec
+	schema *Schema
+	sheets *SheetSelector
+	keys   *pgp.Keys
+	limits archive.Limits
+	// the run the channel is processed in
+	runID    string
+	preamble *Preamble
+	rule     *FilenameRule
+	// output names rendered once the files of the run are read
+	claimed *claimedNames
+	// the seq of the files of the run
+	seqs map[string]int
+	// contents being delivered by the workers of the run
+	contents *claimedContents
+	// files delivered even when the ledger has their content
+	force map[string]bool
+}
 
-		if err != nil {
-			logrus.Errorf("Got error when get rows %v", err)
-			handler.OnErrorHandler("invalidFileError", channelName, err)
-			continue
-		}
+// Run processes every channel concurrently and returns the aggregated summary.
+func (handler *Handler) Run() *RunSummary {
+	return handler.RunWith(RunOptions{})
+}
 
-		var countBefore int
-		for idx, each := range rows {
-			if idx < len(rows)-1 {
-				content = append(content, each)
-			}
+// RunOptions change a single run
+type RunOptions struct {
+	// Channels limits the run to these channels, every channel runs when empty
+	Channels []string
+	// Force delivers these source files even when the ledger already has their content. A file
+	// of an archive is named <archive>/<file>, forcing an archive forces all its files.
+	Force []string
+}
 
-			if idx > 0 && idx < len(rows)-1 {
-				countBefore++
-			}
-		}
+// RunWith processes the channels of options concurrently and returns the aggregated summary.
+func (handler *Handler) RunWith(options RunOptions) *RunSummary {
+	summary := NewRunSummary()
 
-		outputDir := "./tmp/after/" + channelName
+	force := make(map[string]bool)
+	for _, name := range options.Force {
+		force[name] = true
+	}
 
-		err = os.MkdirAll(outputDir, 0755)
-		if err != nil {
-			logrus.Errorf("Error when create directory %v", err)
-			handler.OnErrorHandler("directoryError", channelName, err)
+	var wg sync.WaitGroup
+	for _, channelName := range channelNames {
+		if len(options.Channels) > 0 && indexOf(options.Channels, channelName) < 0 {
 			continue
 		}
-		arrName := strings.Split(localFileBefore.Name(), "/")
+		wg.Add(1)
+		go func(channelName string) {
+			defer wg.Done()
+			handler.processChannel(channelName, summary, true, force)
+		}(channelName)
+	}
+	wg.Wait()
 
-		re := regexp.MustCompile(`(\d{2})-(\d{2})-(\d{4})`)
+	summary.Finish()
+	return summary
+}
 
-		newFilename := re.ReplaceAllString(arrName[len(arrName)-1], "$3$2$1")
-		newFilename = strings.ReplaceAll(newFilename, ".xlsx", "")
+// processChannel runs one pass over the source of a channel. notifyEmpty sends the
+// notExistsError notification when there is nothing to process, force names the files
+// delivered even when they are duplicates.
+func (handler *Handler) processChannel(channelName string, summary *RunSummary, notifyEmpty bool, force map[string]bool) {
+	// the cron and the watcher must not pick up the same file twice
+	lock := handler.channelLocks[channelName]
+	lock.Lock()
+	defer lock.Unlock()
+
+	ch := &channel{
+		name:   channelName,
+		config: handler.Config.Channels()[channelName],
+		spec:   channelSpecs[channelName],
+		schema: handler.Schemas[channelName],
+		sheets: handler.Sheets[channelName],
+		keys:   handler.PgpKeys[channelName],
+		limits: handler.ArchiveLimits[channelName],
+		runID:  summary.ID,
+
+		preamble: handler.Preambles[channelName],
+		rule:     handler.FilenameRules[channelName],
+		claimed:  newClaimedNames(),
+		contents: &claimedContents{files: make(map[string]string)},
+		force:    force,
+	}
 
-		newFilename = newFilename + ".csv"
-		localFileAfter := outputDir + "/" + newFilename
-		newFile, err := os.Create(localFileAfter)
-		if err != nil {
-			logrus.Errorf("Error when create file %v", err)
-			handler.OnErrorHandler("", channelName, err)
-			continue
+	logrus.Printf("Job Running... %v", channelName)
+	source, err := handler.Transports.Source(ch.config)
+	if err != nil {
+		logrus.Errorf("Failed to create client: %v", err)
+		return
+	}
+
+	files, err := source.List(ch.config.SourcePath)
+	source.Close()
+	if err != nil {
+		logrus.Errorf("Failed to read directory: %v", err)
+		handler.OnErrorHandler("directoryError", channelName, err)
+		return
+	}
+	filter := handler.FileFilters[channelName]
+	files = filter.Select(files)
+	held := filter.Held()
+	for _, reason := range held {
+		logrus.Infof("Holding back %v: %v", channelName, reason)
+	}
+
+	// files held back are processed by a later pass, the source is not empty
+	if len(files) == 0 {
+		if notifyEmpty && len(held) == 0 {
+			logrus.Errorf("No file to process %v", err)
+			handler.OnErrorHandler("notExistsError", channelName, err)
 		}
+		return
+	}
 
-		writer := csv.NewWriter(newFile)
-		writer.Comma = ';'
-		columnNum := 0
-		var errorOnContent bool = false
-
-	firstLoop:
-		for idx, each := range content {
-			// cek format header
-			if idx == 0 {
-				columnNum = len(each)
-				if len(each) != len(ovoFormat) {
-					logrus.Errorf("Invalid file format. Given format: %v expectedFormat: %v", each, indodanaFormat)
-					handler.OnErrorHandler("invalidFileError", channelName, err)
-					errorOnContent = true
-					break firstLoop
-				}
-				for i := 0; i < len(each)-1; i++ {
-					if each[i] != ovoFormat[i] {
-						logrus.Errorf("Invalid file format. Given format: %v expectedFormat: %v", each, indodanaFormat)
-						handler.OnErrorHandler("invalidFileError", channelName, err)
-						errorOnContent = true
-						break firstLoop
-					}
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() {
+			names = append(names, file.Name())
+		}
+	}
+	ch.seqs = Sequence(names)
+	outputNames := handler.mapOutputNames(channelName, names, ch.seqs)
+	// the files of archives are mapped once extracted, the names of the other files are theirs
+	// whichever file is processed first
+	for file, output := range outputNames {
+		if output != "" {
+			ch.claimed.reserve(output, file)
+		}
+	}
+
+	workers := ch.config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan os.FileInfo)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				handler.workers <- struct{}{}
+				results := handler.borrowAndProcess(ch, file, outputNames[file.Name()])
+				<-handler.workers
+				for _, result := range results {
+					summary.Add(channelName, result.Source, result)
 				}
 			}
-			// jika kolom terakhir tidak ada datanya
-			if len(each) != columnNum {
-				// each = append(each, "")
-				logrus.Errorf("Invalid file. File in unknown format %v.", file.Name())
-				errorOnContent = true
-				break firstLoop
-			}
+		}()
+	}
 
-			if err := writer.Write(each); err != nil {
-				logrus.Errorf("Failed to write file %v: %v", newFile.Name(), err)
-				handler.OnErrorHandler("internalError", channelName, err)
-				errorOnContent = true
-				break firstLoop
-			}
+	for _, file := range files {
+		if _, ok := outputNames[file.Name()]; !ok {
+			continue
+		}
+		jobs <- file
+	}
+	close(jobs)
+	wg.Wait()
+}
 
+// borrowAndProcess processes a file with transports borrowed for this file only
+func (handler *Handler) borrowAndProcess(ch *channel, file os.FileInfo, newFilename string) []FileResult {
+	outputs := handler.Outputs[ch.name]
+	destinationConfigs := make([]config.Channel, len(outputs))
+	for i, out := range outputs {
+		destinationConfigs[i] = ch.config
+		if !out.Shared {
+			destinationConfigs[i] = out.Destination
 		}
+	}
 
-		writer.Flush()
+	source, destinations, err := handler.Transports.Borrow(ch.config, destinationConfigs)
+	if err != nil {
+		logrus.Errorf("Failed to create client: %v", err)
+		handler.OnErrorHandler("internalError", ch.name, err)
+		return []FileResult{{Source: file.Name(), Status: StatusFailed}}
+	}
+	defer source.Close()
+	for _, destination := range destinations {
+		defer destination.Close()
+	}
 
-		if errorOnContent {
-			logrus.Errorf("Got error on file: %v . Skipping this file", file.Name())
-			handler.OnErrorHandler("invalidFileError", channelName, err)
-			continue
+	return handler.processFile(ch, source, destinations, file, newFilename)
+}
+
+// processError carries the notification reason of a failed step
+type processError struct {
+	reason string
+	err    error
+}
+
+func (e *processError) Error() string {
+	return e.err.Error()
+}
+
+func (e *processError) Unwrap() error {
+	return e.err
+}
+
+func failure(reason string, err error) error {
+	return &processError{reason: reason, err: err}
+}
+
+// processFile converts a single source file, or every file of an archive. Everything it opens
+// is closed before it returns and its temp files are removed whatever the outcome.
+func (handler *Handler) processFile(ch *channel, source transport.Transport, destinations []transport.Transport, file os.FileInfo, newFilename string) []FileResult {
+	results, err := handler.convertFile(ch, source, destinations, file, newFilename)
+	if err != nil {
+		reason := ErrorReason(err)
+		logrus.Errorf("Got error on file: %v . Skipping this file. Err: %v", file.Name(), err)
+		if !handler.newFormatReported(ch.name, file.Name(), err) {
+			handler.OnErrorHandler(reason, ch.name, err)
 		}
+		tagStatus(source, ch.config.SourcePath+"/"+file.Name(), StatusFailed)
+		return append(results, FileResult{Source: file.Name(), Status: StatusFailed})
+	}
+	return results
+}
 
-		fmt.Println("OVO file " + localFileBefore.Name() + " converted to ---->  " + newFilename + " successfully")
+func (handler *Handler) convertFile(ch *channel, source transport.Transport, destinations []transport.Transport, file os.FileInfo, newFilename string) (results []FileResult, err error) {
+	channelName := ch.name
 
-		dstFile, err := clientDest.Create(handler.Config.Ovo.DestinationPath + "/" + newFilename)
+	localPathBefore := handler.Config.TempFolder + "/before/" + channelName + "/"
+	if err := os.MkdirAll(localPathBefore, 0755); err != nil {
+		return nil, failure("directoryError", err)
+	}
+	localPathBefore = localPathBefore + file.Name()
+	defer removeLocalFile(localPathBefore)
+
+	hash, err := download(source, ch.config.SourcePath+"/"+file.Name(), localPathBefore)
+	if err != nil {
+		return nil, failure("internalError", err)
+	}
+	logrus.Infof("Downloaded: %v", file.Name())
+
+	if handler.isDuplicate(ch, file.Name(), hash) {
+		handler.backupSource(source, ch, file.Name(), StatusDuplicate)
+		return []FileResult{{Source: file.Name(), Status: StatusDuplicate}}, nil
+	}
+	defer func() {
 		if err != nil {
-			logrus.Errorf("Failed to put file %v to sftp server. Err: %v", newFilename, err.Error())
-			handler.OnErrorHandler("directoryError", channelName, err)
-			continue
+			ch.contents.release(hash, file.Name())
 		}
+	}()
 
-		defer dstFile.Close()
+	contentPath, record, err := decryptSource(ch, localPathBefore, localPathBefore+".decrypted")
+	if contentPath != localPathBefore {
+		defer removeLocalFile(contentPath)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		if _, err := newFile.Seek(0, 0); err != nil {
-			logrus.Errorf("Failed to seek file %v: %v", newFile.Name(), err)
-			handler.OnErrorHandler("internalError", channelName, err)
-			continue
+	if archive.IsArchive(file.Name()) {
+		return handler.convertArchive(ch, source, destinations, file.Name(), hash, contentPath, record)
+	}
+
+	result, err := handler.deliverContent(ch, source, destinations, ledger.Entry{Source: file.Name(), Output: newFilename, Hash: hash, Pgp: record}, ch.seqs[file.Name()], contentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	handler.backupSource(source, ch, file.Name(), StatusProcessed)
+
+	return []FileResult{result}, nil
+}
+
+// convertArchive delivers every file of an archive as if it was uploaded on its own, with its
+// own output name, duplicate check and ledger entry. The archive is moved to the backup once all
+// its files are delivered or duplicates, otherwise it stays and the next run retries the files
+// that failed. hash is the sha256 of the archive as uploaded.
+func (handler *Handler) convertArchive(ch *channel, source transport.Transport, destinations []transport.Transport, name string, hash string, path string, record *ledger.Pgp) ([]FileResult, error) {
+	dir := path + ".extracted"
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			logrus.Errorf("Failed to remove extracted files %v", err)
 		}
+	}()
+	members, err := archive.Extract(path, name, dir, ch.limits)
+	if err != nil {
+		return nil, failure("invalidFileError", fmt.Errorf("%v: %v", name, err))
+	}
 
-		_, err = io.Copy(dstFile, newFile)
-		if err != nil {
-			logrus.Errorf("Failed to copy file %v to sftp server. Err: %v", newFile.Name(), err.Error())
-			handler.OnErrorHandler("invalidFileError", channelName, err)
+	var selected []archive.Member
+	var names []string
+	for _, member := range members {
+		if !handler.FileFilters[ch.name].Matches(member.Name) {
+			logrus.Infof("Skipping %v of %v, it does not match the file patterns", member.Name, name)
 			continue
 		}
+		selected = append(selected, member)
+		names = append(names, member.Name)
+	}
+	if len(selected) == 0 {
+		return nil, failure("emptyFileError", fmt.Errorf("no files of %v match the file patterns", name))
+	}
+	seqs := Sequence(names)
+	outputNames := handler.mapOutputNames(ch.name, names, seqs)
 
-		// read again to count row after converted
-		convertedFile, err := clientDest.Open(handler.Config.Ovo.DestinationPath + "/" + newFilename)
+	var results []FileResult
+	failed := false
+	for _, member := range selected {
+		result, err := handler.convertMember(ch, source, destinations, name, hash, member, outputNames, seqs[member.Name], record)
 		if err != nil {
-			logrus.Fatalf("Failed to read file (converted) %s: %v", newFilename, err)
-			handler.OnErrorHandler("invalidFileError", channelName, err)
+			logrus.Errorf("Got error on file: %v of %v . Skipping this file. Err: %v", member.Name, name, err)
+			if !handler.newFormatReported(ch.name, name+"/"+member.Name, err) {
+				handler.OnErrorHandler(ErrorReason(err), ch.name, fmt.Errorf("%v of %v: %w", member.Name, name, err))
+			}
+			result = FileResult{Source: name + "/" + member.Name, Status: StatusFailed}
 		}
+		failed = failed || result.Status == StatusFailed
+		results = append(results, result)
+	}
 
-		defer convertedFile.Close()
+	if failed {
+		tagStatus(source, ch.config.SourcePath+"/"+name, StatusFailed)
+	} else {
+		handler.backupSource(source, ch, name, StatusProcessed)
+	}
+	return results, nil
+}
+
+// convertMember delivers a file extracted from the archive name whose sha256 is archiveHash,
+// numbered seq among the files of the archive
+func (handler *Handler) convertMember(ch *channel, source transport.Transport, destinations []transport.Transport, name string, archiveHash string, member archive.Member, outputNames map[string]string, seq int, record *ledger.Pgp) (result FileResult, err error) {
+	newFilename, ok := outputNames[member.Name]
+	if !ok {
+		// reported by mapOutputNames
+		return FileResult{Source: name + "/" + member.Name, Status: StatusFailed}, nil
+	}
+	if archive.IsArchive(member.Name) {
+		return FileResult{}, failure("invalidFileError", fmt.Errorf("archives in archives are not extracted"))
+	}
 
-		reader := csv.NewReader(convertedFile)
-		reader.Comma = ';'
-		convertedRecords, err := reader.ReadAll()
+	hash, err := hashFile(member.Path)
+	if err != nil {
+		return FileResult{}, failure("internalError", err)
+	}
+	// a retry of the archive skips the files it delivered before without reporting them
+	if entry, ok := handler.Ledger.FindByHash(ch.name, hash); ok && entry.ArchiveHash == archiveHash && !ch.force[name] && !ch.force[name+"/"+member.Name] {
+		logrus.Infof("%v of %v was delivered by an earlier run of the archive as %v, skipping it", member.Name, name, entry.Output)
+		return FileResult{Source: name + "/" + member.Name, Status: StatusDuplicate}, nil
+	}
+	if handler.isDuplicate(ch, name+"/"+member.Name, hash) {
+		return FileResult{Source: name + "/" + member.Name, Status: StatusDuplicate}, nil
+	}
+	defer func() {
 		if err != nil {
-			logrus.Errorf("Failed to read csv: %v", err)
-			handler.OnErrorHandler("invalidFileError", channelName, err)
-			continue
+			ch.contents.release(hash, name+"/"+member.Name)
 		}
+	}()
+	// the names of an archive only collide among its own files, another file of the run may
+	// have the name already
+	if newFilename != "" {
+		if err := ch.claimed.reserve(newFilename, name+"/"+member.Name); err != nil {
+			return FileResult{}, err
+		}
+	}
 
-		var countAfter int = len(convertedRecords) - 1
-
-		logrus.Printf("Count before: %d", countBefore)
-		logrus.Printf("Count after: %d", countAfter)
+	entry := ledger.Entry{Source: member.Name, Archive: name, ArchiveHash: archiveHash, Output: newFilename, Hash: hash}
+	if record != nil {
+		// the outputs encrypted for this file are added to its own copy
+		memberRecord := *record
+		entry.Pgp = &memberRecord
+	}
+	return handler.deliverContent(ch, source, destinations, entry, seq, member.Path)
+}
 
-		logrus.Printf("Success converting file")
+// deliverContent converts the file at path, delivers its outputs and records it in the ledger
+// with the details of entry. seq numbers the file for its output name.
+func (handler *Handler) deliverContent(ch *channel, source transport.Transport, destinations []transport.Transport, entry ledger.Entry, seq int, path string) (FileResult, error) {
+	channelName := ch.name
+	newFilename := entry.Output
 
-		handler.OnSuccessHandler("", channelName, countBefore, countAfter)
+	content, info, err := readContent(ch, entry.Source, path)
+	if err != nil {
+		return FileResult{}, err
+	}
+	file := entry.Source
+	if entry.Archive != "" {
+		file = entry.Archive + "/" + entry.Source
+	}
+	if newFilename == "" {
+		if newFilename, err = ch.claimed.claim(ch.rule, entry.Source, file, seq, ch.preamble.TemplateValues(info.metadata)); err != nil {
+			return FileResult{}, err
+		}
+		entry.Output = newFilename
+	}
+	entry.Metadata = info.metadata
+	entry.Forced = ch.force[file] || ch.force[entry.Archive]
+	entry.SchemaVersion = info.version
+	countBefore := len(content) - 1
+	content, err = ch.schema.Apply(content, FileFields{Channel: channelName, Source: entry.Source, Output: newFilename, RunID: ch.runID})
+	if err != nil {
+		return FileResult{}, failure("invalidFileError", err)
+	}
 
-		err = os.Remove(localPathBefore)
+	// every output is written before the first upload, so a file that can't be
+	// written in one format isn't delivered in the others
+	outputs := handler.Outputs[channelName]
+	names := make([]string, len(outputs))
+	localFilesAfter := make([]localOutput, len(outputs))
+	for i, out := range outputs {
+		names[i] = out.Filename(newFilename)
+		localFilesAfter[i], err = handler.writeLocal(ch, out, content, names[i])
 		if err != nil {
-			logrus.Errorf("Failed to remove local file %v", err)
+			return FileResult{}, err
 		}
-		err = os.Remove(localFileAfter)
-		if err != nil {
-			logrus.Errorf("Failed to remove local file %v", err)
+		defer localFilesAfter[i].remove()
+		if out.Encryptor != nil {
+			entry.Pgp = encryptedRecord(entry.Pgp, out, names[i])
 		}
 
-		backupPath := handler.Config.Ovo.BackupPath + "/" + file.Name()
-		err = client.Rename(remoteFileSourcePath, backupPath)
+		fmt.Println(strings.ToUpper(channelName) + " file " + path + " converted to ---->  " + names[i] + " successfully")
+	}
+
+	// the count of the first output is the one reported
+	countAfter := -1
+	var deliveries []delivery
+	for i, out := range outputs {
+		delivered, count, err := deliver(out, destinations[i], localFilesAfter[i], names[i])
+		if delivered.destination != nil {
+			deliveries = append(deliveries, delivered)
+		}
 		if err != nil {
-			logrus.Errorf("Failed to remove remote file %v", err)
+			undeliver(deliveries)
+			return FileResult{}, err
+		}
+		if countAfter < 0 {
+			countAfter = count
 		}
 	}
+
+	logrus.Printf("Count before: %d", countBefore)
+	logrus.Printf("Count after: %d", countAfter)
+
+	logrus.Printf("Success converting file")
+
+	handler.OnSuccessHandler("", channelName, countBefore, countAfter)
+
+	entry.Channel = channelName
+	handler.recordProcessed(entry)
+
+	return FileResult{Source: file, Status: StatusProcessed, RowsBefore: countBefore, RowsAfter: countAfter}, nil
 }
 
-func (handler *Handler) IndodanaHandler() {
-	channelName := "indodana"
-	logrus.Printf("Job Running... Indodana")
-	conn, client, err := handler.CreateClient(handler.Config.Indodana.SftpSource)
+// hashFile returns the sha256 of the content of the file at path
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		logrus.Printf("Failed to create client: %v", err)
-		if client != nil {
-			client.Close()
-		}
-		if conn != nil {
-			conn.Close()
-		}
-		return
+		return "", err
 	}
+	defer file.Close()
 
-	defer func() {
-		client.Close()
-		conn.Close()
-	}()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
 
-	files, err := client.ReadDir(handler.Config.Indodana.SourcePath)
+// download copies the remote file to localPath and returns the sha256 of its content
+func download(source transport.Transport, remotePath string, localPath string) (string, error) {
+	remoteFile, err := source.Open(remotePath)
 	if err != nil {
-		logrus.Fatalf("Failed to read directory: %v", err)
-		return
+		return "", err
 	}
+	defer remoteFile.Close()
 
-	if len(files) == 0 {
-		logrus.Errorf("No file to process %v", err)
-		handler.OnErrorHandler("notExistsError", channelName, err)
-		return
+	localFile, err := os.Create(localPath)
+	if err != nil {
+		return "", err
 	}
+	defer localFile.Close()
 
-	connDest, clientDest, err := handler.CreateClient(handler.Config.Indodana.SftpDestination)
-	if err != nil {
-		logrus.Printf("Failed to create client: %v", err)
-		if client != nil {
-			client.Close()
-		}
-		if conn != nil {
-			conn.Close()
-		}
-		return
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(localFile, hasher), remoteFile); err != nil {
+		return "", err
 	}
-	defer func() {
-		clientDest.Close()
-		connDest.Close()
-	}()
 
-	for _, file := range files {
-		var err error
-		if file.IsDir() {
-			continue // skip subdirectories
-		}
+	return hex.EncodeToString(hasher.Sum(nil)), localFile.Close()
+}
 
-		remoteFileSourcePath := handler.Config.Indodana.SourcePath + "/" + file.Name()
-		remoteFile, err := client.Open(remoteFileSourcePath)
-		if err != nil {
-			logrus.Printf("Failed to open file %s: %v", file.Name(), err)
-			handler.OnErrorHandler("internalError", channelName, err)
-			continue
-		}
+// decryptSource decrypts the source file at path to decrypted when the channel decrypts its
+// files and returns the path the content is read from with what the ledger records about it
+func decryptSource(ch *channel, path string, decrypted string) (string, *ledger.Pgp, error) {
+	if ch.keys == nil || !ch.keys.Enabled() {
+		return path, nil, nil
+	}
 
-		// info, err := client.Stat(handler.Config.Indodana.SourcePath + "/" + file.Name())
-		// if err != nil {
-		// 	handler.OnErrorHandler("",channelName, err)
-		// 	continue
-		// }
+	verification, err := ch.keys.Decrypt(path, decrypted)
+	if err != nil {
+		return decrypted, nil, failure("pgpError", err)
+	}
+	logrus.Infof("Decrypted with %v, signature %v %v", verification.DecryptedWith, verification.Signature, verification.SignedBy)
 
-		defer remoteFile.Close()
+	return decrypted, &ledger.Pgp{
+		DecryptedWith: verification.DecryptedWith,
+		SignedBy:      verification.SignedBy,
+		Signature:     verification.Signature,
+	}, nil
+}
 
-		localPathBefore := handler.Config.TempFolder + "/before/" + channelName + "/"
+// fileDate returns the day of the file name, which the effective dates of schema versions are
+// compared with: the date captured from its preamble, else the date of its filename, else the
+// day it is processed
+func (ch *channel) fileDate(name string, metadata map[string]string) time.Time {
+	date, ok := ch.preamble.Date(metadata)
+	if !ok && ch.rule != nil {
+		date, ok = ch.rule.Date(name)
+	}
+	if !ok {
+		date = time.Now()
+	}
+	// effective dates are days of the local time zone
+	year, month, day := date.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+}
 
-		if err := os.MkdirAll(localPathBefore, 0755); err != nil {
-			logrus.Errorf("Error when create directory %v", err)
-			handler.OnErrorHandler("directoryError", channelName, err)
-			continue
+// contentInfo is what reading a file tells about it
+type contentInfo struct {
+	// the values captured from the rows above the header
+	metadata map[string]string
+	// the schema version of the header, empty without versions or for the schema header
+	version string
+}
+
+// readContent returns the header and transaction rows of the file, in the layout of the schema
+// header, and what was learned reading it
+func readContent(ch *channel, name string, path string) ([][]string, contentInfo, error) {
+	// read for every file, so a rotated password is picked up without a restart
+	password, err := ch.config.WorkbookPassword.Load()
+	if err != nil {
+		return nil, contentInfo{}, failure("internalError", fmt.Errorf("workbook password: %v", err))
+	}
+	wb, err := input.Open(path, ch.config.Input, password)
+	if errors.Is(err, input.ErrEncrypted) {
+		return nil, contentInfo{}, failure("encryptedError", err)
+	}
+	if err != nil {
+		return nil, contentInfo{}, failure("invalidFileError", err)
+	}
+	defer wb.Close()
+
+	// text files have no sheet names, their rows are the transactions
+	sheets := wb.Sheets()
+	if wb.Format() != input.FormatCsv {
+		hasHeader := func(rows [][]string) bool {
+			row := ch.preamble.HeaderRow(rows, ch.schema)
+			if row >= len(rows) {
+				return false
+			}
+			metadata, _ := ch.preamble.Metadata(rows[:row])
+			_, _, diff := ch.schema.matchHeader(rows[row], ch.fileDate(name, metadata))
+			return diff == nil
 		}
-		localPathBefore = localPathBefore + file.Name()
-		localFileBefore, err := os.Create(localPathBefore)
-		if err != nil {
-			logrus.Printf("Failed to create local file %s: %v", file.Name(), err)
-			handler.OnErrorHandler("internalError", channelName, err)
-			continue
+		if sheets, err = ch.sheets.Select(wb, hasHeader); err != nil {
+			return nil, contentInfo{}, failure("invalidFileError", err)
 		}
+	}
 
-		defer localFileBefore.Close()
-
-		_, err = io.Copy(localFileBefore, remoteFile)
+	var content, raw [][]string
+	var info contentInfo
+	matched := false
+	for _, sheet := range sheets {
+		rows, err := wb.Rows(sheet)
 		if err != nil {
-			logrus.Errorf("Failed to copy file %s: %v", file.Name(), err)
-			handler.OnErrorHandler("internalError", channelName, err)
-			continue
-		} else {
-			logrus.Infof("Downloaded: %v", file.Name())
+			return nil, contentInfo{}, failure("invalidFileError", err)
 		}
-
-		f, err := excelize.OpenFile(localFileBefore.Name())
-		if err != nil {
-			logrus.Fatalf("Got error %v", err)
-			handler.OnErrorHandler("internalError", channelName, err)
-			continue
+		// number columns are normalized from the value stored in the cell, not its display format
+		var sheetRaw [][]string
+		if ch.schema.needsRaw() {
+			if sheetRaw, err = wb.RawRows(sheet); err != nil {
+				return nil, contentInfo{}, failure("invalidFileError", err)
+			}
 		}
 
-		// var header []string
-		var content [][]string
+		rows = trimBlankRows(rows)
+		if len(rows) >= ch.spec.footerRows {
+			rows = rows[:len(rows)-ch.spec.footerRows]
+		}
+		if sheetRaw != nil {
+			sheetRaw = alignRows(sheetRaw, len(rows))
+		}
 
-		rows, err := f.GetRows("Ledger")
-		if err != nil {
-			logrus.Errorf("Got error when get rows %v", err)
-			handler.OnErrorHandler("invalidFileError", channelName, err)
+		if len(rows) == 0 {
 			continue
 		}
 
-		var countBefore int
-		var errorOnContent bool = false
-	firstLoop:
-		for idx, each := range rows {
-			if idx == 0 {
-				if len(each) != len(indodanaFormat) {
-					logrus.Errorf("Invalid file format. Given format: %v expectedFormat: %v", each, indodanaFormat)
-					handler.OnErrorHandler("invalidFileError", channelName, err)
-					errorOnContent = true
-					break firstLoop
-				}
-				for i := 0; i < len(each)-1; i++ {
-					if each[i] != indodanaFormat[i] {
-						logrus.Errorf("Invalid file format. Given format: %v expectedFormat: %v", each, indodanaFormat)
-						handler.OnErrorHandler("invalidFileError", channelName, err)
-						errorOnContent = true
-						break firstLoop
-					}
-				}
-			} else {
-				countBefore++
+		// the title rows above the header are left out, the values of the first sheet are kept
+		headerRow := ch.preamble.HeaderRow(rows, ch.schema)
+		if !matched {
+			if info.metadata, err = ch.preamble.Metadata(rows[:headerRow]); err != nil {
+				return nil, contentInfo{}, failure("invalidFileError", fmt.Errorf("sheet %v: %v", sheet, err))
 			}
-			content = append(content, each)
+		}
+		rows = rows[headerRow:]
+		if sheetRaw != nil {
+			sheetRaw = sheetRaw[headerRow:]
 		}
 
-		if errorOnContent {
-			logrus.Errorf("Got error on file: %v . Skipping this file", file.Name())
-			handler.OnErrorHandler("invalidFileError", channelName, err)
-			continue
+		mapping, version, diff := ch.schema.matchHeader(rows[0], ch.fileDate(name, info.metadata))
+		if diff != nil {
+			err := error(diff)
+			if len(sheets) > 1 {
+				err = fmt.Errorf("sheet %v: %w", sheet, diff)
+			}
+			// a channel with versions learns about layouts the partner introduced
+			if ch.schema.versioned() {
+				return nil, contentInfo{}, failure("newFormatError", err)
+			}
+			return nil, contentInfo{}, failure("invalidFileError", err)
+		}
+		if !matched {
+			info.version = version
+			matched = true
+		}
+		// jika kolom terakhir tidak ada datanya
+		if ch.spec.strictColumns {
+			for idx, each := range rows {
+				if len(each) != len(rows[0]) {
+					return nil, contentInfo{}, failure("invalidFileError", fmt.Errorf("row %d has %d columns, expected %d", idx+1, len(each), len(rows[0])))
+				}
+			}
+		}
+		// every sheet is read in the order and under the names of the schema header, the rows
+		// of further sheets follow the rows of the first one without their header
+		rows = mapping.apply(rows, ch.schema.header)
+		start := 0
+		if len(content) > 0 {
+			start = 1
+		}
+		content = append(content, rows[start:]...)
+		if sheetRaw != nil {
+			raw = append(raw, mapping.apply(sheetRaw, ch.schema.header)[start:]...)
 		}
+	}
+	if len(content) == 0 {
+		return nil, contentInfo{}, failure("emptyFileError", fmt.Errorf("no rows in %v", path))
+	}
 
-		outputDir := "./tmp/after/" + channelName
+	if content, err = ch.schema.Normalize(content, raw, wb.Date1904()); err != nil {
+		return nil, contentInfo{}, failure("invalidFileError", err)
+	}
 
-		err = os.MkdirAll(outputDir, 0755)
-		if err != nil {
-			logrus.Errorf("Error when create directory %v", err)
-			handler.OnErrorHandler("directoryError", channelName, err)
-			continue
-		}
-		arrName := strings.Split(localFileBefore.Name(), "/")
+	return content, info, nil
+}
 
-		newFilename := strings.ReplaceAll(arrName[len(arrName)-1], "_yokke-ptp", "")
-		newFilename = strings.ReplaceAll(newFilename, ".xlsx", "")
+func writeOutput(writer *output.Writer, path string, content [][]string) error {
+	newFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer newFile.Close()
 
-		newFilename = newFilename + ".csv"
-		localFileAfter := outputDir + "/" + newFilename
-		newFile, err := os.Create(localFileAfter)
-		if err != nil {
-			logrus.Errorf("Error when create file %v", err)
-			handler.OnErrorHandler("", channelName, err)
-			continue
-		}
+	if err := writer.Write(newFile, content); err != nil {
+		return err
+	}
 
-		writer := csv.NewWriter(newFile)
-		writer.Comma = ';'
+	return newFile.Close()
+}
 
-		for _, each := range content {
-			if err := writer.Write(each); err != nil {
-				logrus.Errorf("Failed to write file %v: %v", newFile.Name(), err)
-				handler.OnErrorHandler("internalError", channelName, err)
-				continue
-			}
-		}
+// Convert reads the workbook at path the way channelName is processed with the given channel
+// config and writes the first output of the channel to w. It neither downloads nor uploads anything,
+// so the runId field of output columns is empty. Encrypted sources are decrypted, the output is
+// written unencrypted.
+func Convert(channelName string, channelConfig config.Channel, path string, w io.Writer) error {
+	spec, ok := channelSpecs[channelName]
+	if !ok {
+		return fmt.Errorf("unknown channel %q", channelName)
+	}
+	schema, err := NewSchema(channelName, channelConfig.Schema)
+	if err != nil {
+		return err
+	}
+
+	keys, err := pgp.NewKeys(channelConfig.Pgp)
+	if err != nil {
+		return err
+	}
+
+	sheets, err := NewSheetSelector(channelName, channelConfig.Sheet)
+	if err != nil {
+		return err
+	}
 
-		writer.Flush()
+	preamble, err := NewPreamble(channelName, channelConfig.Preamble)
+	if err != nil {
+		return err
+	}
 
-		fmt.Println("INDODANA file " + localFileBefore.Name() + " converted to ---->  " + newFilename + " successfully")
+	// without a rule the output name is left empty
+	rule, _ := NewFilenameRule(channelName, channelConfig.FilenameRule)
 
-		dstFile, err := clientDest.Create(handler.Config.Indodana.DestinationPath + "/" + newFilename)
+	ch := &channel{name: channelName, config: channelConfig, spec: spec, schema: schema, sheets: sheets, keys: keys, preamble: preamble, rule: rule}
+	contentPath := path
+	if keys.Enabled() {
+		decrypted, err := os.CreateTemp("", "reconconverter-decrypted-*")
 		if err != nil {
-			logrus.Errorf("Failed to put file %v to sftp server. Err: %", newFilename, err.Error())
-			handler.OnErrorHandler("directoryError", channelName, err)
-			continue
+			return err
+		}
+		decrypted.Close()
+		defer os.Remove(decrypted.Name())
+		if contentPath, _, err = decryptSource(ch, path, decrypted.Name()); err != nil {
+			return err
 		}
+	}
 
-		defer dstFile.Close()
+	content, info, err := readContent(ch, filepath.Base(path), contentPath)
+	if err != nil {
+		return err
+	}
 
-		if _, err := newFile.Seek(0, 0); err != nil {
-			logrus.Errorf("Failed to seek file %v: %v", newFile.Name(), err)
-			handler.OnErrorHandler("internalError", channelName, err)
-			continue
-		}
+	fields := FileFields{Channel: channelName, Source: filepath.Base(path)}
+	if rule != nil {
+		fields.Output, _ = rule.Apply(fields.Source, 1, preamble.TemplateValues(info.metadata))
+	}
+	if content, err = schema.Apply(content, fields); err != nil {
+		return failure("invalidFileError", err)
+	}
 
-		_, err = io.Copy(dstFile, newFile)
-		if err != nil {
-			logrus.Errorf("Failed to copy file %v to sftp server. Err: %v", newFile.Name(), err.Error())
-			handler.OnErrorHandler("invalidFileError", channelName, err)
-			continue
-		}
+	writer, err := output.New(output.Outputs(channelConfig)[0])
+	if err != nil {
+		return err
+	}
+	return writer.Write(w, content)
+}
 
-		// read again to count row after converted
-		convertedFile, err := clientDest.Open(handler.Config.Indodana.DestinationPath + "/" + newFilename)
-		if err != nil {
-			logrus.Fatalf("Failed to read file (converted) %s: %v", newFilename, err)
-			handler.OnErrorHandler("invalidFileError", channelName, err)
-		}
+// ErrorReason returns the notification reason of an error returned by Convert.
+func ErrorReason(err error) string {
+	if e, ok := err.(*processError); ok {
+		return e.reason
+	}
+	return "internalError"
+}
 
-		defer convertedFile.Close()
+// upload copies a local file to the destination and reports whether it created the remote
+// file, even when the copy failed. A destination that can't be written is a directoryError, a
+// failed copy an invalidFileError.
+func upload(destination transport.Transport, localPath string, remotePath string) (bool, error) {
+	localFile, err := os.Open(localPath)
+	if err != nil {
+		return false, failure("internalError", err)
+	}
+	defer localFile.Close()
 
-		reader := csv.NewReader(convertedFile)
-		reader.Comma = ';'
-		convertedRecords, err := reader.ReadAll()
-		if err != nil {
-			logrus.Errorf("Failed to read csv: %v", err)
-			handler.OnErrorHandler("invalidFileError", channelName, err)
-			continue
-		}
+	dstFile, err := destination.Create(remotePath)
+	if err != nil {
+		return false, failure("directoryError", err)
+	}
 
-		var countAfter int
-		countAfter = len(convertedRecords) - 1
+	if _, err := io.Copy(dstFile, localFile); err != nil {
+		transport.Abort(dstFile, err)
+		return true, failure("invalidFileError", err)
+	}
 
-		logrus.Printf("Count before: %d", countBefore)
-		logrus.Printf("Count after: %d", countAfter)
+	if err := dstFile.Close(); err != nil {
+		return true, failure("invalidFileError", err)
+	}
+	return true, nil
+}
 
-		logrus.Printf("Success converting file")
+// countRecords returns the number of data rows of an uploaded output
+func countRecords(writer *output.Writer, destination transport.Transport, remotePath string) (int, error) {
+	convertedFile, err := destination.Open(remotePath)
+	if err != nil {
+		return 0, err
+	}
+	defer convertedFile.Close()
 
-		handler.OnSuccessHandler("", "Indodana", countBefore, countAfter)
+	return writer.Count(convertedFile)
+}
 
-		err = os.Remove(localPathBefore)
-		if err != nil {
-			logrus.Errorf("Failed to remove local file %v", err)
-		}
-		err = os.Remove(localFileAfter)
-		if err != nil {
-			logrus.Errorf("Failed to remove local file %v", err)
+func removeLocalFile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("Failed to remove local file %v", err)
+	}
+}
+
+// alignRows returns n rows of raw, so the raw rows of several sheets stay aligned with their
+// formatted rows
+func alignRows(raw [][]string, n int) [][]string {
+	if len(raw) >= n {
+		return raw[:n]
+	}
+	return append(raw, make([][]string, n-len(raw))...)
+}
+
+// matchesFormat compares the header with the expected format, ignoring the last column
+func matchesFormat(header []string, format []string) bool {
+	if len(header) != len(format) {
+		return false
+	}
+	for i := 0; i < len(header)-1; i++ {
+		if header[i] != format[i] {
+			return false
 		}
+	}
+	return true
+}
 
-		backupPath := handler.Config.Indodana.BackupPath + "/" + file.Name()
-		err = client.Rename(remoteFileSourcePath, backupPath)
-		if err != nil {
-			logrus.Errorf("Failed to backup remote file %v to %v . Err: %v", remoteFileSourcePath, backupPath, err)
+// backupSource moves a source file to the channel backup path together with its done marker.
+// The backup goes to the channel archive when it has one, otherwise it stays on the source.
+func (handler *Handler) backupSource(source transport.Transport, ch *channel, name string, status string) {
+	remoteFileSourcePath := ch.config.SourcePath + "/" + name
+	backupPath := ch.config.BackupPath + "/" + name
+
+	archive, err := handler.Transports.Archive(ch.config)
+	switch {
+	case err != nil:
+		logrus.Errorf("Failed to open archive of %v: %v", ch.name, err)
+	case archive == nil:
+		err = source.Rename(remoteFileSourcePath, backupPath)
+		if err == nil {
+			tagStatus(source, backupPath, status)
+		}
+	default:
+		defer archive.Close()
+		err = moveTo(source, remoteFileSourcePath, archive, backupPath)
+		if err == nil {
+			tagStatus(archive, backupPath, status)
 		}
+	}
+	if err != nil {
+		logrus.Errorf("Failed to backup remote file %v to %v . Err: %v", remoteFileSourcePath, backupPath, err)
+	}
+
+	handler.removeDoneMarker(source, ch.name, ch.config.SourcePath, name)
+}
 
+// moveTo copies a file to another transport and removes it from the first one once the copy is complete
+func moveTo(from transport.Transport, fromPath string, to transport.Transport, toPath string) error {
+	reader, err := from.Open(fromPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := to.Create(toPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(writer, reader); err != nil {
+		transport.Abort(writer, err)
+		to.Remove(toPath)
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
 	}
+	reader.Close()
 
+	return from.Remove(fromPath)
+}
+
+// tagStatus records the processing status on transports that support it
+func tagStatus(t transport.Transport, path string, status string) {
+	tagger, ok := t.(transport.StatusTagger)
+	if !ok {
+		return
+	}
+	if err := tagger.TagStatus(path, status); err != nil {
+		logrus.Errorf("Failed to tag %v with status %v: %v", path, status, err)
+	}
+}
+
+// claimedContents are the contents the workers of a run deliver, by hash, so a file with the
+// same content as a file being delivered is a duplicate before the ledger has either
+type claimedContents struct {
+	mu    sync.Mutex
+	files map[string]string
+}
+
+// claim claims hash for file and returns the file that has it when another one does
+func (claimed *claimedContents) claim(hash string, file string) (string, bool) {
+	claimed.mu.Lock()
+	defer claimed.mu.Unlock()
+	if other, ok := claimed.files[hash]; ok && other != file {
+		return other, false
+	}
+	claimed.files[hash] = file
+	return "", true
+}
+
+// release gives up the claim of file on hash once its delivery failed
+func (claimed *claimedContents) release(hash string, file string) {
+	claimed.mu.Lock()
+	defer claimed.mu.Unlock()
+	if claimed.files[hash] == file {
+		delete(claimed.files, hash)
+	}
+}
+
+// isDuplicate reports whether a file with the same content was already delivered for the channel,
+// or is being delivered by another worker of the run. Otherwise the content is claimed for name
+// until its delivery fails. name is the file as named in the run summary.
+func (handler *Handler) isDuplicate(ch *channel, name string, hash string) bool {
+	channelName := ch.name
+	if ch.config.AllowDuplicates {
+		return false
+	}
+	if archiveName, _, ok := strings.Cut(name, "/"); ch.force[name] || (ok && ch.force[archiveName]) {
+		logrus.Warnf("Forced to process %v, duplicates are not checked", name)
+		return false
+	}
+
+	var err error
+	if entry, ok := handler.Ledger.FindByHash(channelName, hash); ok {
+		err = fmt.Errorf("%v has the same content as %v processed at %v", name, entry.Source, entry.ProcessedAt.Format("2006-01-02 15:04:05"))
+	} else if other, ok := ch.contents.claim(hash, name); !ok {
+		err = fmt.Errorf("%v has the same content as %v processed in this run", name, other)
+	} else {
+		return false
+	}
+	logrus.Errorf("Duplicate file: %v. Skipping this file", err)
+	handler.OnErrorHandler("duplicateError", channelName, err)
+	return true
+}
+
+// newFormatReported reports whether err is a header matching no schema version that was reported
+// for an earlier file. A new format is reported once and recorded in the ledger, the files with
+// the same header after it fail without another alert until the schema has a version for it.
+func (handler *Handler) newFormatReported(channelName string, source string, err error) bool {
+	var diff *HeaderDiff
+	if ErrorReason(err) != "newFormatError" || !errors.As(err, &diff) {
+		return false
+	}
+	recorded, err := handler.Ledger.RecordNewFormat(ledger.Entry{Channel: channelName, Source: source, NewFormat: diff.Fingerprint})
+	if err != nil {
+		logrus.Errorf("Failed to record the new format of %v in ledger: %v", source, err)
+		return false
+	}
+	if !recorded {
+		logrus.Warnf("%v has the new format %v reported before, not reporting it again", source, diff.Fingerprint)
+	}
+	return !recorded
+}
+
+func (handler *Handler) recordProcessed(entry ledger.Entry) {
+	if err := handler.Ledger.Record(entry); err != nil {
+		logrus.Errorf("Failed to record %v in ledger: %v", entry.Source, err)
+	}
+}
+
+func (handler *Handler) removeDoneMarker(source transport.Transport, channelName string, sourcePath string, name string) {
+	marker := handler.FileFilters[channelName].DoneMarker(name)
+	if marker == "" {
+		return
+	}
+	if err := source.Remove(sourcePath + "/" + marker); err != nil {
+		logrus.Errorf("Failed to remove done marker %v: %v", marker, err)
+	}
 }
 
 func (handler *Handler) OnErrorHandler(reason string, channelName string, err error) {
@@ -605,6 +1234,11 @@ func (handler *Handler) OnErrorHandler(reason string, channelName string, err er
 		Subject:            subject,
 		ConditionalMessage: reasonsMap[reason],
 	}
+	// a header that doesn't match is reported column by column
+	var diff *HeaderDiff
+	if errors.As(err, &diff) {
+		templateData.ConditionalMessage += ": " + diff.describe()
+	}
 
 	bBody := new(bytes.Buffer)
 	if err := asset.Execute(bBody, templateData); err != nil {
@@ -662,28 +1296,3 @@ func (handler *Handler) OnSuccessHandler(reason string, channelName string, rowB
 		logrus.Errorf("Error sending email: %v", err)
 	}
 }
-
-func (handler *Handler) CreateClient(sftpConfig config.Sftp) (conn *ssh.Client, cl *sftp.Client, e error) {
-	var err error
-	sshConfig := &ssh.ClientConfig{
-		User: sftpConfig.User,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(sftpConfig.Password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-
-	conn, err = ssh.Dial("tcp", sftpConfig.Host+":"+strconv.Itoa(sftpConfig.Port), sshConfig)
-	if err != nil {
-		logrus.Fatalf("Failed to dial: %v", err)
-		return nil, nil, err
-	}
-
-	client, err := sftp.NewClient(conn)
-	if err != nil {
-		logrus.Fatalf("Failed to create SFTP client: %v", err)
-		return conn, nil, err
-	}
-
-	return conn, client, err
-}
@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reconconverter/config"
+	"reconconverter/s3test"
+	"reconconverter/transport"
+	"testing"
+	"time"
+)
+
+// failingSource is a local transport whose files fail after the first bytes
+type failingSource struct {
+	transport.Local
+}
+
+type failingReader struct {
+	io.ReadCloser
+	read int
+}
+
+func (source failingSource) Open(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &failingReader{ReadCloser: file}, nil
+}
+
+func (reader *failingReader) Read(p []byte) (int, error) {
+	if reader.read > 0 {
+		return 0, errors.New("connection reset")
+	}
+	n, err := reader.ReadCloser.Read(p[:4])
+	reader.read += n
+	return n, err
+}
+
+func TestMoveToAbortsFailedCopy(t *testing.T) {
+	server := s3test.NewServer("archive")
+	defer server.Close()
+
+	dialer := transport.NewDialer(&config.Config{})
+	defer dialer.Close()
+	archive, err := dialer.Archive(config.Channel{ArchiveType: transport.TypeS3, S3Archive: server.S3()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "ovo.xlsx")
+	if err := os.WriteFile(path, []byte("the whole workbook"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := moveTo(failingSource{}, path, archive, "backup/ovo.xlsx"); err == nil {
+		t.Fatal("move with a failing source succeeded")
+	}
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("truncated copy stored as %v", keys)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("source removed after a failed copy: %v", err)
+	}
+
+	if err := moveTo(transport.Local{}, path, archive, "backup/ovo.xlsx"); err != nil {
+		t.Fatal(err)
+	}
+	if object, _ := server.Object("backup/ovo.xlsx"); string(object.Data) != "the whole workbook" {
+		t.Errorf("archived %q", object.Data)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("source kept after the move: %v", err)
+	}
+}
+
+// failingDestination is a local transport whose files fail on the first write
+type failingDestination struct {
+	transport.Local
+}
+
+type failingWriter struct {
+	io.WriteCloser
+}
+
+func (destination failingDestination) Create(path string) (io.WriteCloser, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return failingWriter{file}, nil
+}
+
+func (writer failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("no space left on device")
+}
+
+func TestUploadReasons(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "converted.csv")
+	if err := os.WriteFile(local, []byte("a;b\n1;2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := upload(transport.Local{}, local, filepath.Join(dir, "missing", "converted.csv"))
+	if reason := ErrorReason(err); reason != "directoryError" || created {
+		t.Errorf("upload to a missing folder failed with %q, created %v: %v", reason, created, err)
+	}
+	created, err = upload(failingDestination{}, local, filepath.Join(dir, "converted (1).csv"))
+	if reason := ErrorReason(err); reason != "invalidFileError" || !created {
+		t.Errorf("failed copy reported as %q, created %v: %v", reason, created, err)
+	}
+	if _, err := upload(transport.Local{}, local, filepath.Join(dir, "delivered.csv")); err != nil {
+		t.Error(err)
+	}
+}
+
+// readOnlyDestination is a local transport that can't create files
+type readOnlyDestination struct {
+	transport.Local
+}
+
+func (destination readOnlyDestination) Create(path string) (io.WriteCloser, error) {
+	return nil, &os.PathError{Op: "create", Path: path, Err: os.ErrPermission}
+}
+
+// a failed upload removes what it wrote, not a file it could not replace
+func TestDeliverRemovesOnlyCreated(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "converted.csv")
+	if err := os.WriteFile(local, []byte("a;b\n1;2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	destination := filepath.Join(dir, "destination")
+	if err := os.Mkdir(destination, 0755); err != nil {
+		t.Fatal(err)
+	}
+	out := &Output{Destination: config.Channel{DestinationPath: destination}}
+
+	existing := filepath.Join(destination, "settlement.csv")
+	if err := os.WriteFile(existing, []byte("delivered before"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := deliver(out, readOnlyDestination{}, localOutput{path: local, plain: local}, "settlement.csv"); err == nil {
+		t.Fatal("delivered to a destination that can't create files")
+	}
+	if _, err := os.Stat(existing); err != nil {
+		t.Errorf("file the upload didn't create removed: %v", err)
+	}
+
+	if _, _, err := deliver(out, failingDestination{}, localOutput{path: local, plain: local}, "partial.csv"); err == nil {
+		t.Fatal("delivered with a failing copy")
+	}
+	if _, err := os.Stat(filepath.Join(destination, "partial.csv")); !os.IsNotExist(err) {
+		t.Errorf("incomplete upload kept: %v", err)
+	}
+}
+
+func TestFileDate(t *testing.T) {
+	rule, err := NewFilenameRule("ovo", config.FilenameRule{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	preamble, err := NewPreamble("ovo", config.Preamble{ScanRows: 5, Fields: []config.PreambleField{
+		{Name: "merchant", Pattern: `Merchant: (\S+)`},
+		{Name: "period", Pattern: `Periode: (\S+)`, DateLayout: "02/01/2006"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := &channel{name: "ovo", rule: rule, preamble: preamble}
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.Local)
+	}
+	year, month, today := time.Now().Date()
+
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		want     time.Time
+	}{
+		// the period the file reports comes before its name
+		{"YOKKE_27-03-2024.xlsx", map[string]string{"merchant": "0700010411960", "period": "01/03/2024"}, day(2024, 3, 1)},
+		{"YOKKE_27-03-2024.xlsx", map[string]string{"merchant": "0700010411960"}, day(2024, 3, 27)},
+		{"YOKKE.xlsx", nil, day(year, month, today)},
+	}
+	for _, c := range cases {
+		if got := ch.fileDate(c.name, c.metadata); !got.Equal(c.want) {
+			t.Errorf("%v %v: got %v, want %v", c.name, c.metadata, got, c.want)
+		}
+	}
+}
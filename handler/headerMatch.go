@@ -0,0 +1,307 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// HeaderDiff is how the header of a sheet differs from the header the schema expects
+type HeaderDiff struct {
+	// the schema version compared with, empty for the header of the schema
+	Version    string
+	Missing    []string
+	Unexpected []string
+	Renamed    []Rename
+	// columns out of the order of the header, only a strict schema requires the order
+	Moved []string
+	// Fingerprint identifies the header row compared, files with the same header have the same
+	Fingerprint string
+}
+
+// Rename is an expected column found under another name at its position
+type Rename struct {
+	From string
+	To   string
+}
+
+func (diff *HeaderDiff) Error() string {
+	var parts []string
+	if len(diff.Missing) > 0 {
+		parts = append(parts, fmt.Sprintf("missing %q", diff.Missing))
+	}
+	if len(diff.Unexpected) > 0 {
+		parts = append(parts, fmt.Sprintf("unexpected %q", diff.Unexpected))
+	}
+	for _, rename := range diff.Renamed {
+		parts = append(parts, fmt.Sprintf("%q renamed to %q", rename.From, rename.To))
+	}
+	if len(diff.Moved) > 0 {
+		parts = append(parts, fmt.Sprintf("moved %q", diff.Moved))
+	}
+	if diff.Version != "" {
+		return fmt.Sprintf("header does not match schema version %v: %v", diff.Version, strings.Join(parts, ", "))
+	}
+	return "header does not match the schema: " + strings.Join(parts, ", ")
+}
+
+// size is the number of differences
+func (diff *HeaderDiff) size() int {
+	return len(diff.Missing) + len(diff.Unexpected) + len(diff.Renamed) + len(diff.Moved)
+}
+
+// describe lists the differences for the notification
+func (diff *HeaderDiff) describe() string {
+	var parts []string
+	if len(diff.Missing) > 0 {
+		parts = append(parts, "kolom tidak ada: "+strings.Join(diff.Missing, ", "))
+	}
+	if len(diff.Unexpected) > 0 {
+		var names []string
+		for _, name := range diff.Unexpected {
+			if strings.TrimSpace(name) == "" {
+				name = "(kosong)"
+			}
+			names = append(names, name)
+		}
+		parts = append(parts, "kolom tidak dikenal: "+strings.Join(names, ", "))
+	}
+	for _, rename := range diff.Renamed {
+		parts = append(parts, fmt.Sprintf("kolom %v berganti nama menjadi %v", rename.From, rename.To))
+	}
+	if len(diff.Moved) > 0 {
+		parts = append(parts, "urutan kolom berubah: "+strings.Join(diff.Moved, ", "))
+	}
+	if diff.Version != "" {
+		return "dibandingkan dengan versi " + diff.Version + ", " + strings.Join(parts, "; ")
+	}
+	return strings.Join(parts, "; ")
+}
+
+// headerMapping is the position in a sheet of every column of the schema header, nil when the
+// sheet has the columns of the header in its order
+type headerMapping []int
+
+// apply returns rows with the columns in the order of header and header as their first row.
+// Columns of the sheet that are not in the header are left out, columns of the header the sheet
+// doesn't have are empty.
+func (mapping headerMapping) apply(rows [][]string, header []string) [][]string {
+	if mapping == nil || len(rows) == 0 {
+		return rows
+	}
+	mapped := make([][]string, len(rows))
+	mapped[0] = append([]string{}, header...)
+	for i, row := range rows[1:] {
+		values := make([]string, len(mapping))
+		for col, from := range mapping {
+			if from >= 0 && from < len(row) {
+				values[col] = row[from]
+			}
+		}
+		mapped[i+1] = values
+	}
+	return mapped
+}
+
+// headerLayout is a header the files of a channel have, the header of the schema or of one of
+// its versions
+type headerLayout struct {
+	// the schema version, empty for the header of the schema
+	version string
+	// files have the layout from that day on
+	from   time.Time
+	header []string
+	// the column of header by folded name and alias
+	names map[string]int
+	// the column of the schema header of every column of header, nil for the schema header
+	canonical []int
+}
+
+// matchHeader locates the columns of the schema header in the header row of a sheet. The row is
+// matched with the schema header, then with the versions in effect on date, the day of the file,
+// newest first. It returns the version matched, or the differences with the closest layout when
+// none matches.
+func (schema *Schema) matchHeader(row []string, date time.Time) (headerMapping, string, *HeaderDiff) {
+	var closest *HeaderDiff
+	for _, layout := range schema.layouts {
+		if date.Before(layout.from) {
+			continue
+		}
+		mapping, diff := schema.matchLayout(layout, row)
+		if diff == nil {
+			return layout.toCanonical(mapping, len(schema.header)), layout.version, nil
+		}
+		if closest == nil || diff.size() < closest.size() {
+			closest = diff
+		}
+	}
+	if closest != nil {
+		closest.Fingerprint = headerFingerprint(row)
+	}
+	return nil, "", closest
+}
+
+// headerFingerprint identifies a header row by its column names, ignoring case, spaces,
+// punctuation and blank cells
+func headerFingerprint(row []string) string {
+	var names []string
+	for _, cell := range row {
+		if name := foldColumnName(cell); name != "" {
+			names = append(names, name)
+		}
+	}
+	sum := sha256.Sum256([]byte(strings.Join(names, ",")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// toCanonical turns the mapping of the columns of the layout into the mapping of the columns of
+// the schema header
+func (layout headerLayout) toCanonical(mapping headerMapping, columns int) headerMapping {
+	if layout.canonical == nil {
+		return mapping
+	}
+	canonical := make(headerMapping, columns)
+	for col := range canonical {
+		canonical[col] = -1
+	}
+	for col, to := range layout.canonical {
+		canonical[to] = col
+		if mapping != nil {
+			canonical[to] = mapping[col]
+		}
+	}
+	return canonical
+}
+
+// matchLayout locates the columns of layout in the header row of a sheet. Columns are found by
+// name or alias, ignoring case, spaces and punctuation, wherever they are. Columns the layout
+// doesn't know are unexpected unless the schema ignores them. Like the fixed header before it,
+// the last column of the layout may have any name when the row has as many columns as the
+// layout, a column added at the end is not taken for it. A strict schema requires the names of
+// the layout in its order.
+func (schema *Schema) matchLayout(layout headerLayout, row []string) (headerMapping, *HeaderDiff) {
+	if schema.strictHeader {
+		if matchesFormat(row, layout.header) {
+			return nil, nil
+		}
+		return nil, schema.diffHeader(layout, row, nil, nil)
+	}
+
+	mapping := make(headerMapping, len(layout.header))
+	for col := range mapping {
+		mapping[col] = -1
+	}
+	var unknown, repeated []int
+	lastCell := -1
+	for i, cell := range row {
+		if strings.TrimSpace(cell) == "" {
+			continue
+		}
+		lastCell = i
+		col, ok := layout.names[foldColumnName(cell)]
+		switch {
+		case !ok:
+			unknown = append(unknown, i)
+		case mapping[col] >= 0:
+			repeated = append(repeated, i)
+		default:
+			mapping[col] = i
+		}
+	}
+	if last := len(mapping) - 1; mapping[last] < 0 && lastCell == last && len(unknown) > 0 && unknown[len(unknown)-1] == lastCell {
+		mapping[last] = lastCell
+		unknown = unknown[:len(unknown)-1]
+	}
+
+	complete := len(repeated) == 0 && (len(unknown) == 0 || schema.ignoreUnknown)
+	for _, from := range mapping {
+		if from < 0 {
+			complete = false
+		}
+	}
+	if !complete {
+		unexpected := append(unknown, repeated...)
+		sort.Ints(unexpected)
+		return nil, schema.diffHeader(layout, row, mapping, unexpected)
+	}
+
+	if len(row) != len(layout.header) {
+		return mapping, nil
+	}
+	for col, from := range mapping {
+		if from != col || row[from] != layout.header[col] {
+			return mapping, nil
+		}
+	}
+	return nil, nil
+}
+
+// diffHeader describes the differences of row with the header of layout. Without a mapping, the
+// columns are compared by exact name and blank cells are unexpected too. A missing column with an
+// unexpected one at its position is reported as renamed.
+func (schema *Schema) diffHeader(layout headerLayout, row []string, mapping headerMapping, unexpected []int) *HeaderDiff {
+	if mapping == nil {
+		mapping = make(headerMapping, len(layout.header))
+		for col, name := range layout.header {
+			mapping[col] = indexOf(row, name)
+		}
+		unexpected = nil
+		for i, cell := range row {
+			if indexOf(layout.header, cell) < 0 {
+				unexpected = append(unexpected, i)
+			}
+		}
+	}
+
+	isUnexpected := make(map[int]bool, len(unexpected))
+	for _, i := range unexpected {
+		isUnexpected[i] = true
+	}
+
+	diff := &HeaderDiff{Version: layout.version}
+	for col, from := range mapping {
+		switch {
+		case from == col:
+		case from >= 0:
+			if schema.strictHeader {
+				diff.Moved = append(diff.Moved, layout.header[col])
+			}
+		case isUnexpected[col]:
+			diff.Renamed = append(diff.Renamed, Rename{From: layout.header[col], To: row[col]})
+			delete(isUnexpected, col)
+		default:
+			diff.Missing = append(diff.Missing, layout.header[col])
+		}
+	}
+	for _, i := range unexpected {
+		if isUnexpected[i] {
+			diff.Unexpected = append(diff.Unexpected, row[i])
+		}
+	}
+	return diff
+}
+
+// headerScore counts the cells of row naming a column of the schema header
+func (schema *Schema) headerScore(row []string) int {
+	score := 0
+	for _, cell := range row {
+		if _, ok := schema.headerNames[foldColumnName(cell)]; ok {
+			score++
+		}
+	}
+	return score
+}
+
+// foldColumnName returns the letters and digits of name in lower case
+func foldColumnName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+}
@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"reconconverter/config"
+	"reconconverter/ledger"
+	"reconconverter/output"
+	"reconconverter/pgp"
+	"reconconverter/transport"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Output is a file delivered for every source file of a channel.
+type Output struct {
+	Writer *output.Writer
+	// the channel config with the destination of the output
+	Destination config.Channel
+	// whether the output goes to the channel's own destination
+	Shared bool
+	// encrypts the output before it is uploaded, nil when it is delivered as written
+	Encryptor *pgp.Encryptor
+}
+
+// NewPgpKeys reads the pgp keys of every channel.
+func NewPgpKeys(cfg *config.Config) (map[string]*pgp.Keys, error) {
+	keys := make(map[string]*pgp.Keys)
+	for channelName, channel := range cfg.Channels() {
+		channelKeys, err := pgp.NewKeys(channel.Pgp)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", channelName, err)
+		}
+		keys[channelName] = channelKeys
+	}
+	return keys, nil
+}
+
+// NewOutputs compiles the outputs of every channel. Encrypted outputs are signed with the
+// channel's keys.
+func NewOutputs(cfg *config.Config, keys map[string]*pgp.Keys) (map[string][]*Output, error) {
+	outputs := make(map[string][]*Output)
+	for channelName, channel := range cfg.Channels() {
+		written := make(map[string]int)
+		for i, settings := range output.Outputs(channel) {
+			writer, err := output.New(settings)
+			if err != nil {
+				return nil, fmt.Errorf("output %d of %v: %v", i+1, channelName, err)
+			}
+
+			encryptor, err := pgp.NewEncryptor(settings.Encrypt, keys[channelName])
+			if err != nil {
+				return nil, fmt.Errorf("output %d of %v: %v", i+1, channelName, err)
+			}
+
+			out := &Output{Writer: writer, Destination: channel, Shared: settings.DestinationType == "", Encryptor: encryptor}
+			if !out.Shared {
+				out.Destination.DestinationType = settings.DestinationType
+				out.Destination.SftpDestination = settings.SftpDestination
+				if out.Destination.SftpDestination.Host == "" {
+					out.Destination.SftpDestination = cfg.Sftp
+				}
+				out.Destination.FtpDestination = settings.FtpDestination
+				out.Destination.S3Destination = settings.S3Destination
+			}
+			if settings.DestinationPath != "" {
+				out.Destination.DestinationPath = settings.DestinationPath
+			}
+
+			// outputs must not overwrite each other
+			key := fmt.Sprintf("%v|%v|%v", out.Destination.DestinationType, out.Destination.DestinationPath, out.Filename("file.csv"))
+			if other, ok := written[key]; ok {
+				return nil, fmt.Errorf("outputs %d and %d of %v write the same file", other+1, i+1, channelName)
+			}
+			written[key] = i
+
+			outputs[channelName] = append(outputs[channelName], out)
+		}
+	}
+	return outputs, nil
+}
+
+// Filename returns the name of the output of a file the filename rule names name
+func (out *Output) Filename(name string) string {
+	name = out.Writer.Filename(name)
+	if out.Encryptor != nil {
+		name += out.Encryptor.Extension()
+	}
+	return name
+}
+
+// localOutput is an output written to the temp folder
+type localOutput struct {
+	// the file uploaded
+	path string
+	// the file as written before it is encrypted, the same as path for unencrypted outputs
+	plain string
+}
+
+func (local localOutput) remove() {
+	removeLocalFile(local.path)
+	if local.plain != local.path {
+		removeLocalFile(local.plain)
+	}
+}
+
+// delivery is an output uploaded for the file being processed
+type delivery struct {
+	destination transport.Transport
+	path        string
+}
+
+// writeLocal writes content in the format of out to the temp folder, encrypted when the
+// output is, and returns where it is written
+func (handler *Handler) writeLocal(ch *channel, out *Output, content [][]string, name string) (localOutput, error) {
+	outputDir := handler.Config.TempFolder + "/after/" + ch.name
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return localOutput{}, failure("directoryError", err)
+	}
+	local := localOutput{path: outputDir + "/" + name, plain: outputDir + "/" + name}
+	if out.Encryptor != nil {
+		local.plain = strings.TrimSuffix(local.path, out.Encryptor.Extension())
+	}
+
+	if err := writeOutput(out.Writer, local.plain, content); err != nil {
+		local.remove()
+		return localOutput{}, failure("internalError", err)
+	}
+	if out.Encryptor != nil {
+		if err := out.Encryptor.Encrypt(local.plain, local.path); err != nil {
+			local.remove()
+			return localOutput{}, failure("pgpError", err)
+		}
+	}
+	return local, nil
+}
+
+// encryptedRecord adds an encrypted output to the ledger record of a file
+func encryptedRecord(record *ledger.Pgp, out *Output, name string) *ledger.Pgp {
+	if record == nil {
+		record = &ledger.Pgp{}
+	}
+	record.Encrypted = append(record.Encrypted, ledger.Encrypted{
+		Output:     name,
+		Recipients: out.Encryptor.Recipients(),
+		SignedWith: out.Encryptor.Signer(),
+	})
+	return record
+}
+
+// deliver uploads an output written by writeLocal to its destination and returns the records
+// counted on the uploaded file. Encrypted outputs can't be read back, their records are counted
+// on the file before it was encrypted.
+func deliver(out *Output, destination transport.Transport, local localOutput, name string) (delivery, int, error) {
+	remoteFileAfter := out.Destination.DestinationPath + "/" + name
+	if created, err := upload(destination, local.path, remoteFileAfter); err != nil {
+		// a file the upload didn't create is not this run's to remove
+		if created {
+			if err := destination.Remove(remoteFileAfter); err != nil && !os.IsNotExist(err) {
+				logrus.Errorf("Failed to remove incomplete upload %v: %v", remoteFileAfter, err)
+			}
+		}
+		return delivery{}, 0, err
+	}
+	delivered := delivery{destination: destination, path: remoteFileAfter}
+
+	tagStatus(destination, remoteFileAfter, StatusDelivered)
+
+	// read again to count row after converted
+	counted, countedPath := destination, remoteFileAfter
+	if out.Encryptor != nil {
+		counted, countedPath = transport.Local{}, local.plain
+	}
+	count, err := countRecords(out.Writer, counted, countedPath)
+	if err != nil {
+		return delivered, 0, failure("invalidFileError", err)
+	}
+
+	return delivered, count, nil
+}
+
+// undeliver removes the outputs of a file that failed after some of its outputs were delivered
+func undeliver(deliveries []delivery) {
+	for _, delivered := range deliveries {
+		if err := delivered.destination.Remove(delivered.path); err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("Failed to remove delivered output %v: %v", delivered.path, err)
+		}
+	}
+}
@@ -0,0 +1,642 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reconconverter/config"
+	"reconconverter/ledger"
+	"reconconverter/mail"
+	"reconconverter/sftptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-yaml/yaml"
+	"github.com/xuri/excelize/v2"
+)
+
+// pipeline is a handler of a single channel whose folders are served by an in-process SFTP server
+type pipeline struct {
+	channelName string
+	root        string
+	server      *sftptest.Server
+	config      *config.Config
+	channel     *config.Channel
+	handler     *Handler
+	recorder    *mail.Recorder
+}
+
+func newPipeline(t *testing.T, channelName string, configure func(*config.Channel)) *pipeline {
+	t.Helper()
+	root := t.TempDir()
+
+	server, err := sftptest.NewServer(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	cfg := &config.Config{
+		TempFolder: filepath.Join(root, "tmp"),
+		LedgerFile: filepath.Join(root, "ledger.jsonl"),
+		Sftp:       server.Sftp(),
+	}
+	channel := map[string]*config.Channel{"ovo": &cfg.Ovo, "indodana": &cfg.Indodana}[channelName]
+	channel.SourcePath = filepath.Join(root, channelName, "source")
+	channel.DestinationPath = filepath.Join(root, channelName, "destination")
+	channel.BackupPath = filepath.Join(root, channelName, "backup")
+	channel.Workers = 2
+	for _, dir := range []string{channel.SourcePath, channel.DestinationPath, channel.BackupPath} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if configure != nil {
+		configure(channel)
+	}
+
+	assets, err := mail.NewAssets("../views", mail.NotifConverted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &mail.Recorder{}
+	h := NewHandlerWithSender(cfg, assets, recorder)
+	t.Cleanup(func() { h.Transports.Close() })
+
+	return &pipeline{
+		channelName: channelName,
+		root:        root,
+		server:      server,
+		config:      cfg,
+		channel:     channel,
+		handler:     h,
+		recorder:    recorder,
+	}
+}
+
+// run processes the channel once
+func (p *pipeline) run(force ...string) *ChannelSummary {
+	summary := p.handler.RunWith(RunOptions{Channels: []string{p.channelName}, Force: force})
+	if channel := summary.Channels[p.channelName]; channel != nil {
+		return channel
+	}
+	return &ChannelSummary{}
+}
+
+// upload copies a file into the source folder under name and returns the sha256 of its content
+func (p *pipeline) upload(t *testing.T, path string, name string) string {
+	t.Helper()
+	in, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(filepath.Join(p.channel.SourcePath, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hasher), in); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func (p *pipeline) ledger(t *testing.T) *ledger.Ledger {
+	t.Helper()
+	processed, err := ledger.Open(p.config.LedgerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return processed
+}
+
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestPipelineOvo(t *testing.T) {
+	testPipeline(t, "ovo", "YOKKE_0700010411960_27-03-2024.xlsx", "YOKKE_0700010411960_20240327.csv")
+}
+
+func TestPipelineIndodana(t *testing.T) {
+	testPipeline(t, "indodana", "settlement_20240327_yokke-ptp.xlsx", "settlement_20240327.csv")
+}
+
+// testPipeline delivers a fixture of testdata/pipeline/<channel>, the .csv of the same name is
+// what recon must receive. A re-upload of the same content is skipped unless it is forced.
+func testPipeline(t *testing.T, channelName string, source string, output string) {
+	p := newPipeline(t, channelName, nil)
+	fixture := filepath.Join("testdata", "pipeline", channelName, source)
+	hash := p.upload(t, fixture, source)
+
+	result := p.run()
+	if len(result.Processed) != 1 || len(result.Failed) != 0 {
+		t.Fatalf("processed %v, failed %v", result.Processed, result.Failed)
+	}
+	if result.RowsBefore != result.RowsAfter || result.RowsBefore == 0 {
+		t.Errorf("rows changed from %d to %d", result.RowsBefore, result.RowsAfter)
+	}
+
+	expected, err := os.ReadFile(strings.TrimSuffix(fixture, ".xlsx") + ".csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := os.ReadFile(filepath.Join(p.channel.DestinationPath, output))
+	if err != nil {
+		t.Fatalf("output not delivered: %v", err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("delivered %v differs from the fixture", output)
+	}
+	if got := listDir(t, p.channel.DestinationPath); len(got) != 1 {
+		t.Errorf("delivered %v, want [%v]", got, output)
+	}
+
+	if got := listDir(t, p.channel.SourcePath); len(got) != 0 {
+		t.Errorf("files left in source: %v", got)
+	}
+	if _, err := os.Stat(filepath.Join(p.channel.BackupPath, source)); err != nil {
+		t.Errorf("not moved to backup: %v", err)
+	}
+
+	entry, ok := p.ledger(t).FindByHash(channelName, hash)
+	if !ok {
+		t.Fatalf("%v not recorded in the ledger", source)
+	}
+	if entry.Source != source || entry.Output != output || entry.Forced {
+		t.Errorf("ledger entry %+v", entry)
+	}
+
+	if subjects := p.recorder.Subjects(); len(subjects) != 1 || !strings.HasPrefix(subjects[0], "[Berhasil]") {
+		t.Errorf("notifications %v, want a single success", subjects)
+	}
+
+	// the same content under another name is not delivered again
+	reupload := strings.TrimSuffix(source, ".xlsx") + " (1).xlsx"
+	p.upload(t, fixture, reupload)
+	if result := p.run(); len(result.Duplicates) != 1 || len(result.Processed) != 0 {
+		t.Fatalf("re-upload: processed %v, duplicates %v", result.Processed, result.Duplicates)
+	}
+	if _, err := os.Stat(filepath.Join(p.channel.BackupPath, reupload)); err != nil {
+		t.Errorf("duplicate not moved to backup: %v", err)
+	}
+	if subjects := p.recorder.Subjects(); len(subjects) != 2 || strings.HasPrefix(subjects[1], "[Berhasil]") {
+		t.Errorf("notifications %v, want the duplicate reported", subjects)
+	}
+
+	// unless it is forced
+	p.upload(t, fixture, source)
+	if result := p.run(source); len(result.Processed) != 1 {
+		t.Fatalf("forced re-upload: processed %v, duplicates %v, failed %v", result.Processed, result.Duplicates, result.Failed)
+	}
+	if entry, _ := p.ledger(t).FindByHash(channelName, hash); !entry.Forced {
+		t.Errorf("forced delivery not recorded in the ledger: %+v", entry)
+	}
+}
+
+// an empty source is reported, a source whose files are held back is not
+func TestPipelineEmptySource(t *testing.T) {
+	p := newPipeline(t, "ovo", func(channel *config.Channel) { channel.DoneMarker = ".done" })
+	p.run()
+	if subjects := p.recorder.Subjects(); len(subjects) != 1 {
+		t.Fatalf("notifications %v, want the empty source reported", subjects)
+	}
+
+	fixture := filepath.Join("testdata", "pipeline", "ovo", "YOKKE_0700010411960_27-03-2024.xlsx")
+	p.upload(t, fixture, "YOKKE_0700010411960_27-03-2024.xlsx")
+	if result := p.run(); len(result.Processed) != 0 || len(result.Failed) != 0 {
+		t.Fatalf("processed %v, failed %v without a done marker", result.Processed, result.Failed)
+	}
+	if subjects := p.recorder.Subjects(); len(subjects) != 1 {
+		t.Errorf("notifications %v, want no report for a file waiting for its done marker", subjects)
+	}
+}
+
+// files with the same content picked up by different workers of a run are delivered once
+func TestPipelineConcurrentDuplicates(t *testing.T) {
+	p := newPipeline(t, "ovo", func(channel *config.Channel) { channel.Workers = 4 })
+	fixture := filepath.Join("testdata", "pipeline", "ovo", "YOKKE_0700010411960_27-03-2024.xlsx")
+	for _, name := range []string{"YOKKE_0700010411960_27-03-2024.xlsx", "YOKKE_0700010411960_28-03-2024.xlsx"} {
+		p.upload(t, fixture, name)
+	}
+
+	result := p.run()
+	if len(result.Processed) != 1 || len(result.Duplicates) != 1 || len(result.Failed) != 0 {
+		t.Fatalf("processed %v, duplicates %v, failed %v", result.Processed, result.Duplicates, result.Failed)
+	}
+	if got := listDir(t, p.channel.DestinationPath); len(got) != 1 {
+		t.Errorf("delivered %v, want a single file", got)
+	}
+	if got := listDir(t, p.channel.BackupPath); len(got) != 2 {
+		t.Errorf("backup %v, want both files", got)
+	}
+}
+
+// Every file a run processes, delivered, duplicate or failed, gives back what it opened: the
+// descriptors of the process, the handles of the SFTP server and the files of the temp folder.
+func TestPipelineReleasesResources(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("open files are counted from /proc")
+	}
+	p := newPipeline(t, "ovo", func(channel *config.Channel) { channel.Workers = 4 })
+	fixture := filepath.Join("testdata", "pipeline", "ovo", "YOKKE_0700010411960_27-03-2024.xlsx")
+
+	// the first run connects to the server, what stays open afterwards is the baseline
+	p.upload(t, fixture, "YOKKE_0700010411960_27-03-2024.xlsx")
+	if result := p.run(); len(result.Processed) != 1 {
+		t.Fatalf("first run: processed %v, failed %v", result.Processed, result.Failed)
+	}
+	fds, temp := countFds(t), listFiles(t, p.config.TempFolder)
+
+	workbook, err := excelize.OpenFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer workbook.Close()
+	sheet := workbook.GetSheetName(0)
+	invoice, err := workbook.SearchSheet(sheet, "INV-0001")
+	if err != nil || len(invoice) == 0 {
+		t.Fatalf("no invoice cell in the fixture: %v", err)
+	}
+
+	const runs, files = 4, 75
+	date := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	var previous []byte
+	// failed files stay in the source folder and are tried again every run
+	failed := 0
+	for run := 0; run < runs; run++ {
+		invalid, duplicates := 0, 0
+		for i := 0; i < files; i++ {
+			date = date.AddDate(0, 0, 1)
+			name := "YOKKE_0700010411960_" + date.Format("02-01-2006") + ".xlsx"
+			content := previous
+			switch {
+			case i%10 == 9:
+				content = []byte(fmt.Sprintf("not a workbook %d", i))
+				invalid++
+			case i%10 == 4:
+				// a re-upload of the file before under another date
+				duplicates++
+			default:
+				workbook.SetCellValue(sheet, invoice[0], fmt.Sprintf("INV-%d-%d", run, i))
+				buffer, err := workbook.WriteToBuffer()
+				if err != nil {
+					t.Fatal(err)
+				}
+				content = bytes.Clone(buffer.Bytes())
+			}
+			if err := os.WriteFile(filepath.Join(p.channel.SourcePath, name), content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			previous = content
+		}
+
+		result := p.run()
+		failed += invalid
+		if len(result.Processed) != files-invalid-duplicates || len(result.Duplicates) != duplicates || len(result.Failed) != failed {
+			t.Fatalf("run %d: %d processed, %d duplicates, %d failed", run, len(result.Processed), len(result.Duplicates), len(result.Failed))
+		}
+
+		if handles, err := p.server.OpenFiles(); err != nil || len(handles) != 0 {
+			t.Fatalf("run %d: files left open below the served folder %v, %v", run, handles, err)
+		}
+		if got := countFds(t); got != fds {
+			t.Fatalf("run %d: %d open descriptors, %d after the first run", run, got, fds)
+		}
+		if got := listFiles(t, p.config.TempFolder); strings.Join(got, ",") != strings.Join(temp, ",") {
+			t.Fatalf("run %d: temp folder holds %v, %v after the first run", run, got, temp)
+		}
+	}
+}
+
+func countFds(t *testing.T) int {
+	t.Helper()
+	return len(listDir(t, "/proc/self/fd"))
+}
+
+// listFiles lists the files below dir, directories left for later runs are not counted
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// indodanaWorkbook returns the indodana fixture with the transaction id of its first row
+// replaced by id, so workbooks of the same day differ in content
+func indodanaWorkbook(t *testing.T, id string) []byte {
+	t.Helper()
+	workbook, err := excelize.OpenFile(filepath.Join("testdata", "pipeline", "indodana", "settlement_20240327_yokke-ptp.xlsx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer workbook.Close()
+	sheet := workbook.GetSheetName(workbook.GetActiveSheetIndex())
+	cells, err := workbook.SearchSheet(sheet, "TRX-0000001")
+	if err != nil || len(cells) == 0 {
+		t.Fatalf("no transaction id in the fixture: %v", err)
+	}
+	workbook.SetCellValue(sheet, cells[0], id)
+	buffer, err := workbook.WriteToBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Clone(buffer.Bytes())
+}
+
+// member is a file of a zip archive uploaded by a test
+type member struct {
+	name string
+	data []byte
+}
+
+// uploadZip writes a zip of members to the source folder
+func (p *pipeline) uploadZip(t *testing.T, name string, members ...member) {
+	t.Helper()
+	var buffer bytes.Buffer
+	w := zip.NewWriter(&buffer)
+	for _, m := range members {
+		out, err := w.Create(m.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := out.Write(m.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(p.channel.SourcePath, name), buffer.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// every file of an archive is delivered and recorded on its own
+func TestPipelineArchive(t *testing.T) {
+	p := newPipeline(t, "indodana", nil)
+	march27, march28 := indodanaWorkbook(t, "TRX-27"), indodanaWorkbook(t, "TRX-28")
+	p.uploadZip(t, "settlements.zip",
+		member{"2024/settlement_20240327_yokke-ptp.xlsx", march27},
+		member{"2024/settlement_20240328_yokke-ptp.xlsx", march28},
+		member{"readme.txt", []byte("not a settlement")})
+
+	result := p.run()
+	if len(result.Processed) != 2 || len(result.Failed) != 0 {
+		t.Fatalf("processed %v, failed %v", result.Processed, result.Failed)
+	}
+	if got := listDir(t, p.channel.DestinationPath); strings.Join(got, ",") != "settlement_20240327.csv,settlement_20240328.csv" {
+		t.Errorf("delivered %v", got)
+	}
+	if got := listDir(t, p.channel.BackupPath); strings.Join(got, ",") != "settlements.zip" {
+		t.Errorf("backup holds %v", got)
+	}
+
+	processed := p.ledger(t)
+	for source, data := range map[string][]byte{"settlement_20240327_yokke-ptp.xlsx": march27, "settlement_20240328_yokke-ptp.xlsx": march28} {
+		entry, ok := processed.FindByHash("indodana", sha256Hex(data))
+		if !ok {
+			t.Errorf("%v not recorded in the ledger", source)
+			continue
+		}
+		if entry.Source != source || entry.Archive != "settlements.zip" || entry.Output != strings.Replace(source, "_yokke-ptp.xlsx", ".csv", 1) {
+			t.Errorf("ledger entry %+v", entry)
+		}
+	}
+
+	// the same files in another archive are duplicates, file by file
+	p.uploadZip(t, "settlements (1).zip",
+		member{"settlement_20240327_yokke-ptp.xlsx", march27},
+		member{"settlement_20240328_yokke-ptp.xlsx", march28})
+	if result := p.run(); len(result.Duplicates) != 2 || len(result.Processed) != 0 {
+		t.Errorf("re-upload: processed %v, duplicates %v, failed %v", result.Processed, result.Duplicates, result.Failed)
+	}
+}
+
+// the files of an archive are named with the other files of the run, a file of an archive
+// mapping to the output of another file is not delivered over it
+func TestPipelineArchiveCollisions(t *testing.T) {
+	p := newPipeline(t, "indodana", nil)
+	top := indodanaWorkbook(t, "TRX-TOP")
+	member0, member1, member2 := indodanaWorkbook(t, "TRX-ZIP-0"), indodanaWorkbook(t, "TRX-ZIP-1"), indodanaWorkbook(t, "TRX-ZIP-2")
+	if err := os.WriteFile(filepath.Join(p.channel.SourcePath, "settlement_20240401_yokke-ptp.xlsx"), top, 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.uploadZip(t, "first.zip", member{"settlement_20240401_yokke-ptp.xlsx", member0})
+	p.uploadZip(t, "second.zip", member{"settlement_20240402_yokke-ptp.xlsx", member1})
+	p.uploadZip(t, "third.zip", member{"settlement_20240402_yokke-ptp.xlsx", member2})
+
+	result := p.run()
+	// the top level file and one of the archives mapping to 20240402
+	if len(result.Processed) != 2 || len(result.Failed) != 2 {
+		t.Fatalf("processed %v, failed %v", result.Processed, result.Failed)
+	}
+	if !contains(result.Processed, "settlement_20240401_yokke-ptp.xlsx") || !contains(result.Failed, "first.zip/settlement_20240401_yokke-ptp.xlsx") {
+		t.Errorf("processed %v, failed %v", result.Processed, result.Failed)
+	}
+
+	delivered, err := os.ReadFile(filepath.Join(p.channel.DestinationPath, "settlement_20240401.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(delivered, []byte("TRX-TOP")) {
+		t.Errorf("output of the top level file replaced by a file of an archive")
+	}
+	if _, ok := p.ledger(t).FindByHash("indodana", sha256Hex(member1)); ok != contains(result.Processed, "second.zip/settlement_20240402_yokke-ptp.xlsx") {
+		t.Errorf("ledger disagrees with the run on second.zip")
+	}
+
+	// archives with a file that failed stay in the source for the next run
+	if got := listDir(t, p.channel.SourcePath); len(got) != 2 || got[0] != "first.zip" {
+		t.Errorf("source holds %v", got)
+	}
+}
+
+func TestPipelineArchiveRejected(t *testing.T) {
+	p := newPipeline(t, "indodana", func(channel *config.Channel) {
+		channel.Archive = config.Archive{MaxMembers: 2}
+	})
+	workbook := indodanaWorkbook(t, "TRX-NESTED")
+
+	var inner bytes.Buffer
+	w := zip.NewWriter(&inner)
+	out, _ := w.Create("settlement_20240403_yokke-ptp.xlsx")
+	out.Write(workbook)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p.uploadZip(t, "nested.zip", member{"inner.zip", inner.Bytes()})
+	p.uploadZip(t, "crowded.zip",
+		member{"settlement_20240404_yokke-ptp.xlsx", indodanaWorkbook(t, "TRX-1")},
+		member{"settlement_20240405_yokke-ptp.xlsx", indodanaWorkbook(t, "TRX-2")},
+		member{"settlement_20240406_yokke-ptp.xlsx", indodanaWorkbook(t, "TRX-3")})
+
+	result := p.run()
+	if len(result.Processed) != 0 || !contains(result.Failed, "nested.zip/inner.zip") || !contains(result.Failed, "crowded.zip") {
+		t.Fatalf("processed %v, failed %v", result.Processed, result.Failed)
+	}
+	if got := listDir(t, p.channel.DestinationPath); len(got) != 0 {
+		t.Errorf("delivered %v", got)
+	}
+	if got := listDir(t, p.channel.SourcePath); strings.Join(got, ",") != "crowded.zip,nested.zip" {
+		t.Errorf("source holds %v", got)
+	}
+}
+
+// a retry of an archive that partly failed skips the files it delivered without reporting them
+// as duplicates
+func TestPipelineArchiveRetry(t *testing.T) {
+	p := newPipeline(t, "indodana", nil)
+	p.uploadZip(t, "settlements.zip",
+		member{"settlement_20240327_yokke-ptp.xlsx", indodanaWorkbook(t, "TRX-27")},
+		member{"settlement_20240328_yokke-ptp.xlsx", []byte("not a workbook")})
+
+	result := p.run()
+	if len(result.Processed) != 1 || len(result.Failed) != 1 {
+		t.Fatalf("processed %v, failed %v", result.Processed, result.Failed)
+	}
+	if subjects := p.recorder.Subjects(); len(subjects) != 2 {
+		t.Fatalf("notifications %v, want a success and a failure", subjects)
+	}
+
+	result = p.run()
+	if len(result.Processed) != 0 || len(result.Duplicates) != 1 || len(result.Failed) != 1 {
+		t.Fatalf("retry: processed %v, duplicates %v, failed %v", result.Processed, result.Duplicates, result.Failed)
+	}
+	if subjects := p.recorder.Subjects(); len(subjects) != 3 {
+		t.Errorf("notifications %v after the retry, want only the failure reported", subjects)
+	}
+	if got := listDir(t, p.channel.DestinationPath); strings.Join(got, ",") != "settlement_20240327.csv" {
+		t.Errorf("delivered %v", got)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// a layout no schema version has is reported for the first file that has it, not for every file
+// or every run, whether a column was renamed or added
+func TestPipelineNewFormatReportedOnce(t *testing.T) {
+	for _, name := range []string{"version_unknown", "version_added_column"} {
+		t.Run(name, func(t *testing.T) {
+			testNewFormatReportedOnce(t, filepath.Join("..", "testdata", "golden", "ovo", name))
+		})
+	}
+}
+
+func testNewFormatReportedOnce(t *testing.T, fixture string) {
+	raw, err := os.ReadFile(fixture + ".yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versioned config.Channel
+	if err := yaml.Unmarshal(raw, &versioned); err != nil {
+		t.Fatal(err)
+	}
+	p := newPipeline(t, "ovo", func(channel *config.Channel) { channel.Schema = versioned.Schema })
+
+	p.upload(t, fixture+".xlsx", "YOKKE_0700010411960_01-04-2024.xlsx")
+	p.upload(t, fixture+".xlsx", "YOKKE_0700010411960_02-04-2024.xlsx")
+	if result := p.run(); len(result.Failed) != 2 {
+		t.Fatalf("processed %v, failed %v", result.Processed, result.Failed)
+	}
+	if subjects := p.recorder.Subjects(); len(subjects) != 1 {
+		t.Fatalf("notifications %v, want the new format reported once", subjects)
+	}
+
+	// the files stay in the source and fail again without a report
+	if result := p.run(); len(result.Failed) != 2 {
+		t.Fatalf("second run: processed %v, failed %v", result.Processed, result.Failed)
+	}
+	if subjects := p.recorder.Subjects(); len(subjects) != 1 {
+		t.Errorf("notifications %v after the second run, want no new report", subjects)
+	}
+
+	// the ledger remembers the format for the runs after a restart, a different header is new
+	workbook, err := excelize.OpenFile(fixture + ".xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer workbook.Close()
+	sheet := workbook.GetSheetName(0)
+	cells, err := workbook.SearchSheet(sheet, "QRISAmountUsed")
+	if err != nil || len(cells) == 0 {
+		t.Fatalf("no QRISAmountUsed column in the fixture: %v", err)
+	}
+	workbook.SetCellValue(sheet, cells[0], "QRISAmount")
+	if err := workbook.SaveAs(filepath.Join(p.channel.SourcePath, "YOKKE_0700010411960_03-04-2024.xlsx")); err != nil {
+		t.Fatal(err)
+	}
+	restarted := NewHandlerWithSender(p.config, p.handler.Assets, p.recorder)
+	defer restarted.Transports.Close()
+	summary := restarted.RunWith(RunOptions{Channels: []string{"ovo"}})
+	if result := summary.Channels["ovo"]; result == nil || len(result.Failed) != 3 {
+		t.Fatalf("after restart: %+v", result)
+	}
+	if subjects := p.recorder.Subjects(); len(subjects) != 2 {
+		t.Errorf("notifications %v after the restart, want the changed header reported", subjects)
+	}
+
+	var reported []string
+	raw, err = os.ReadFile(p.config.LedgerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		var entry ledger.Entry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.NewFormat != "" {
+			reported = append(reported, entry.Source)
+		}
+	}
+	if len(reported) != 2 || reported[1] != "YOKKE_0700010411960_03-04-2024.xlsx" {
+		t.Errorf("new formats recorded for %v", reported)
+	}
+}
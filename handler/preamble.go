@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"fmt"
+	"reconconverter/config"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Preamble locates the header of a sheet below the partner's title rows and captures values
+// of those rows.
+type Preamble struct {
+	scanRows int
+	fields   []preambleField
+}
+
+type preambleField struct {
+	name       string
+	pattern    *regexp.Regexp
+	dateLayout string
+}
+
+// NewPreamble compiles the preamble of a channel
+func NewPreamble(channelName string, cfg config.Preamble) (*Preamble, error) {
+	if cfg.ScanRows < 0 {
+		return nil, fmt.Errorf("preamble scan rows of %v must not be negative", channelName)
+	}
+	preamble := &Preamble{scanRows: cfg.ScanRows}
+
+	names := make(map[string]bool)
+	for _, field := range cfg.Fields {
+		if field.Name == "" || field.Pattern == "" {
+			return nil, fmt.Errorf("preamble field of %v needs both name and pattern", channelName)
+		}
+		if names[field.Name] {
+			return nil, fmt.Errorf("preamble of %v has more than one field %v", channelName, field.Name)
+		}
+		names[field.Name] = true
+		if cfg.ScanRows < 2 {
+			return nil, fmt.Errorf("preamble field %v of %v needs scan rows, the header is the first row", field.Name, channelName)
+		}
+
+		re, err := regexp.Compile(field.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern of preamble field %v of %v: %v", field.Name, channelName, err)
+		}
+		preamble.fields = append(preamble.fields, preambleField{name: field.Name, pattern: re, dateLayout: field.DateLayout})
+	}
+	return preamble, nil
+}
+
+// NewPreambles compiles the preamble of every channel.
+func NewPreambles(cfg *config.Config) (map[string]*Preamble, error) {
+	preambles := make(map[string]*Preamble)
+	for channelName, channel := range cfg.Channels() {
+		preamble, err := NewPreamble(channelName, channel.Preamble)
+		if err != nil {
+			return nil, err
+		}
+		preambles[channelName] = preamble
+	}
+	return preambles, nil
+}
+
+// HasFields reports whether values are captured from the preamble
+func (preamble *Preamble) HasFields() bool {
+	return len(preamble.fields) > 0
+}
+
+// Date returns the first value of metadata captured with a DateLayout, the period the file
+// reports
+func (preamble *Preamble) Date(metadata map[string]string) (time.Time, bool) {
+	for _, field := range preamble.fields {
+		if field.dateLayout == "" {
+			continue
+		}
+		if date, err := time.Parse(field.dateLayout, metadata[field.name]); err == nil {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// HeaderRow returns the index of the header in rows, the first of the scanned rows with the
+// most cells naming a column of the schema header. It is 0 when no row has any.
+func (preamble *Preamble) HeaderRow(rows [][]string, schema *Schema) int {
+	best, bestScore := 0, 0
+	for i := 0; i < preamble.scanRows && i < len(rows); i++ {
+		if score := schema.headerScore(rows[i]); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// Metadata captures the values of the fields in rows, the rows above the header. Every field
+// must be found.
+func (preamble *Preamble) Metadata(rows [][]string) (map[string]string, error) {
+	if !preamble.HasFields() {
+		return nil, nil
+	}
+
+	lines := make([]string, 0, len(rows))
+	for _, row := range rows {
+		var cells []string
+		for _, cell := range row {
+			if cell = strings.TrimSpace(cell); cell != "" {
+				cells = append(cells, cell)
+			}
+		}
+		lines = append(lines, strings.Join(cells, " "))
+	}
+
+	metadata := make(map[string]string, len(preamble.fields))
+	for _, field := range preamble.fields {
+		value, ok := field.capture(lines)
+		if !ok {
+			return nil, fmt.Errorf("no %v above the header, expected a row matching %v", field.name, field.pattern)
+		}
+		if field.dateLayout != "" {
+			if _, err := time.Parse(field.dateLayout, value); err != nil {
+				return nil, fmt.Errorf("invalid %v %q above the header: %v", field.name, value, err)
+			}
+		}
+		metadata[field.name] = value
+	}
+	return metadata, nil
+}
+
+func (field preambleField) capture(lines []string) (string, bool) {
+	for _, line := range lines {
+		match := field.pattern.FindStringSubmatch(line)
+		switch {
+		case match == nil:
+			continue
+		case len(match) > 1:
+			return strings.TrimSpace(match[1]), true
+		default:
+			return strings.TrimSpace(match[0]), true
+		}
+	}
+	return "", false
+}
+
+// TemplateValues returns metadata the way the filename template sees it, dates are parsed so
+// they can be reformatted. Without metadata every field is empty, for names rendered before
+// the file is read.
+func (preamble *Preamble) TemplateValues(metadata map[string]string) map[string]interface{} {
+	values := make(map[string]interface{}, len(preamble.fields))
+	for _, field := range preamble.fields {
+		value := metadata[field.name]
+		if field.dateLayout == "" {
+			values[field.name] = value
+			continue
+		}
+		// checked when captured
+		parsed, _ := time.Parse(field.dateLayout, value)
+		values[field.name] = parsed
+	}
+	return values
+}
+
+// trimBlankRows returns rows without the rows at its end that have no value
+func trimBlankRows(rows [][]string) [][]string {
+	for len(rows) > 0 && isBlankRow(rows[len(rows)-1]) {
+		rows = rows[:len(rows)-1]
+	}
+	return rows
+}
+
+func isBlankRow(row []string) bool {
+	for _, cell := range row {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"fmt"
+	"reconconverter/config"
+	"strings"
+)
+
+// fields of a file available to output columns
+const (
+	FieldChannel = "channel"
+	FieldSource  = "source"
+	FieldOutput  = "output"
+	FieldRunID   = "runId"
+)
+
+// FileFields are the values of a file that don't come from its content.
+type FileFields struct {
+	Channel string
+	Source  string
+	Output  string
+	RunID   string
+}
+
+func (fields FileFields) get(name string) string {
+	switch name {
+	case FieldChannel:
+		return fields.Channel
+	case FieldSource:
+		return fields.Source
+	case FieldOutput:
+		return fields.Output
+	case FieldRunID:
+		return fields.RunID
+	}
+	return ""
+}
+
+// outputValue computes the value of an output column from a row
+type outputValue func(row []string, fields FileFields) string
+
+type outputColumn struct {
+	name  string
+	value outputValue
+}
+
+// compileOutput checks the output columns against the columns of the normalized file
+func compileOutput(columns []config.OutputColumn, header []string) ([]outputColumn, error) {
+	var compiled []outputColumn
+	for i, column := range columns {
+		name := column.Name
+		if name == "" {
+			name = column.From
+		}
+		if name == "" {
+			return nil, fmt.Errorf("output column %d has no name", i+1)
+		}
+		if column.From == "" && column.Value == nil && column.Field == "" && len(column.Concat) == 0 {
+			column.From = name
+		}
+
+		value, err := compileValue(column, header)
+		if err != nil {
+			return nil, fmt.Errorf("output column %v: %v", name, err)
+		}
+		compiled = append(compiled, outputColumn{name: name, value: value})
+	}
+	return compiled, nil
+}
+
+func compileValue(column config.OutputColumn, header []string) (outputValue, error) {
+	set := 0
+	for _, isSet := range []bool{column.From != "", column.Value != nil, column.Field != "", len(column.Concat) > 0} {
+		if isSet {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("only one of from, value, field and concat can be set")
+	}
+	if set == 0 {
+		return nil, fmt.Errorf("one of from, value, field and concat must be set")
+	}
+
+	switch {
+	case column.From != "":
+		col := indexOf(header, column.From)
+		if col < 0 {
+			return nil, fmt.Errorf("column %v not in header", column.From)
+		}
+		return func(row []string, fields FileFields) string {
+			if col < len(row) {
+				return row[col]
+			}
+			return ""
+		}, nil
+
+	case column.Field != "":
+		switch column.Field {
+		case FieldChannel, FieldSource, FieldOutput, FieldRunID:
+		default:
+			return nil, fmt.Errorf("unknown field %q", column.Field)
+		}
+		field := column.Field
+		return func(row []string, fields FileFields) string {
+			return fields.get(field)
+		}, nil
+
+	case len(column.Concat) > 0:
+		var parts []outputValue
+		for _, part := range column.Concat {
+			value, err := compileValue(part, header)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, value)
+		}
+		separator := column.Separator
+		return func(row []string, fields FileFields) string {
+			values := make([]string, len(parts))
+			for i, part := range parts {
+				values[i] = part(row, fields)
+			}
+			return strings.Join(values, separator)
+		}, nil
+	}
+
+	constant := *column.Value
+	return func(row []string, fields FileFields) string {
+		return constant
+	}, nil
+}
+
+// project builds the output rows. content starts with the header.
+func project(columns []outputColumn, content [][]string, fields FileFields) [][]string {
+	projected := make([][]string, len(content))
+
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.name
+	}
+	projected[0] = header
+
+	for idx := 1; idx < len(content); idx++ {
+		row := make([]string, len(columns))
+		for i, column := range columns {
+			row[i] = column.value(content[idx], fields)
+		}
+		projected[idx] = row
+	}
+	return projected
+}
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	StatusProcessed = "processed"
+	StatusFailed    = "failed"
+	StatusDuplicate = "duplicate"
+	// tagged on delivered output files, never the status of a source file
+	StatusDelivered = "delivered"
+)
+
+// FileResult is the outcome of processing a single source file.
+type FileResult struct {
+	// the source file, a file of an archive is named <archive>/<file>
+	Source     string
+	Status     string
+	RowsBefore int
+	RowsAfter  int
+}
+
+type ChannelSummary struct {
+	Processed  []string
+	Failed     []string
+	Duplicates []string
+	RowsBefore int
+	RowsAfter  int
+}
+
+// RunSummary aggregates the results of all channels in a run. It is safe for concurrent use.
+type RunSummary struct {
+	mu sync.Mutex
+	// identifies the run in the delivered files, derived from the start time
+	ID       string
+	Started  time.Time
+	Finished time.Time
+	Channels map[string]*ChannelSummary
+}
+
+func NewRunSummary() *RunSummary {
+	started := time.Now()
+	return &RunSummary{
+		ID:       started.Format("20060102T150405.000"),
+		Started:  started,
+		Channels: make(map[string]*ChannelSummary),
+	}
+}
+
+func (summary *RunSummary) Add(channelName string, file string, result FileResult) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+
+	channel, ok := summary.Channels[channelName]
+	if !ok {
+		channel = &ChannelSummary{}
+		summary.Channels[channelName] = channel
+	}
+
+	switch result.Status {
+	case StatusProcessed:
+		channel.Processed = append(channel.Processed, file)
+	case StatusDuplicate:
+		channel.Duplicates = append(channel.Duplicates, file)
+	default:
+		channel.Failed = append(channel.Failed, file)
+	}
+	channel.RowsBefore += result.RowsBefore
+	channel.RowsAfter += result.RowsAfter
+}
+
+// Finish marks the end of the run and logs the summary of every channel.
+func (summary *RunSummary) Finish() {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+
+	summary.Finished = time.Now()
+
+	var names []string
+	for name := range summary.Channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	logrus.Infof("Run finished in %v", summary.Finished.Sub(summary.Started).Round(time.Second))
+	for _, name := range names {
+		channel := summary.Channels[name]
+		logrus.Infof("Summary %v: processed %d, failed %d, duplicate %d, rows before %d, rows after %d",
+			name, len(channel.Processed), len(channel.Failed), len(channel.Duplicates), channel.RowsBefore, channel.RowsAfter)
+	}
+}
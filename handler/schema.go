@@ -0,0 +1,528 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"reconconverter/config"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/expr-lang/expr/vm"
+)
+
+const (
+	ColumnText     = "text"
+	ColumnNumber   = "number"
+	ColumnDate     = "date"
+	ColumnTime     = "time"
+	ColumnDateTime = "datetime"
+)
+
+// default schemas expect the partner's header and declare the amount columns,
+// which used to be read with the General number format
+var defaultSchemas = map[string]config.Schema{
+	"ovo": {Header: ovoFormat, Columns: numberColumns(
+		"TransactionAmount", "CashAmountUsed", "OVOPointUsed", "MDROVOCash", "NettAmountOVOCash",
+		"MDROVOPoint", "NettAmountOVOPoint", "OVOPayLaterUsed", "MDROVOPayLater", "NettAmountOVOPayLater",
+		"SavingsAmountUsed", "MDRSavingsPlusByNobu", "NettAmountSavingsPlusByNobu", "RefundOVOCash",
+		"RefundOVOPoint", "RefundOVOPaylater", "NettSettlement",
+		"MDRRefundCash", "MDRRefundPoint", "MDRRefundPayLater",
+	)},
+	"indodana": {Header: indodanaFormat, Columns: numberColumns("AMOUNT", "FEE", "TAX", "MERCHANT SUPPORT", "PAY TO MERCHANT")},
+}
+
+func numberColumns(names ...string) []config.Column {
+	columns := make([]config.Column, len(names))
+	for i, name := range names {
+		columns[i] = config.Column{Name: name, Type: ColumnNumber}
+	}
+	return columns
+}
+
+type columnRule struct {
+	kind                  string
+	decimals              int
+	decimalSeparator      string
+	inputDecimalSeparator string
+	layouts               []string
+	layout                string
+	location              *time.Location
+	outputLocation        *time.Location
+	timeColumn            string
+}
+
+// Schema checks the header of a workbook, normalizes its rows column by column
+// and projects them on the output columns.
+type Schema struct {
+	header []string
+	// the column of header by folded name and alias
+	headerNames  map[string]int
+	strictHeader bool
+	// columns no layout knows are left out instead of unexpected
+	ignoreUnknown bool
+	// the header of the schema then its versions, newest first
+	layouts    []headerLayout
+	columns    map[string]columnRule
+	scope      *rowScope
+	transforms []transformRule
+	dropWhen   []*vm.Program
+	output     []outputColumn
+}
+
+// NewSchema compiles the schema of a channel. Configured columns override the
+// default column of the same name.
+func NewSchema(channelName string, schema config.Schema) (*Schema, error) {
+	columns := append(append([]config.Column{}, defaultSchemas[channelName].Columns...), schema.Columns...)
+
+	compiled := &Schema{
+		header:        schema.Header,
+		strictHeader:  schema.StrictHeader,
+		ignoreUnknown: schema.IgnoreUnknownColumns,
+		columns:       make(map[string]columnRule),
+	}
+	if len(compiled.header) == 0 {
+		compiled.header = defaultSchemas[channelName].Header
+	}
+	if len(compiled.header) == 0 {
+		return nil, fmt.Errorf("schema of %v has no header", channelName)
+	}
+	if err := compiled.compileHeaderNames(columns); err != nil {
+		return nil, fmt.Errorf("schema of %v: %v", channelName, err)
+	}
+	if err := compiled.compileVersions(schema.Versions); err != nil {
+		return nil, fmt.Errorf("schema of %v: %v", channelName, err)
+	}
+
+	for _, column := range columns {
+		if column.Name == "" {
+			return nil, fmt.Errorf("schema of %v has a column without name", channelName)
+		}
+
+		rule := columnRule{kind: column.Type, decimals: -1, decimalSeparator: column.DecimalSeparator}
+		switch column.Type {
+		case "", ColumnText:
+			rule.kind = ColumnText
+		case ColumnNumber:
+			if column.Decimals != nil {
+				if *column.Decimals < 0 {
+					return nil, fmt.Errorf("invalid decimals %d of column %v in schema of %v", *column.Decimals, column.Name, channelName)
+				}
+				rule.decimals = *column.Decimals
+			}
+			if rule.decimalSeparator == "" {
+				rule.decimalSeparator = "."
+			}
+			switch column.InputDecimalSeparator {
+			case "", ".", ",":
+				rule.inputDecimalSeparator = column.InputDecimalSeparator
+			default:
+				return nil, fmt.Errorf("invalid input decimal separator %q of column %v in schema of %v", column.InputDecimalSeparator, column.Name, channelName)
+			}
+		case ColumnDate, ColumnTime, ColumnDateTime:
+			if err := compileDateColumn(&rule, column); err != nil {
+				return nil, fmt.Errorf("column %v in schema of %v: %v", column.Name, channelName, err)
+			}
+		default:
+			return nil, fmt.Errorf("unknown type %q of column %v in schema of %v", column.Type, column.Name, channelName)
+		}
+		compiled.columns[column.Name] = rule
+	}
+
+	// output columns refer to the columns left after merging date and time
+	var normalized []string
+	for _, name := range compiled.header {
+		if !compiled.mergesTime(name) {
+			normalized = append(normalized, name)
+		}
+	}
+	var err error
+	compiled.scope = newRowScope(normalized, compiled.columns)
+	if compiled.transforms, err = compileTransforms(schema.Transforms, compiled.scope); err != nil {
+		return nil, fmt.Errorf("schema of %v: %v", channelName, err)
+	}
+	if compiled.dropWhen, err = compileConditions(schema.DropWhen, compiled.scope); err != nil {
+		return nil, fmt.Errorf("schema of %v: %v", channelName, err)
+	}
+	if compiled.output, err = compileOutput(schema.Output, compiled.scope.columns); err != nil {
+		return nil, fmt.Errorf("schema of %v: %v", channelName, err)
+	}
+
+	return compiled, nil
+}
+
+// compileHeaderNames indexes the columns of the header by their folded names and aliases
+func (schema *Schema) compileHeaderNames(columns []config.Column) error {
+	schema.headerNames = make(map[string]int)
+	add := func(name string, col int) error {
+		folded := foldColumnName(name)
+		if other, ok := schema.headerNames[folded]; ok && other != col {
+			return fmt.Errorf("%q of column %v is the same as column %v ignoring case, spaces and punctuation", name, schema.header[col], schema.header[other])
+		}
+		schema.headerNames[folded] = col
+		return nil
+	}
+
+	for col, name := range schema.header {
+		if err := add(name, col); err != nil {
+			return err
+		}
+	}
+	for _, column := range columns {
+		if len(column.Aliases) == 0 {
+			continue
+		}
+		col := indexOf(schema.header, column.Name)
+		if col < 0 {
+			return fmt.Errorf("column %v has aliases but is not in the header", column.Name)
+		}
+		for _, alias := range column.Aliases {
+			if err := add(alias, col); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compileVersions maps the columns of every version to the columns of the header
+func (schema *Schema) compileVersions(versions []config.SchemaVersion) error {
+	schema.layouts = []headerLayout{{header: schema.header, names: schema.headerNames}}
+
+	names := make(map[string]bool)
+	var compiled []headerLayout
+	for _, version := range versions {
+		if version.Name == "" {
+			return fmt.Errorf("schema version without name")
+		}
+		if names[version.Name] {
+			return fmt.Errorf("more than one schema version %v", version.Name)
+		}
+		names[version.Name] = true
+		if len(version.Header) == 0 {
+			return fmt.Errorf("schema version %v has no header", version.Name)
+		}
+
+		layout := headerLayout{version: version.Name, header: version.Header, names: make(map[string]int)}
+		if version.EffectiveFrom != "" {
+			from, err := time.ParseInLocation("2006-01-02", version.EffectiveFrom, time.Local)
+			if err != nil {
+				return fmt.Errorf("invalid effective date of schema version %v: %v", version.Name, err)
+			}
+			layout.from = from
+		}
+
+		// the version knows its columns by the names and aliases of the header columns
+		byCanonical := make(map[int]int)
+		for col, name := range version.Header {
+			canonical, ok := schema.headerNames[foldColumnName(name)]
+			if !ok {
+				return fmt.Errorf("column %v of schema version %v is not in the header", name, version.Name)
+			}
+			if _, ok := byCanonical[canonical]; ok {
+				return fmt.Errorf("schema version %v has column %v more than once", version.Name, schema.header[canonical])
+			}
+			byCanonical[canonical] = col
+			layout.canonical = append(layout.canonical, canonical)
+		}
+		for name, canonical := range schema.headerNames {
+			if col, ok := byCanonical[canonical]; ok {
+				layout.names[name] = col
+			}
+		}
+		compiled = append(compiled, layout)
+	}
+
+	sort.SliceStable(compiled, func(i, j int) bool {
+		return compiled[i].from.After(compiled[j].from)
+	})
+	schema.layouts = append(schema.layouts, compiled...)
+	return nil
+}
+
+// versioned reports whether the schema has versions
+func (schema *Schema) versioned() bool {
+	return len(schema.layouts) > 1
+}
+
+// mergesTime reports whether the column name is merged into a date column
+func (schema *Schema) mergesTime(name string) bool {
+	for _, rule := range schema.columns {
+		if rule.timeColumn == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply runs the transforms, drops the rows matching dropWhen and returns the rows of
+// the output columns, or of all columns without output columns. content starts with the header.
+func (schema *Schema) Apply(content [][]string, fields FileFields) ([][]string, error) {
+	if len(schema.transforms) > 0 || len(schema.dropWhen) > 0 {
+		var err error
+		if content, err = evaluate(schema.scope, schema.transforms, schema.dropWhen, content, fields); err != nil {
+			return nil, err
+		}
+	}
+	if len(schema.output) == 0 {
+		return content, nil
+	}
+	return project(schema.output, content, fields), nil
+}
+
+func compileDateColumn(rule *columnRule, column config.Column) error {
+	var err error
+	if rule.location, err = loadTimezone(column.Timezone); err != nil {
+		return err
+	}
+	rule.outputLocation = rule.location
+	if column.OutputTimezone != "" {
+		if rule.outputLocation, err = loadTimezone(column.OutputTimezone); err != nil {
+			return err
+		}
+	}
+
+	rule.layouts = column.Layouts
+	if len(rule.layouts) == 0 {
+		rule.layouts = defaultLayouts[column.Type]
+	}
+
+	if column.TimeColumn != "" {
+		if column.Type != ColumnDate {
+			return fmt.Errorf("timeColumn needs type date")
+		}
+		rule.timeColumn = column.TimeColumn
+	}
+
+	rule.layout = column.Layout
+	if rule.layout == "" {
+		rule.layout = defaultOutputLayouts[column.Type]
+		if rule.timeColumn != "" {
+			rule.layout = defaultOutputLayouts[ColumnDateTime]
+		}
+	}
+	return nil
+}
+
+// NewSchemas compiles the schema of every channel.
+func NewSchemas(cfg *config.Config) (map[string]*Schema, error) {
+	schemas := make(map[string]*Schema)
+	for channelName, channel := range cfg.Channels() {
+		schema, err := NewSchema(channelName, channel.Schema)
+		if err != nil {
+			return nil, err
+		}
+		schemas[channelName] = schema
+	}
+	return schemas, nil
+}
+
+// needsRaw reports whether Normalize uses the raw cell values
+func (schema *Schema) needsRaw() bool {
+	for _, rule := range schema.columns {
+		if rule.kind != ColumnText {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalize rewrites content in place and returns it. content starts with the header,
+// raw holds the unformatted cell values of the same rows. date1904 is the date system
+// of the workbook. Time columns merged into a date column are dropped.
+func (schema *Schema) Normalize(content [][]string, raw [][]string, date1904 bool) ([][]string, error) {
+	header := content[0]
+	dropped := make(map[int]bool)
+	for col, name := range header {
+		rule, ok := schema.columns[name]
+		// a merged time column is read by its date column
+		if !ok || rule.kind == ColumnText || schema.mergesTime(name) {
+			continue
+		}
+
+		timeCol := -1
+		clockLayouts := defaultLayouts[ColumnTime]
+		if rule.timeColumn != "" {
+			if timeCol = indexOf(header, rule.timeColumn); timeCol < 0 {
+				return nil, fmt.Errorf("time column %v of %v not found", rule.timeColumn, name)
+			}
+			dropped[timeCol] = true
+			if timeRule, ok := schema.columns[rule.timeColumn]; ok && timeRule.kind == ColumnTime {
+				clockLayouts = timeRule.layouts
+			}
+		}
+
+		for idx := 1; idx < len(content); idx++ {
+			row := content[idx]
+			if col >= len(row) {
+				continue
+			}
+
+			var normalized string
+			var err error
+			switch rule.kind {
+			case ColumnNumber:
+				normalized, err = rule.normalizeNumber(cellValue(content, raw, idx, col))
+			default:
+				var clock string
+				if timeCol >= 0 {
+					clock, _ = cellValue(content, raw, idx, timeCol)
+				}
+				value, _ := cellValue(content, raw, idx, col)
+				normalized, err = rule.normalizeTime(value, clock, clockLayouts, date1904)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("row %d column %v: %v", idx+1, name, err)
+			}
+			row[col] = normalized
+		}
+	}
+
+	if len(dropped) == 0 {
+		return content, nil
+	}
+	for idx, row := range content {
+		kept := make([]string, 0, len(row))
+		for col, value := range row {
+			if !dropped[col] {
+				kept = append(kept, value)
+			}
+		}
+		content[idx] = kept
+	}
+	return content, nil
+}
+
+// cellValue prefers the raw value of a cell over its formatted value, stored reports whether
+// the value is the one stored in a cell holding a number rather than text
+func cellValue(content [][]string, raw [][]string, idx int, col int) (value string, stored bool) {
+	if idx < len(raw) && col < len(raw[idx]) && raw[idx][col] != "" {
+		return raw[idx][col], true
+	}
+	if col < len(content[idx]) {
+		return content[idx][col], false
+	}
+	return "", false
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// normalizeTime parses value with the layouts of the column and the time of day clock, if any,
+// with clockLayouts
+func (rule columnRule) normalizeTime(value string, clock string, clockLayouts []string, date1904 bool) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+
+	t, err := parseTime(value, rule.layouts, rule.location, date1904)
+	if err != nil {
+		return "", err
+	}
+
+	if clock = strings.TrimSpace(clock); clock != "" {
+		parsed, err := parseTime(clock, clockLayouts, rule.location, date1904)
+		if err != nil {
+			return "", fmt.Errorf("time %v", err)
+		}
+		t = withTimeOf(t, parsed)
+	}
+
+	return t.In(rule.outputLocation).Format(rule.layout), nil
+}
+
+// normalizeNumber reads text with the input decimal separator of the column, the values stored
+// in number cells always have "."
+func (rule columnRule) normalizeNumber(value string, stored bool) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+
+	separator := rule.inputDecimalSeparator
+	if stored {
+		separator = "."
+	}
+	number, err := parseNumber(value, separator)
+	if err != nil {
+		return "", err
+	}
+
+	return formatNumber(number, rule.decimals, rule.decimalSeparator), nil
+}
+
+// formatNumber writes number without exponent and thousands separators.
+// Negative decimals keep the significant digits of the number.
+func formatNumber(number float64, decimals int, decimalSeparator string) string {
+	var formatted string
+	if decimals < 0 {
+		// Excel keeps 15 significant digits, anything beyond is binary noise
+		number, _ = strconv.ParseFloat(strconv.FormatFloat(number, 'g', 15, 64), 64)
+		formatted = strconv.FormatFloat(number, 'f', -1, 64)
+	} else {
+		formatted = strconv.FormatFloat(number, 'f', decimals, 64)
+	}
+	// -0.00 after rounding
+	if strings.Trim(formatted, "-0.") == "" {
+		formatted = strings.TrimPrefix(formatted, "-")
+	}
+
+	return strings.Replace(formatted, ".", decimalSeparator, 1)
+}
+
+var (
+	// thousands separated by spaces with an optional fraction
+	spaceGrouped = regexp.MustCompile(`^[-+]?\d{1,3}([ \x{00a0}]\d{3})+([.,]\d+)?$`)
+	// thousands separated by "," with an optional "." fraction
+	commaGrouped = regexp.MustCompile(`^[-+]?\d{1,3}(,\d{3})+(\.\d+)?$`)
+	// digits, or thousands separated by ".", with an optional "," fraction
+	dotGrouped = regexp.MustCompile(`^[-+]?(\d+|\d{1,3}(\.\d{3})+)(,\d+)?$`)
+)
+
+// parseNumber accepts raw cell values, scientific notation and text with thousands separated by
+// "," or spaces in groups of three. With the input decimal separator "," it accepts text with
+// thousands separated by "." or spaces in groups of three and a "," fraction instead. Anything
+// else, like 1,5, 1 5 or 12,50,000, is rejected rather than read another way.
+func parseNumber(value string, inputDecimalSeparator string) (float64, error) {
+	cleaned := value
+	if strings.ContainsAny(value, " \u00a0") {
+		if !spaceGrouped.MatchString(value) {
+			return 0, fmt.Errorf("%q is not a number", value)
+		}
+		cleaned = strings.NewReplacer(" ", "", "\u00a0", "").Replace(value)
+	}
+
+	switch {
+	case inputDecimalSeparator == ",":
+		if !dotGrouped.MatchString(cleaned) {
+			return 0, fmt.Errorf("%q is not a number with decimal separator \",\"", value)
+		}
+		cleaned = strings.Replace(strings.ReplaceAll(cleaned, ".", ""), ",", ".", 1)
+	case isFinite(cleaned):
+	case commaGrouped.MatchString(cleaned):
+		cleaned = strings.ReplaceAll(cleaned, ",", "")
+	default:
+		return 0, fmt.Errorf("%q is not a number", value)
+	}
+
+	number, err := strconv.ParseFloat(cleaned, 64)
+	if err != nil || math.IsInf(number, 0) || math.IsNaN(number) {
+		return 0, fmt.Errorf("%q is not a number", value)
+	}
+	return number, nil
+}
+
+// isFinite reports whether value is a finite number as strconv reads it
+func isFinite(value string) bool {
+	number, err := strconv.ParseFloat(value, 64)
+	return err == nil && !math.IsInf(number, 0) && !math.IsNaN(number)
+}
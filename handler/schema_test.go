@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"fmt"
+	"reconconverter/config"
+	"testing"
+)
+
+func TestParseNumber(t *testing.T) {
+	cases := []struct {
+		value     string
+		separator string
+		number    float64
+		invalid   bool
+	}{
+		{value: "1222250", number: 1222250},
+		{value: "1097.8000000000002", number: 1097.8000000000002},
+		{value: "1.5E+06", number: 1500000},
+		{value: "9,980", number: 9980},
+		{value: "-1,250,000.50", number: -1250000.5},
+		{value: "1 250 000", number: 1250000},
+		{value: "1\u00a0250.5", number: 1250.5},
+		{value: "1 5", invalid: true},
+		{value: "12 50 000", invalid: true},
+		{value: "1,5", invalid: true},
+		{value: "1.234,56", invalid: true},
+		{value: "12,50,000", invalid: true},
+		{value: "1,2345", invalid: true},
+		{value: "1,5", separator: ",", number: 1.5},
+		{value: "1.234,56", separator: ",", number: 1234.56},
+		// text, a number cell holding 1.234 is read with "."
+		{value: "1.234", separator: ",", number: 1234},
+		{value: "1.234", separator: ".", number: 1.234},
+		{value: "1 250,5", separator: ",", number: 1250.5},
+		{value: "1 5", separator: ",", invalid: true},
+		{value: "-250.000", separator: ",", number: -250000},
+		{value: "1097.8", separator: ",", invalid: true},
+		{value: "1,234.56", separator: ",", invalid: true},
+	}
+	for _, c := range cases {
+		number, err := parseNumber(c.value, c.separator)
+		switch {
+		case c.invalid && err == nil:
+			t.Errorf("%q with %q: got %v, want an error", c.value, c.separator, number)
+		case !c.invalid && err != nil:
+			t.Errorf("%q with %q: %v", c.value, c.separator, err)
+		case number != c.number:
+			t.Errorf("%q with %q: got %v, want %v", c.value, c.separator, number, c.number)
+		}
+	}
+}
+
+func TestNormalizeNumberStored(t *testing.T) {
+	rule := columnRule{kind: ColumnNumber, decimals: -1, decimalSeparator: ".", inputDecimalSeparator: ","}
+	cases := []struct {
+		value      string
+		stored     bool
+		normalized string
+	}{
+		{"1.234", false, "1234"},
+		{"1.234", true, "1.234"},
+		{"1097.8", true, "1097.8"},
+		{"1.5E+06", true, "1500000"},
+		{"1,5", false, "1.5"},
+	}
+	for _, c := range cases {
+		normalized, err := rule.normalizeNumber(c.value, c.stored)
+		if err != nil || normalized != c.normalized {
+			t.Errorf("%q stored %v: got %q, %v, want %q", c.value, c.stored, normalized, err, c.normalized)
+		}
+	}
+}
+
+func TestCompileOutput(t *testing.T) {
+	header := []string{"NO", "AMOUNT"}
+	currency := "IDR"
+	columns, err := compileOutput([]config.OutputColumn{
+		{Name: "AMOUNT"},
+		{Name: "NUMBER", From: "NO"},
+		{Name: "CURRENCY", Value: &currency},
+		{Name: "REMARKS", Value: new(string)},
+	}, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projected := project(columns, [][]string{header, {"1", "1250000"}}, FileFields{})
+	if got, want := fmt.Sprint(projected), "[[AMOUNT NUMBER CURRENCY REMARKS] [1250000 1 IDR ]]"; got != want {
+		t.Errorf("projected %v, want %v", got, want)
+	}
+
+	// a name alone must be a column of the file
+	if _, err := compileOutput([]config.OutputColumn{{Name: "FEE"}}, header); err == nil {
+		t.Error("compiled an output column missing from the file")
+	}
+	if _, err := compileOutput([]config.OutputColumn{{Name: "REFERENCE", Concat: []config.OutputColumn{{From: "NO"}, {}}}}, header); err == nil {
+		t.Error("compiled a concat part without a value")
+	}
+}
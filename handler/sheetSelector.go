@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"fmt"
+	"reconconverter/config"
+	"reconconverter/input"
+	"regexp"
+	"strings"
+)
+
+// SheetSelector picks the sheets of a workbook holding the transactions.
+type SheetSelector struct {
+	name       string
+	ignoreCase bool
+	pattern    *regexp.Regexp
+	index      int
+	header     bool
+	concat     bool
+}
+
+// NewSheetSelector compiles the sheet selection of a channel. An empty selection falls back to
+// the channel default.
+func NewSheetSelector(channelName string, cfg config.Sheet) (*SheetSelector, error) {
+	if cfg == (config.Sheet{}) {
+		cfg = channelSpecs[channelName].sheet
+	}
+
+	selectors := 0
+	for _, set := range []bool{cfg.Name != "", cfg.Pattern != "", cfg.Index != 0, cfg.Header} {
+		if set {
+			selectors++
+		}
+	}
+	if selectors != 1 {
+		return nil, fmt.Errorf("sheet of %v needs exactly one of name, pattern, index or header", channelName)
+	}
+	if cfg.Index < 0 {
+		return nil, fmt.Errorf("sheet index of %v must be 1 or more", channelName)
+	}
+	if cfg.IgnoreCase && cfg.Name == "" {
+		return nil, fmt.Errorf("sheet of %v can only ignore the case of a name", channelName)
+	}
+	if cfg.Concat && cfg.Index != 0 {
+		return nil, fmt.Errorf("sheet of %v can't concat a single sheet index", channelName)
+	}
+
+	selector := &SheetSelector{
+		name:       cfg.Name,
+		ignoreCase: cfg.IgnoreCase,
+		index:      cfg.Index,
+		header:     cfg.Header,
+		concat:     cfg.Concat,
+	}
+	if cfg.Pattern != "" {
+		re, err := regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sheet pattern of %v: %v", channelName, err)
+		}
+		selector.pattern = re
+	}
+	if selector.ignoreCase {
+		selector.name = foldSheetName(selector.name)
+	}
+	return selector, nil
+}
+
+// NewSheetSelectors compiles the sheet selection of every channel.
+func NewSheetSelectors(cfg *config.Config) (map[string]*SheetSelector, error) {
+	selectors := make(map[string]*SheetSelector)
+	for channelName, channel := range cfg.Channels() {
+		selector, err := NewSheetSelector(channelName, channel.Sheet)
+		if err != nil {
+			return nil, err
+		}
+		selectors[channelName] = selector
+	}
+	return selectors, nil
+}
+
+// Select returns the sheets of wb to read, in workbook order. hasHeader reports whether the rows
+// of a sheet have the header the channel expects.
+func (selector *SheetSelector) Select(wb input.Workbook, hasHeader func(rows [][]string) bool) ([]string, error) {
+	sheets := wb.Sheets()
+	if selector.index > 0 {
+		if selector.index > len(sheets) {
+			return nil, fmt.Errorf("sheet %d does not exist, the workbook has %d sheets", selector.index, len(sheets))
+		}
+		return []string{sheets[selector.index-1]}, nil
+	}
+
+	var selected []string
+	for _, sheet := range sheets {
+		ok, err := selector.matches(wb, sheet, hasHeader)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			selected = append(selected, sheet)
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no sheet %v, the workbook has %q", selector, sheets)
+	}
+	if len(selected) > 1 && !selector.concat {
+		return nil, fmt.Errorf("sheets %q are all %v, concat them or select one", selected, selector)
+	}
+	return selected, nil
+}
+
+func (selector *SheetSelector) matches(wb input.Workbook, sheet string, hasHeader func(rows [][]string) bool) (bool, error) {
+	switch {
+	case selector.header:
+		rows, err := wb.Rows(sheet)
+		if err != nil {
+			return false, err
+		}
+		return hasHeader(rows), nil
+	case selector.pattern != nil:
+		return selector.pattern.MatchString(sheet), nil
+	case selector.ignoreCase:
+		return foldSheetName(sheet) == selector.name, nil
+	}
+	return sheet == selector.name, nil
+}
+
+// String describes the sheets selected, for errors
+func (selector *SheetSelector) String() string {
+	switch {
+	case selector.index > 0:
+		return fmt.Sprintf("number %d", selector.index)
+	case selector.header:
+		return "with the expected header"
+	case selector.pattern != nil:
+		return fmt.Sprintf("matching %v", selector.pattern)
+	case selector.ignoreCase:
+		return fmt.Sprintf("named %q ignoring case and spaces", selector.name)
+	}
+	return fmt.Sprintf("named %q", selector.name)
+}
+
+func foldSheetName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
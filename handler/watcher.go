@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"fmt"
+	"reconconverter/config"
+	"reconconverter/transport"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// Watch starts a watcher for every channel with watch enabled on a local source.
+// The watched runs use the same file filter and ledger as the cron runs.
+func (handler *Handler) Watch() error {
+	for _, channelName := range channelNames {
+		channel := handler.Config.Channels()[channelName]
+		if !channel.Watch {
+			continue
+		}
+		if channel.SourceType != transport.TypeLocal {
+			return fmt.Errorf("watch of %v needs sourceType %v", channelName, transport.TypeLocal)
+		}
+
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		if err := watcher.Add(channel.SourcePath); err != nil {
+			watcher.Close()
+			return fmt.Errorf("failed to watch %v: %v", channel.SourcePath, err)
+		}
+
+		logrus.Infof("Watching %v for %v", channel.SourcePath, channelName)
+		go handler.watch(channelName, channel, watcher)
+	}
+	return nil
+}
+
+func (handler *Handler) watch(channelName string, channel config.Channel, watcher *fsnotify.Watcher) {
+	defer watcher.Close()
+
+	debounce := time.Duration(channel.DebounceSeconds) * time.Second
+	if debounce <= 0 {
+		debounce = 5 * time.Second
+	}
+	recheck := time.Duration(channel.StableSeconds) * time.Second
+	if recheck < debounce {
+		recheck = debounce
+	}
+
+	// the first run picks up what arrived while the service was down
+	timer := time.NewTimer(debounce)
+	defer timer.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			// files moved in show up as Create, Rename and Remove only mean a file left
+			if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) {
+				timer.Reset(debounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Errorf("Watcher of %v got error: %v", channelName, err)
+		case <-timer.C:
+			summary := NewRunSummary()
+			handler.processChannel(channelName, summary, false, nil)
+			summary.Finish()
+
+			// files still being written don't produce another event once they are complete
+			if handler.FileFilters[channelName].Unstable() {
+				timer.Reset(recheck)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package input
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"reconconverter/config"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
+)
+
+// the sheet of a text file
+const textSheet = "Sheet1"
+
+// delimiters recognized in the header line, the first one wins a tie
+var delimiters = []rune{';', ',', '\t', '|'}
+
+type csvOptions struct {
+	// zero when detected from the header line
+	comma    rune
+	encoding encoding.Encoding
+}
+
+func newCsvOptions(cfg config.Input) (csvOptions, error) {
+	var options csvOptions
+	if cfg.Delimiter != "" {
+		if cfg.Delimiter == `\t` {
+			cfg.Delimiter = "\t"
+		}
+		if utf8.RuneCountInString(cfg.Delimiter) != 1 || strings.ContainsAny(cfg.Delimiter, "\"\r\n") {
+			return options, fmt.Errorf("invalid csv delimiter %q", cfg.Delimiter)
+		}
+		options.comma, _ = utf8.DecodeRuneInString(cfg.Delimiter)
+	}
+
+	if cfg.Encoding != "" && !strings.EqualFold(cfg.Encoding, "utf-8") && !strings.EqualFold(cfg.Encoding, "utf8") {
+		enc, err := ianaindex.IANA.Encoding(cfg.Encoding)
+		if err != nil || enc == nil {
+			return options, fmt.Errorf("unknown encoding %q", cfg.Encoding)
+		}
+		options.encoding = enc
+	}
+	return options, nil
+}
+
+func openCsv(path string, cfg config.Input) (Workbook, error) {
+	options, err := newCsvOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if options.encoding != nil {
+		r = transform.NewReader(r, options.encoding.NewDecoder())
+	}
+	buffered := bufio.NewReader(r)
+	if bom, _, err := buffered.ReadRune(); err == nil && bom != '\ufeff' {
+		buffered.UnreadRune()
+	}
+
+	if options.comma == 0 {
+		options.comma = detectDelimiter(buffered)
+	}
+
+	reader := csv.NewReader(buffered)
+	reader.Comma = options.comma
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if !utf8Valid(rows) {
+		return nil, fmt.Errorf("file is not valid utf-8, set the input encoding")
+	}
+
+	return &table{
+		format: FormatCsv,
+		names:  []string{textSheet},
+		rows:   map[string][][]string{textSheet: rows},
+	}, nil
+}
+
+// detectDelimiter returns the delimiter found most often in the first line
+func detectDelimiter(r *bufio.Reader) rune {
+	// a header line longer than the buffer is cut, which still holds enough delimiters
+	line, _ := r.Peek(r.Size())
+	if idx := strings.IndexAny(string(line), "\r\n"); idx >= 0 {
+		line = line[:idx]
+	}
+
+	best, count := delimiters[0], 0
+	for _, delimiter := range delimiters {
+		if n := strings.Count(string(line), string(delimiter)); n > count {
+			best, count = delimiter, n
+		}
+	}
+	return best
+}
+
+func utf8Valid(rows [][]string) bool {
+	for _, row := range rows {
+		for _, cell := range row {
+			if !utf8.ValidString(cell) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,294 @@
+// Package input reads the rows of the files partners send, whichever spreadsheet or text
+// format they come in, so every format goes through the same validation and outputs.
+// The format is recognized from the content of the file, not its extension.
+package input
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reconconverter/config"
+
+	"github.com/richardlehane/mscfb"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	FormatXlsx = "xlsx"
+	FormatXls  = "xls"
+	FormatOds  = "ods"
+	FormatCsv  = "csv"
+)
+
+var (
+	zipMagic = []byte("PK\x03\x04")
+	// compound file binary, the container of legacy .xls workbooks
+	oleMagic = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+)
+
+const odsMimetype = "application/vnd.oasis.opendocument.spreadsheet"
+
+// ErrEncrypted is returned, wrapped with the reason, for encrypted files that can't be opened
+var ErrEncrypted = errors.New("workbook is encrypted")
+
+// Workbook is a file opened by Open. Text files have a single sheet.
+type Workbook interface {
+	Format() string
+	Sheets() []string
+	// Rows returns the cells of a sheet as displayed
+	Rows(sheet string) ([][]string, error)
+	// RawRows returns the values stored in the cells holding numbers, dates as Excel serial
+	// numbers. Cells holding text are empty, their value is the one Rows displays.
+	RawRows(sheet string) ([][]string, error)
+	Date1904() bool
+	Close() error
+}
+
+// Check validates the input settings of a channel
+func Check(cfg config.Input) error {
+	if _, err := newCsvOptions(cfg); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Open detects the format of the file at path and opens it. password opens encrypted xlsx
+// workbooks, it is ignored for other files.
+func Open(path string, cfg config.Input, password string) (Workbook, error) {
+	format, encrypted, err := detect(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatXlsx:
+		return openXlsx(path, encrypted, password)
+	case FormatXls:
+		return openXls(path)
+	case FormatOds:
+		return openOds(path)
+	}
+	return openCsv(path, cfg)
+}
+
+// Detect returns the format of the file at path
+func Detect(path string, cfg config.Input) (string, error) {
+	format, _, err := detect(path, cfg)
+	return format, err
+}
+
+// detect returns the format of the file at path and whether it is an encrypted xlsx workbook
+func detect(path string, cfg config.Input) (string, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer file.Close()
+
+	head := make([]byte, 8192)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", false, err
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, oleMagic):
+		// encrypted xlsx workbooks are stored in a compound file like xls workbooks
+		encrypted, err := isEncryptedXlsx(file)
+		if err != nil {
+			return "", false, err
+		}
+		if encrypted {
+			return FormatXlsx, true, nil
+		}
+		return FormatXls, false, nil
+	case bytes.HasPrefix(head, zipMagic):
+		info, err := file.Stat()
+		if err != nil {
+			return "", false, err
+		}
+		archive, err := zip.NewReader(file, info.Size())
+		if err != nil {
+			return "", false, err
+		}
+		if isOds(archive) {
+			return FormatOds, false, nil
+		}
+		return FormatXlsx, false, nil
+	}
+
+	// text in a multi-byte encoding such as utf-16 has zero bytes
+	options, err := newCsvOptions(cfg)
+	if err != nil {
+		return "", false, err
+	}
+	if options.encoding == nil && isBinary(head) {
+		return "", false, fmt.Errorf("unrecognized file format")
+	}
+	return FormatCsv, false, nil
+}
+
+// isBinary reports whether head has control characters no text file has
+func isBinary(head []byte) bool {
+	for _, b := range head {
+		switch {
+		case b == '\t' || b == '\n' || b == '\r' || b == '\f':
+		// the end of file mark of old DOS files
+		case b == 0x1A:
+		case b < 0x20 || b == 0x7F:
+			return true
+		}
+	}
+	return false
+}
+
+func isOds(archive *zip.Reader) bool {
+	for _, file := range archive.File {
+		if file.Name != "mimetype" {
+			continue
+		}
+		r, err := file.Open()
+		if err != nil {
+			return false
+		}
+		defer r.Close()
+		mimetype, err := io.ReadAll(io.LimitReader(r, 256))
+		return err == nil && string(bytes.TrimSpace(mimetype)) == odsMimetype
+	}
+	return false
+}
+
+func isEncryptedXlsx(file io.ReaderAt) (bool, error) {
+	doc, err := mscfb.New(file)
+	if err != nil {
+		return false, err
+	}
+	for entry, err := doc.Next(); err == nil; entry, err = doc.Next() {
+		if entry.Name == "EncryptedPackage" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func openXlsx(path string, encrypted bool, password string) (Workbook, error) {
+	if !encrypted {
+		f, err := excelize.OpenFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return &spreadsheet{File: f, format: FormatXlsx}, nil
+	}
+
+	if password == "" {
+		return nil, fmt.Errorf("%w and no workbook password is configured", ErrEncrypted)
+	}
+	f, err := excelize.OpenFile(path, excelize.Options{Password: password})
+	if err != nil {
+		// a wrong password decrypts to bytes that are no xlsx
+		return nil, fmt.Errorf("%w: %v", ErrEncrypted, err)
+	}
+	return &spreadsheet{File: f, format: FormatXlsx}, nil
+}
+
+// spreadsheet reads the workbooks excelize opens, xlsx files and converted xls files
+type spreadsheet struct {
+	*excelize.File
+	format string
+}
+
+func (s *spreadsheet) Format() string {
+	return s.format
+}
+
+func (s *spreadsheet) Sheets() []string {
+	return s.GetSheetList()
+}
+
+func (s *spreadsheet) Rows(sheet string) ([][]string, error) {
+	return s.GetRows(sheet)
+}
+
+func (s *spreadsheet) RawRows(sheet string) ([][]string, error) {
+	rows, err := s.GetRows(sheet, excelize.Options{RawCellValue: true})
+	if err != nil {
+		return nil, err
+	}
+	for i, row := range rows {
+		for j, value := range row {
+			if value == "" {
+				continue
+			}
+			cell, err := excelize.CoordinatesToCellName(j+1, i+1)
+			if err != nil {
+				return nil, err
+			}
+			cellType, err := s.GetCellType(sheet, cell)
+			if err != nil {
+				return nil, err
+			}
+			if isText(cellType) {
+				row[j] = ""
+			}
+		}
+	}
+	return rows, nil
+}
+
+// isText reports whether a cell of type cellType holds text, formulas hold the text they result in
+func isText(cellType excelize.CellType) bool {
+	switch cellType {
+	case excelize.CellTypeSharedString, excelize.CellTypeInlineString, excelize.CellTypeFormula, excelize.CellTypeError:
+		return true
+	}
+	return false
+}
+
+func (s *spreadsheet) Date1904() bool {
+	props, err := s.GetWorkbookProps()
+	return err == nil && props.Date1904 != nil && *props.Date1904
+}
+
+// table is a workbook read into memory, the sheets of an ods file or the rows of a text file
+type table struct {
+	format string
+	names  []string
+	rows   map[string][][]string
+	raw    map[string][][]string
+}
+
+func (t *table) Format() string {
+	return t.format
+}
+
+func (t *table) Sheets() []string {
+	return t.names
+}
+
+func (t *table) Rows(sheet string) ([][]string, error) {
+	rows, ok := t.rows[sheet]
+	if !ok {
+		return nil, fmt.Errorf("sheet %v does not exist", sheet)
+	}
+	return rows, nil
+}
+
+func (t *table) RawRows(sheet string) ([][]string, error) {
+	if _, ok := t.rows[sheet]; !ok {
+		return nil, fmt.Errorf("sheet %v does not exist", sheet)
+	}
+	// the cells of text files are all text
+	return t.raw[sheet], nil
+}
+
+func (t *table) Date1904() bool {
+	return false
+}
+
+func (t *table) Close() error {
+	return nil
+}
@@ -0,0 +1,80 @@
+package input
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reconconverter/config"
+	"strings"
+	"testing"
+)
+
+func writeInput(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "settlement.xlsx")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func zipped(t *testing.T, name string, data string) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	w := zip.NewWriter(&buffer)
+	out, err := w.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write([]byte(data))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		cfg    config.Input
+		format string
+	}{
+		{"csv", []byte("NO;AMOUNT\r\n1;1.250.000\r\n"), config.Input{}, FormatCsv},
+		{"csv with the end of file mark", []byte("NO;AMOUNT\r\n1;100\r\n\x1a"), config.Input{}, FormatCsv},
+		{"utf-16 csv", []byte("N\x00O\x00;\x00A\x00\n\x00"), config.Input{Encoding: "utf-16le"}, FormatCsv},
+		{"ods", zipped(t, "mimetype", odsMimetype), config.Input{}, FormatOds},
+		{"xlsx", zipped(t, "[Content_Types].xml", "<Types/>"), config.Input{}, FormatXlsx},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			format, err := Detect(writeInput(t, test.data), test.cfg)
+			if err != nil || format != test.format {
+				t.Errorf("detected %v, %v, want %v", format, err, test.format)
+			}
+		})
+	}
+}
+
+func TestDetectBinary(t *testing.T) {
+	tests := map[string][]byte{
+		"pdf":            []byte("%PDF-1.4\n\x00\x01\x02\x03binary"),
+		"control bytes":  []byte("\x01\x02\x03\x04\x05\x06\x07\x08\x0e\x0f"),
+		"escape":         []byte("NO;AMOUNT\n\x1b[31m1;100\n"),
+		"utf-16 unset":   []byte("N\x00O\x00;\x00A\x00\n\x00"),
+		"no zip archive": []byte("PK\x03\x04 not a zip archive"),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if format, err := Detect(writeInput(t, data), config.Input{}); err == nil {
+				t.Errorf("detected %v", format)
+			}
+		})
+	}
+
+	// text that is not utf-8 is rejected once read
+	if _, err := Open(writeInput(t, []byte("NO;NAMA\n1;Caf\xe9\n")), config.Input{}, ""); err == nil || !strings.Contains(err.Error(), "utf-8") {
+		t.Errorf("latin-1 text without encoding: %v", err)
+	}
+}
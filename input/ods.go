@@ -0,0 +1,362 @@
+package input
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	odsTable  = "urn:oasis:names:tc:opendocument:xmlns:table:1.0"
+	odsOffice = "urn:oasis:names:tc:opendocument:xmlns:office:1.0"
+	odsText   = "urn:oasis:names:tc:opendocument:xmlns:text:1.0"
+)
+
+// the size of an Excel sheet. Spreadsheet applications repeat empty rows and cells up to
+// the end of the sheet, so only the repeats before content are materialized.
+const (
+	maxRows    = 1048576
+	maxColumns = 16384
+	// the cells of a workbook read into memory, a few repeated rows of a small file must not
+	// fill the memory with copies of their cells
+	maxCells = 10000000
+)
+
+// day 0 of the Excel serial dates
+var excelEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+var odsDuration = regexp.MustCompile(`^(-)?P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:([\d.]+)S)?)?$`)
+
+func openOds(path string) (Workbook, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	encrypted, err := isEncryptedOds(archive)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		return nil, fmt.Errorf("%w: encrypted ods files are not supported", ErrEncrypted)
+	}
+
+	for _, file := range archive.File {
+		if file.Name != "content.xml" {
+			continue
+		}
+		r, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readOds(r)
+	}
+	return nil, fmt.Errorf("ods file has no content.xml")
+}
+
+// isEncryptedOds reports whether the manifest lists encryption data for the files of the package
+func isEncryptedOds(archive *zip.ReadCloser) (bool, error) {
+	for _, file := range archive.File {
+		if file.Name != "META-INF/manifest.xml" {
+			continue
+		}
+		r, err := file.Open()
+		if err != nil {
+			return false, err
+		}
+		defer r.Close()
+		manifest, err := io.ReadAll(r)
+		if err != nil {
+			return false, err
+		}
+		return bytes.Contains(manifest, []byte("encryption-data")), nil
+	}
+	return false, nil
+}
+
+// odsSheet collects the rows of a table:table
+type odsSheet struct {
+	rows [][]string
+	raw  [][]string
+	// empty rows not added yet, they are dropped at the end of the sheet
+	pendingRows int
+	// the cells of the workbook added so far
+	cells *int
+}
+
+// odsRow collects the cells of a table:table-row
+type odsRow struct {
+	cells []string
+	raw   []string
+	// empty cells not added yet, they are dropped at the end of the row
+	pendingCells int
+}
+
+func readOds(r io.Reader) (Workbook, error) {
+	book := &table{format: FormatOds, rows: make(map[string][][]string), raw: make(map[string][][]string)}
+	decoder := xml.NewDecoder(r)
+
+	var name string
+	var sheet *odsSheet
+	cells := 0
+	var row *odsRow
+	rowRepeat := 1
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			if element.Name.Space != odsTable {
+				continue
+			}
+			switch element.Name.Local {
+			case "table":
+				name, sheet = attr(element, odsTable, "name"), &odsSheet{cells: &cells}
+			case "table-row":
+				if sheet == nil {
+					continue
+				}
+				if rowRepeat, err = repeat(element, odsTable, "number-rows-repeated"); err != nil {
+					return nil, err
+				}
+				row = &odsRow{}
+			case "table-cell", "covered-table-cell":
+				if row == nil {
+					continue
+				}
+				if err := row.add(decoder, element); err != nil {
+					return nil, fmt.Errorf("sheet %v row %d: %v", name, len(sheet.rows)+sheet.pendingRows+1, err)
+				}
+			}
+
+		case xml.EndElement:
+			if element.Name.Space != odsTable {
+				continue
+			}
+			switch element.Name.Local {
+			case "table-row":
+				if row == nil {
+					continue
+				}
+				if err := sheet.add(row, rowRepeat); err != nil {
+					return nil, fmt.Errorf("sheet %v: %v", name, err)
+				}
+				row = nil
+			case "table":
+				if sheet == nil {
+					continue
+				}
+				if _, ok := book.rows[name]; ok {
+					return nil, fmt.Errorf("sheet %v appears twice", name)
+				}
+				book.names = append(book.names, name)
+				book.rows[name], book.raw[name] = sheet.rows, sheet.raw
+				sheet = nil
+			}
+		}
+	}
+
+	if len(book.names) == 0 {
+		return nil, fmt.Errorf("ods file has no sheets")
+	}
+	return book, nil
+}
+
+func (sheet *odsSheet) add(row *odsRow, times int) error {
+	if len(row.cells) == 0 {
+		sheet.pendingRows += times
+		return nil
+	}
+	if len(sheet.rows)+sheet.pendingRows+times > maxRows {
+		return fmt.Errorf("more than %d rows", maxRows)
+	}
+	if *sheet.cells += times * len(row.cells); *sheet.cells > maxCells {
+		return fmt.Errorf("more than %d cells", maxCells)
+	}
+
+	for ; sheet.pendingRows > 0; sheet.pendingRows-- {
+		sheet.rows = append(sheet.rows, nil)
+		sheet.raw = append(sheet.raw, nil)
+	}
+	for i := 0; i < times; i++ {
+		sheet.rows = append(sheet.rows, append([]string{}, row.cells...))
+		sheet.raw = append(sheet.raw, append([]string{}, row.raw...))
+	}
+	return nil
+}
+
+// add reads a cell up to its end element. Covered cells, the cells hidden by a merge, are empty.
+func (row *odsRow) add(decoder *xml.Decoder, start xml.StartElement) error {
+	times, err := repeat(start, odsTable, "number-columns-repeated")
+	if err != nil {
+		return err
+	}
+
+	text, err := cellText(decoder)
+	if err != nil {
+		return err
+	}
+	var value string
+	if start.Name.Local == "covered-table-cell" {
+		text = ""
+	} else if value, err = rawValue(start, text); err != nil {
+		return fmt.Errorf("column %d: %v", len(row.cells)+row.pendingCells+1, err)
+	}
+
+	if text == "" && value == "" {
+		row.pendingCells += times
+		return nil
+	}
+	if len(row.cells)+row.pendingCells+times > maxColumns {
+		return fmt.Errorf("more than %d columns", maxColumns)
+	}
+	for ; row.pendingCells > 0; row.pendingCells-- {
+		row.cells = append(row.cells, "")
+		row.raw = append(row.raw, "")
+	}
+	for i := 0; i < times; i++ {
+		row.cells = append(row.cells, text)
+		row.raw = append(row.raw, value)
+	}
+	return nil
+}
+
+// cellText returns the paragraphs of a cell as displayed, one per line
+func cellText(decoder *xml.Decoder) (string, error) {
+	var paragraphs []string
+	var text strings.Builder
+	inParagraph := false
+	for depth := 1; depth > 0; {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch {
+			case element.Name.Space == odsOffice && element.Name.Local == "annotation":
+				// comments are not part of the value
+				if err := decoder.Skip(); err != nil {
+					return "", err
+				}
+				continue
+			case element.Name.Space != odsText:
+			case element.Name.Local == "p" || element.Name.Local == "h":
+				inParagraph = true
+				text.Reset()
+			case element.Name.Local == "s":
+				spaces, err := repeat(element, odsText, "c")
+				if err != nil {
+					return "", err
+				}
+				text.WriteString(strings.Repeat(" ", spaces))
+			case element.Name.Local == "tab":
+				text.WriteString("\t")
+			case element.Name.Local == "line-break":
+				text.WriteString("\n")
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+			if element.Name.Space == odsText && (element.Name.Local == "p" || element.Name.Local == "h") {
+				paragraphs = append(paragraphs, text.String())
+				inParagraph = false
+			}
+		case xml.CharData:
+			if inParagraph {
+				text.Write(element)
+			}
+		}
+	}
+	return strings.Join(paragraphs, "\n"), nil
+}
+
+// rawValue returns the value stored in a cell like excelize does for xlsx: numbers as they are,
+// dates and times as Excel serial numbers and booleans as 1 or 0. Text cells have no raw value.
+func rawValue(cell xml.StartElement, text string) (string, error) {
+	switch attr(cell, odsOffice, "value-type") {
+	case "float", "percentage", "currency":
+		return attr(cell, odsOffice, "value"), nil
+	case "date":
+		value := attr(cell, odsOffice, "date-value")
+		for _, layout := range []string{"2006-01-02T15:04:05.999999999", "2006-01-02"} {
+			if t, err := time.Parse(layout, value); err == nil {
+				return strconv.FormatFloat(t.Sub(excelEpoch).Hours()/24, 'f', -1, 64), nil
+			}
+		}
+		return "", fmt.Errorf("invalid date %q", value)
+	case "time":
+		value := attr(cell, odsOffice, "time-value")
+		days, err := parseDuration(value)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(days, 'f', -1, 64), nil
+	case "boolean":
+		if attr(cell, odsOffice, "boolean-value") == "true" {
+			return "1", nil
+		}
+		return "0", nil
+	}
+	return "", nil
+}
+
+// parseDuration returns an ISO 8601 duration such as PT10H15M00S in days
+func parseDuration(value string) (float64, error) {
+	match := odsDuration.FindStringSubmatch(value)
+	if match == nil {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	var seconds float64
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		if match[i+2] == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(match[i+2], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q", value)
+		}
+		seconds += n * unit
+	}
+	if match[1] != "" {
+		seconds = -seconds
+	}
+	return seconds / 86400, nil
+}
+
+func attr(element xml.StartElement, space string, local string) string {
+	for _, a := range element.Attr {
+		if a.Name.Space == space && a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// repeat returns a repeat count attribute, 1 when missing
+func repeat(element xml.StartElement, space string, local string) (int, error) {
+	value := attr(element, space, local)
+	if value == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %v %q", local, value)
+	}
+	return n, nil
+}
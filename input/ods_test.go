@@ -0,0 +1,104 @@
+package input
+
+import (
+	"strings"
+	"testing"
+)
+
+// odsContent is the content.xml of a workbook with a single sheet of the rows
+func odsContent(rows ...string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">
+<office:body><office:spreadsheet><table:table table:name="Ledger">` + strings.Join(rows, "") + `</table:table></office:spreadsheet></office:body></office:document-content>`
+}
+
+// textCell is a cell holding text
+func textCell(text string) string {
+	return `<table:table-cell office:value-type="string"><text:p>` + text + `</text:p></table:table-cell>`
+}
+
+func TestReadOds(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		rows    [][]string
+		raw     [][]string
+	}{
+		{
+			name: "values",
+			content: odsContent(`<table:table-row>` + textCell("TOKO") +
+				`<table:table-cell office:value-type="float" office:value="1250000.5"><text:p>1.250.000,50</text:p></table:table-cell>` +
+				`<table:table-cell office:value-type="date" office:date-value="2024-03-27"><text:p>27/03/2024</text:p></table:table-cell>` +
+				`<table:table-cell office:value-type="time" office:time-value="PT12H00M00S"><text:p>12:00</text:p></table:table-cell>` +
+				`<table:table-cell office:value-type="boolean" office:boolean-value="true"><text:p>TRUE</text:p></table:table-cell>` +
+				`</table:table-row>`),
+			rows: [][]string{{"TOKO", "1.250.000,50", "27/03/2024", "12:00", "TRUE"}},
+			raw:  [][]string{{"", "1250000.5", "45378", "0.5", "1"}},
+		},
+		{
+			name: "merged cells",
+			content: odsContent(`<table:table-row><table:table-cell table:number-columns-spanned="2" office:value-type="string"><text:p>TOKO</text:p></table:table-cell>` +
+				`<table:covered-table-cell office:value-type="string"><text:p>TOKO</text:p></table:covered-table-cell>` + textCell("X") + `</table:table-row>`),
+			rows: [][]string{{"TOKO", "", "X"}},
+		},
+		{
+			// applications repeat empty rows and cells to the end of the sheet
+			name: "repeats",
+			content: odsContent(
+				`<table:table-row table:number-rows-repeated="2">`+textCell("A")+`<table:table-cell table:number-columns-repeated="2"/>`+textCell("B")+`<table:table-cell table:number-columns-repeated="16000"/></table:table-row>`,
+				`<table:table-row table:number-rows-repeated="1"><table:table-cell/></table:table-row>`,
+				`<table:table-row>`+textCell("C")+`</table:table-row>`,
+				`<table:table-row table:number-rows-repeated="1048000"><table:table-cell table:number-columns-repeated="16384"/></table:table-row>`),
+			rows: [][]string{{"A", "", "", "B"}, {"A", "", "", "B"}, nil, {"C"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wb, err := readOds(strings.NewReader(test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, err := wb.Rows("Ledger")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := join(rows), join(test.rows); got != want {
+				t.Errorf("rows %q, want %q", got, want)
+			}
+			if test.raw == nil {
+				return
+			}
+			raw, err := wb.RawRows("Ledger")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := join(raw), join(test.raw); got != want {
+				t.Errorf("raw rows %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestReadOdsRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"rows", odsContent(`<table:table-row table:number-rows-repeated="1048577">` + textCell("A") + `</table:table-row>`), "more than 1048576 rows"},
+		{"columns", odsContent(`<table:table-row><table:table-cell table:number-columns-repeated="16385" office:value-type="string"><text:p>A</text:p></table:table-cell></table:table-row>`), "more than 16384 columns"},
+		// a few bytes repeating a full row a million times
+		{"cells", odsContent(`<table:table-row table:number-rows-repeated="1000000"><table:table-cell table:number-columns-repeated="100" office:value-type="string"><text:p>A</text:p></table:table-cell></table:table-row>`), "more than 10000000 cells"},
+		{"repeat", odsContent(`<table:table-row table:number-rows-repeated="-1">` + textCell("A") + `</table:table-row>`), "invalid number-rows-repeated"},
+		{"date", odsContent(`<table:table-row><table:table-cell office:value-type="date" office:date-value="27/03/2024"/></table:table-row>`), "invalid date"},
+		{"sheets", `<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0"/>`, "no sheets"},
+		{"xml", odsContent(`<table:table-row>`), "XML syntax error"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := readOds(strings.NewReader(test.content)); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got %v, want %q", err, test.err)
+			}
+		})
+	}
+}
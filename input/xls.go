@@ -0,0 +1,548 @@
+package input
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"unicode/utf16"
+
+	"github.com/richardlehane/mscfb"
+	"github.com/xuri/excelize/v2"
+)
+
+// records of the BIFF8 workbook stream read by the converter
+const (
+	recordBOF        = 0x0809
+	recordEOF        = 0x000A
+	recordFilePass   = 0x002F
+	recordDateMode   = 0x0022
+	recordFormat     = 0x041E
+	recordXF         = 0x00E0
+	recordBoundSheet = 0x0085
+	recordSST        = 0x00FC
+	recordContinue   = 0x003C
+	recordLabelSST   = 0x00FD
+	recordLabel      = 0x0204
+	recordNumber     = 0x0203
+	recordRK         = 0x027E
+	recordMulRK      = 0x00BD
+	recordFormula    = 0x0006
+	recordString     = 0x0207
+	recordBoolErr    = 0x0205
+)
+
+const biff8 = 0x0600
+
+// the columns of a BIFF8 sheet
+const xlsMaxColumns = 256
+
+// BIFF error codes as Excel displays them
+var xlsErrors = map[byte]string{
+	0x00: "#NULL!",
+	0x07: "#DIV/0!",
+	0x0F: "#VALUE!",
+	0x17: "#REF!",
+	0x1D: "#NAME?",
+	0x24: "#NUM!",
+	0x2A: "#N/A",
+}
+
+// openXls reads a legacy Excel 97-2003 workbook into an in memory xlsx workbook, so its cells
+// are displayed with the same number formats as xlsx files
+func openXls(path string) (Workbook, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	doc, err := mscfb.New(file)
+	if err != nil {
+		return nil, err
+	}
+	var stream []byte
+	for entry, err := doc.Next(); err == nil; entry, err = doc.Next() {
+		if entry.Name == "Workbook" || entry.Name == "Book" {
+			if stream, err = io.ReadAll(entry); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if stream == nil {
+		return nil, fmt.Errorf("xls file has no workbook stream")
+	}
+
+	book, err := parseXls(stream)
+	if err != nil {
+		return nil, err
+	}
+	f, err := book.xlsx()
+	if err != nil {
+		return nil, err
+	}
+	return &spreadsheet{File: f, format: FormatXls}, nil
+}
+
+type xlsRecord struct {
+	kind uint16
+	data []byte
+	// offset of the next record
+	next int
+}
+
+func readRecord(stream []byte, offset int) (xlsRecord, error) {
+	if offset+4 > len(stream) {
+		return xlsRecord{}, fmt.Errorf("xls record at %d is truncated", offset)
+	}
+	kind := binary.LittleEndian.Uint16(stream[offset:])
+	size := int(binary.LittleEndian.Uint16(stream[offset+2:]))
+	if offset+4+size > len(stream) {
+		return xlsRecord{}, fmt.Errorf("xls record %#04x at %d is truncated", kind, offset)
+	}
+	return xlsRecord{kind: kind, data: stream[offset+4 : offset+4+size], next: offset + 4 + size}, nil
+}
+
+type xlsSheet struct {
+	name   string
+	offset int
+	cells  map[[2]int]xlsCell
+}
+
+type xlsCell struct {
+	value interface{}
+	xf    uint16
+}
+
+type xlsBook struct {
+	date1904 bool
+	// number format of every cell format
+	xfs     []uint16
+	formats map[uint16]string
+	strings []string
+	sheets  []*xlsSheet
+}
+
+func parseXls(stream []byte) (*xlsBook, error) {
+	book := &xlsBook{formats: make(map[uint16]string)}
+
+	var sst [][]byte
+	for offset := 0; offset < len(stream); {
+		record, err := readRecord(stream, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = record.next
+
+		if record.kind != recordContinue && sst != nil {
+			if book.strings, err = readSST(sst); err != nil {
+				return nil, err
+			}
+			sst = nil
+		}
+
+		switch record.kind {
+		case recordBOF:
+			if len(record.data) < 2 || binary.LittleEndian.Uint16(record.data) != biff8 {
+				return nil, fmt.Errorf("only Excel 97 and later xls files are supported")
+			}
+		case recordFilePass:
+			return nil, fmt.Errorf("%w: encrypted xls workbooks are not supported", ErrEncrypted)
+		case recordDateMode:
+			book.date1904 = len(record.data) >= 2 && binary.LittleEndian.Uint16(record.data) == 1
+		case recordFormat:
+			if len(record.data) < 2 {
+				return nil, fmt.Errorf("invalid format record")
+			}
+			code, _, err := readUnicodeString(record.data[2:], 2)
+			if err != nil {
+				return nil, err
+			}
+			book.formats[binary.LittleEndian.Uint16(record.data)] = code
+		case recordXF:
+			if len(record.data) < 4 {
+				return nil, fmt.Errorf("invalid xf record")
+			}
+			book.xfs = append(book.xfs, binary.LittleEndian.Uint16(record.data[2:]))
+		case recordBoundSheet:
+			if len(record.data) < 6 {
+				return nil, fmt.Errorf("invalid sheet record")
+			}
+			// charts and macro sheets have no cells
+			if record.data[5] != 0 {
+				continue
+			}
+			name, _, err := readUnicodeString(record.data[6:], 1)
+			if err != nil {
+				return nil, err
+			}
+			book.sheets = append(book.sheets, &xlsSheet{name: name, offset: int(binary.LittleEndian.Uint32(record.data)), cells: make(map[[2]int]xlsCell)})
+		case recordSST:
+			if len(record.data) < 8 {
+				return nil, fmt.Errorf("invalid shared strings record")
+			}
+			sst = [][]byte{record.data[8:]}
+		case recordContinue:
+			if sst != nil {
+				sst = append(sst, record.data)
+			}
+		}
+		if record.kind == recordEOF {
+			break
+		}
+	}
+
+	for _, sheet := range book.sheets {
+		if err := book.readSheet(stream, sheet); err != nil {
+			return nil, fmt.Errorf("sheet %v: %v", sheet.name, err)
+		}
+	}
+	return book, nil
+}
+
+func (book *xlsBook) readSheet(stream []byte, sheet *xlsSheet) error {
+	// the formula waiting for the STRING record holding its text result
+	var formula *[2]int
+	for offset := sheet.offset; offset < len(stream); {
+		record, err := readRecord(stream, offset)
+		if err != nil {
+			return err
+		}
+		offset = record.next
+		if record.kind == recordEOF {
+			return nil
+		}
+
+		data := record.data
+		if record.kind == recordString {
+			if formula != nil {
+				text, _, err := readUnicodeString(data, 2)
+				if err != nil {
+					return err
+				}
+				sheet.cells[*formula] = xlsCell{value: text, xf: sheet.cells[*formula].xf}
+				formula = nil
+			}
+			continue
+		}
+
+		switch record.kind {
+		case recordLabelSST, recordLabel, recordNumber, recordRK, recordMulRK, recordFormula, recordBoolErr:
+		default:
+			continue
+		}
+		if len(data) < 6 {
+			return fmt.Errorf("invalid cell record %#04x", record.kind)
+		}
+		row := int(binary.LittleEndian.Uint16(data))
+		col := int(binary.LittleEndian.Uint16(data[2:]))
+		xf := binary.LittleEndian.Uint16(data[4:])
+		position := [2]int{row, col}
+		if col >= xlsMaxColumns || (record.kind == recordMulRK && col+(len(data)-6)/6 > xlsMaxColumns) {
+			return fmt.Errorf("cell in column %d, a sheet has %d columns", col+1, xlsMaxColumns)
+		}
+
+		switch record.kind {
+		case recordLabelSST:
+			if len(data) < 10 {
+				return fmt.Errorf("invalid cell record %#04x", record.kind)
+			}
+			idx := int(binary.LittleEndian.Uint32(data[6:]))
+			if idx >= len(book.strings) {
+				return fmt.Errorf("shared string %d does not exist", idx)
+			}
+			sheet.cells[position] = xlsCell{value: book.strings[idx], xf: xf}
+		case recordLabel:
+			text, _, err := readUnicodeString(data[6:], 2)
+			if err != nil {
+				return err
+			}
+			sheet.cells[position] = xlsCell{value: text, xf: xf}
+		case recordNumber:
+			if len(data) < 14 {
+				return fmt.Errorf("invalid cell record %#04x", record.kind)
+			}
+			sheet.cells[position] = xlsCell{value: math.Float64frombits(binary.LittleEndian.Uint64(data[6:])), xf: xf}
+		case recordRK:
+			if len(data) < 10 {
+				return fmt.Errorf("invalid cell record %#04x", record.kind)
+			}
+			sheet.cells[position] = xlsCell{value: rkNumber(binary.LittleEndian.Uint32(data[6:])), xf: xf}
+		case recordMulRK:
+			// columns from col, each with its xf and rk, then the last column
+			for i := 4; i+6 <= len(data)-2; i += 6 {
+				sheet.cells[[2]int{row, col}] = xlsCell{
+					value: rkNumber(binary.LittleEndian.Uint32(data[i+2:])),
+					xf:    binary.LittleEndian.Uint16(data[i:]),
+				}
+				col++
+			}
+		case recordFormula:
+			if len(data) < 14 {
+				return fmt.Errorf("invalid cell record %#04x", record.kind)
+			}
+			result := data[6:14]
+			if result[6] != 0xFF || result[7] != 0xFF {
+				sheet.cells[position] = xlsCell{value: math.Float64frombits(binary.LittleEndian.Uint64(result)), xf: xf}
+				continue
+			}
+			switch result[0] {
+			case 0:
+				sheet.cells[position] = xlsCell{value: "", xf: xf}
+				formula = &position
+			case 1:
+				sheet.cells[position] = xlsCell{value: result[2] != 0, xf: xf}
+			case 2:
+				sheet.cells[position] = xlsCell{value: xlsErrors[result[2]], xf: xf}
+			}
+		case recordBoolErr:
+			if len(data) < 8 {
+				return fmt.Errorf("invalid cell record %#04x", record.kind)
+			}
+			if data[7] == 1 {
+				sheet.cells[position] = xlsCell{value: xlsErrors[data[6]], xf: xf}
+			} else {
+				sheet.cells[position] = xlsCell{value: data[6] != 0, xf: xf}
+			}
+		}
+	}
+	return fmt.Errorf("sheet has no end")
+}
+
+// rkNumber decodes the compressed number of RK records
+func rkNumber(rk uint32) float64 {
+	var number float64
+	if rk&0x02 != 0 {
+		number = float64(int32(rk) >> 2)
+	} else {
+		number = math.Float64frombits(uint64(rk&0xFFFFFFFC) << 32)
+	}
+	if rk&0x01 != 0 {
+		number /= 100
+	}
+	return number
+}
+
+// readUnicodeString reads a string whose length takes lengthSize bytes and returns it with the
+// number of bytes read. Rich text and phonetic runs are skipped.
+func readUnicodeString(data []byte, lengthSize int) (string, int, error) {
+	reader := &continuedReader{segments: [][]byte{data}}
+	text, err := reader.unicodeString(lengthSize)
+	return text, reader.pos, err
+}
+
+// readSST reads the shared strings, which continue over CONTINUE records
+func readSST(segments [][]byte) ([]string, error) {
+	reader := &continuedReader{segments: segments}
+	var strings []string
+	for !reader.done() {
+		text, err := reader.unicodeString(2)
+		if err != nil {
+			return nil, fmt.Errorf("shared string %d: %v", len(strings), err)
+		}
+		strings = append(strings, text)
+	}
+	return strings, nil
+}
+
+// continuedReader reads a record continued by CONTINUE records. Characters of a string split
+// over records start with a new flags byte telling whether they are compressed.
+type continuedReader struct {
+	segments [][]byte
+	segment  int
+	pos      int
+}
+
+var errTruncated = fmt.Errorf("string is truncated")
+
+func (r *continuedReader) done() bool {
+	for r.segment < len(r.segments) && r.pos >= len(r.segments[r.segment]) {
+		r.segment++
+		r.pos = 0
+	}
+	return r.segment >= len(r.segments)
+}
+
+func (r *continuedReader) bytes(n int) ([]byte, error) {
+	var read []byte
+	for n > 0 {
+		if r.done() {
+			return nil, errTruncated
+		}
+		current := r.segments[r.segment][r.pos:]
+		take := n
+		if take > len(current) {
+			take = len(current)
+		}
+		read = append(read, current[:take]...)
+		r.pos += take
+		n -= take
+	}
+	return read, nil
+}
+
+func (r *continuedReader) uint(size int) (int, error) {
+	b, err := r.bytes(size)
+	if err != nil {
+		return 0, err
+	}
+	value := 0
+	for i := size - 1; i >= 0; i-- {
+		value = value<<8 | int(b[i])
+	}
+	return value, nil
+}
+
+func (r *continuedReader) unicodeString(lengthSize int) (string, error) {
+	length, err := r.uint(lengthSize)
+	if err != nil {
+		return "", err
+	}
+	flags, err := r.uint(1)
+	if err != nil {
+		return "", err
+	}
+	runs, extension := 0, 0
+	if flags&0x08 != 0 {
+		if runs, err = r.uint(2); err != nil {
+			return "", err
+		}
+	}
+	if flags&0x04 != 0 {
+		if extension, err = r.uint(4); err != nil {
+			return "", err
+		}
+	}
+
+	chars := make([]uint16, 0, length)
+	wide := flags&0x01 != 0
+	for len(chars) < length {
+		if r.done() {
+			return "", errTruncated
+		}
+		// the characters continue in the next record after a new flags byte
+		if r.pos == 0 && r.segment > 0 && len(chars) > 0 {
+			flags, err := r.uint(1)
+			if err != nil {
+				return "", err
+			}
+			wide = flags&0x01 != 0
+		}
+		available := len(r.segments[r.segment]) - r.pos
+		for available > 0 && len(chars) < length {
+			if wide {
+				if available < 2 {
+					return "", errTruncated
+				}
+				b, _ := r.bytes(2)
+				chars = append(chars, binary.LittleEndian.Uint16(b))
+				available -= 2
+			} else {
+				b, _ := r.bytes(1)
+				chars = append(chars, uint16(b[0]))
+				available--
+			}
+		}
+	}
+
+	if _, err := r.bytes(4*runs + extension); err != nil {
+		return "", err
+	}
+	return string(utf16.Decode(chars)), nil
+}
+
+// xlsx writes the cells into an xlsx workbook with the number formats of the xls file
+func (book *xlsBook) xlsx() (*excelize.File, error) {
+	f := excelize.NewFile()
+	if len(book.sheets) == 0 {
+		return nil, fmt.Errorf("xls file has no sheets")
+	}
+
+	if book.date1904 {
+		date1904 := true
+		if err := f.SetWorkbookProps(&excelize.WorkbookPropsOptions{Date1904: &date1904}); err != nil {
+			return nil, err
+		}
+	}
+
+	styles := make(map[uint16]int)
+	for i, sheet := range book.sheets {
+		if i == 0 {
+			if err := f.SetSheetName("Sheet1", sheet.name); err != nil {
+				return nil, err
+			}
+		} else if _, err := f.NewSheet(sheet.name); err != nil {
+			return nil, err
+		}
+
+		if err := book.writeSheet(f, sheet, styles); err != nil {
+			return nil, fmt.Errorf("sheet %v: %v", sheet.name, err)
+		}
+	}
+	return f, nil
+}
+
+func (book *xlsBook) writeSheet(f *excelize.File, sheet *xlsSheet, styles map[uint16]int) error {
+	rows := make(map[int][]interface{})
+	for position, cell := range sheet.cells {
+		row, col := position[0], position[1]
+		for len(rows[row]) <= col {
+			rows[row] = append(rows[row], nil)
+		}
+
+		style, err := book.style(f, cell, styles)
+		if err != nil {
+			return err
+		}
+		rows[row][col] = excelize.Cell{StyleID: style, Value: cell.value}
+	}
+
+	numbers := make([]int, 0, len(rows))
+	for row := range rows {
+		numbers = append(numbers, row)
+	}
+	sort.Ints(numbers)
+
+	stream, err := f.NewStreamWriter(sheet.name)
+	if err != nil {
+		return err
+	}
+	for _, row := range numbers {
+		cell, err := excelize.CoordinatesToCellName(1, row+1)
+		if err != nil {
+			return err
+		}
+		if err := stream.SetRow(cell, rows[row]); err != nil {
+			return err
+		}
+	}
+	return stream.Flush()
+}
+
+// style returns the style displaying a number cell with its number format
+func (book *xlsBook) style(f *excelize.File, cell xlsCell, styles map[uint16]int) (int, error) {
+	if _, ok := cell.value.(float64); !ok || int(cell.xf) >= len(book.xfs) {
+		return 0, nil
+	}
+	numFmt := book.xfs[cell.xf]
+	if numFmt == 0 {
+		return 0, nil
+	}
+	if style, ok := styles[numFmt]; ok {
+		return style, nil
+	}
+
+	format := &excelize.Style{NumFmt: int(numFmt)}
+	if code, ok := book.formats[numFmt]; ok {
+		format = &excelize.Style{CustomNumFmt: &code}
+	}
+	style, err := f.NewStyle(format)
+	if err != nil {
+		return 0, err
+	}
+	styles[numFmt] = style
+	return style, nil
+}
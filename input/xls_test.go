@@ -0,0 +1,212 @@
+package input
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func le16(v int) []byte {
+	return binary.LittleEndian.AppendUint16(nil, uint16(v))
+}
+
+func le32(v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, v)
+}
+
+func record(kind uint16, data ...[]byte) []byte {
+	var body []byte
+	for _, d := range data {
+		body = append(body, d...)
+	}
+	return append(append(le16(int(kind)), le16(len(body))...), body...)
+}
+
+// compressed is an unformatted string of single byte characters
+func compressed(text string, lengthSize int) []byte {
+	length := le16(len(text))
+	if lengthSize == 1 {
+		length = []byte{byte(len(text))}
+	}
+	return append(append(length, 0), text...)
+}
+
+func wide(text string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(text)) {
+		b = append(b, le16(int(c))...)
+	}
+	return b
+}
+
+func cell(kind uint16, row int, col int, xf int, value ...[]byte) []byte {
+	return record(kind, append([][]byte{le16(row), le16(col), le16(xf)}, value...)...)
+}
+
+// rk is an RK number holding an integer
+func rk(n int) []byte {
+	return le32(uint32(n)<<2 | 2)
+}
+
+// xlsStream is a workbook stream with globals after its BOF and a single sheet named Sheet of
+// the cells
+func xlsStream(globals []byte, cells ...[]byte) []byte {
+	bof := func(kind int) []byte {
+		return record(recordBOF, le16(biff8), le16(kind), make([]byte, 12))
+	}
+	sheet := func(offset int) []byte {
+		return record(recordBoundSheet, le32(uint32(offset)), []byte{0, 0}, compressed("Sheet", 1))
+	}
+	stream := append(bof(0x0005), globals...)
+	offset := len(stream) + len(sheet(0)) + len(record(recordEOF))
+	stream = append(append(append(stream, sheet(offset)...), record(recordEOF)...), bof(0x0010)...)
+	for _, c := range cells {
+		stream = append(stream, c...)
+	}
+	return append(stream, record(recordEOF)...)
+}
+
+func TestParseXls(t *testing.T) {
+	number := func(v float64) []byte {
+		return binary.LittleEndian.AppendUint64(nil, math.Float64bits(v))
+	}
+	xfs := append(append(record(recordXF, le16(0), le16(0), make([]byte, 16)),
+		record(recordXF, le16(0), le16(14), make([]byte, 16))...),
+		record(recordXF, le16(0), le16(164), make([]byte, 16))...)
+
+	tests := []struct {
+		name    string
+		globals []byte
+		cells   [][]byte
+		rows    [][]string
+		raw     [][]string
+	}{
+		{
+			name: "shared strings continued",
+			// the second string is split, its characters continue wide after a new flags byte
+			globals: append(
+				record(recordSST, le32(2), le32(2), compressed("NO", 2), le16(13), []byte{0}, []byte("MERCHA")),
+				record(recordContinue, []byte{1}, wide("NT NAMÉ"))...),
+			cells: [][]byte{
+				cell(recordLabelSST, 0, 0, 0, le32(0)),
+				cell(recordLabelSST, 0, 1, 0, le32(1)),
+			},
+			rows: [][]string{{"NO", "MERCHANT NAMÉ"}},
+		},
+		{
+			name: "rk and mulrk",
+			cells: [][]byte{
+				cell(recordRK, 0, 0, 0, rk(1250000)),
+				// 123.45 stored as 12345 divided by 100
+				cell(recordRK, 0, 1, 0, le32(12345<<2|3)),
+				// the high 32 bits of 1.5
+				cell(recordRK, 0, 2, 0, le32(0x3FF80000)),
+				record(recordMulRK, le16(1), le16(0), le16(0), rk(1), le16(0), rk(2), le16(0), rk(3), le16(2)),
+			},
+			rows: [][]string{{"1250000", "123.45", "1.5"}, {"1", "2", "3"}},
+			raw:  [][]string{{"1250000", "123.45", "1.5"}, {"1", "2", "3"}},
+		},
+		{
+			name:    "dates",
+			globals: append(record(recordFormat, le16(164), compressed("yyyy-mm-dd", 2)), xfs...),
+			cells: [][]byte{
+				cell(recordNumber, 0, 0, 1, number(45378)),
+				cell(recordNumber, 0, 1, 2, number(45378)),
+			},
+			rows: [][]string{{"03-27-24", "2024-03-27"}},
+			raw:  [][]string{{"45378", "45378"}},
+		},
+		{
+			name: "merged cells",
+			cells: [][]byte{
+				cell(recordLabel, 0, 0, 0, compressed("TOKO", 2)),
+				// the cell hidden by the merge is blank
+				cell(0x0201, 0, 1, 0),
+				cell(recordLabel, 0, 2, 0, compressed("X", 2)),
+				record(0x00E5, le16(1), le16(0), le16(0), le16(0), le16(1)),
+			},
+			rows: [][]string{{"TOKO", "", "X"}},
+			raw:  [][]string{{"", "", ""}},
+		},
+		{
+			name: "formula text",
+			cells: [][]byte{
+				cell(recordFormula, 0, 0, 0, []byte{0, 0, 0, 0, 0, 0, 0xFF, 0xFF}, make([]byte, 6)),
+				record(recordString, compressed("PURCHASE", 2)),
+				cell(recordFormula, 0, 1, 0, number(2.5), make([]byte, 6)),
+			},
+			rows: [][]string{{"PURCHASE", "2.5"}},
+			raw:  [][]string{{"", "2.5"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			book, err := parseXls(xlsStream(test.globals, test.cells...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := book.xlsx()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wb := &spreadsheet{File: f, format: FormatXls}
+			defer wb.Close()
+
+			rows, err := wb.Rows("Sheet")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := join(rows), join(test.rows); got != want {
+				t.Errorf("rows %v, want %v", got, want)
+			}
+			if test.raw == nil {
+				return
+			}
+			raw, err := wb.RawRows("Sheet")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := join(raw), join(test.raw); got != want {
+				t.Errorf("raw rows %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseXlsRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []byte
+		err    string
+	}{
+		{"encrypted", xlsStream(record(recordFilePass, le16(1), make([]byte, 52))), "encrypted"},
+		{"biff5", record(recordBOF, le16(0x0500), le16(5)), "only Excel 97"},
+		{"truncated", xlsStream(nil)[:30], "truncated"},
+		{"missing shared string", xlsStream(nil, cell(recordLabelSST, 0, 0, 0, le32(3))), "shared string 3"},
+		{"column out of the sheet", xlsStream(nil, cell(recordRK, 0, 300, 0, rk(1))), "256 columns"},
+		{"mulrk out of the sheet", xlsStream(nil, record(recordMulRK, le16(0), le16(255), le16(0), rk(1), le16(0), rk(2), le16(256))), "256 columns"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseXls(test.stream)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got %v, want %q", err, test.err)
+			}
+			if test.name == "encrypted" && !errors.Is(err, ErrEncrypted) {
+				t.Errorf("%v is not ErrEncrypted", err)
+			}
+		})
+	}
+}
+
+// join writes rows on lines with their cells separated by |
+func join(rows [][]string) string {
+	lines := make([]string, len(rows))
+	for i, row := range rows {
+		lines[i] = strings.Join(row, "|")
+	}
+	return strings.Join(lines, "\n")
+}
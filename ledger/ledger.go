@@ -0,0 +1,150 @@
+package ledger
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Entry records a source file that has been delivered to recon, or a new format reported.
+type Entry struct {
+	Channel string `json:"channel"`
+	Source  string `json:"source"`
+	// the archive Source was extracted from, empty for files uploaded on their own
+	Archive string `json:"archive,omitempty"`
+	// the sha256 of the archive, a retry of the archive skips the files it delivered
+	ArchiveHash string    `json:"archiveHash,omitempty"`
+	Output      string    `json:"output"`
+	Hash        string    `json:"hash"`
+	ProcessedAt time.Time `json:"processedAt"`
+	// Metadata holds the values captured from the rows above the header
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Forced is set when the file was delivered without checking for duplicates
+	Forced bool `json:"forced,omitempty"`
+	// SchemaVersion is the schema version the header of the file matched
+	SchemaVersion string `json:"schemaVersion,omitempty"`
+	// Pgp records the keys of a file decrypted or delivered encrypted
+	Pgp *Pgp `json:"pgp,omitempty"`
+	// NewFormat is the fingerprint of a header that matched no schema version, reported for
+	// Source. The entry records the report, not a delivery.
+	NewFormat string `json:"newFormat,omitempty"`
+}
+
+// Pgp records the OpenPGP keys a file was processed with, by fingerprint.
+type Pgp struct {
+	DecryptedWith string `json:"decryptedWith,omitempty"`
+	SignedBy      string `json:"signedBy,omitempty"`
+	// verified, unsigned or unchecked
+	Signature string      `json:"signature,omitempty"`
+	Encrypted []Encrypted `json:"encrypted,omitempty"`
+}
+
+// Encrypted is an output delivered as an OpenPGP message
+type Encrypted struct {
+	Output     string   `json:"output"`
+	Recipients []string `json:"recipients"`
+	SignedWith string   `json:"signedWith,omitempty"`
+}
+
+// Ledger is an append-only JSON lines file of processed files.
+type Ledger struct {
+	path    string
+	mu      sync.Mutex
+	entries []Entry
+}
+
+func Open(path string) (*Ledger, error) {
+	ledger := &Ledger{path: path}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return ledger, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		ledger.entries = append(ledger.entries, entry)
+	}
+
+	return ledger, scanner.Err()
+}
+
+// FindByHash returns the latest entry of channel with the given content hash.
+func (ledger *Ledger) FindByHash(channel string, hash string) (Entry, bool) {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+
+	for i := len(ledger.entries) - 1; i >= 0; i-- {
+		if ledger.entries[i].NewFormat != "" {
+			continue
+		}
+		if ledger.entries[i].Channel == channel && ledger.entries[i].Hash == hash {
+			return ledger.entries[i], true
+		}
+	}
+	return Entry{}, false
+}
+
+// Record appends entry to the ledger file.
+func (ledger *Ledger) Record(entry Entry) error {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	return ledger.record(entry)
+}
+
+// RecordNewFormat appends entry, the report of a new format, unless the format of the channel is
+// recorded already. It returns whether entry was recorded.
+func (ledger *Ledger) RecordNewFormat(entry Entry) (bool, error) {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+
+	for _, recorded := range ledger.entries {
+		if recorded.Channel == entry.Channel && recorded.NewFormat == entry.NewFormat {
+			return false, nil
+		}
+	}
+	return true, ledger.record(entry)
+}
+
+// record appends entry to the ledger file. ledger.mu must be held.
+func (ledger *Ledger) record(entry Entry) error {
+	if entry.ProcessedAt.IsZero() {
+		entry.ProcessedAt = time.Now()
+	}
+
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ledger.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(ledger.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(raw, '\n')); err != nil {
+		return err
+	}
+
+	ledger.entries = append(ledger.entries, entry)
+	return nil
+}
@@ -0,0 +1,32 @@
+package mail
+
+import (
+	"sync"
+
+	"gopkg.in/gomail.v2"
+)
+
+// Recorder is a Sender that keeps the messages instead of sending them
+type Recorder struct {
+	mu       sync.Mutex
+	Messages []*gomail.Message
+}
+
+func (recorder *Recorder) DialAndSend(messages ...*gomail.Message) error {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.Messages = append(recorder.Messages, messages...)
+	return nil
+}
+
+// Subjects returns the subject of every recorded message
+func (recorder *Recorder) Subjects() []string {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	var subjects []string
+	for _, message := range recorder.Messages {
+		subjects = append(subjects, message.GetHeader("Subject")...)
+	}
+	return subjects
+}
@@ -31,8 +31,6 @@ func (*Application) JobHandler() {
 
 func main() {
 
-	c := cron.New()
-
 	logFile, err := os.OpenFile("miniprogram"+".log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		logrus.Fatalf("Failed to create logfile %v", err)
@@ -46,6 +44,19 @@ func main() {
 	logrus.SetFormatter(&utils.CustomJSONFormatter{})
 	logrus.SetOutput(io.MultiWriter(writers...))
 
+	initCommands()
+	app.Name = "reconconverter"
+	app.Action = runJob
+
+	if err := app.Run(os.Args); err != nil {
+		logrus.Fatalf("%v", err)
+	}
+}
+
+func runJob(ctx *cli.Context) {
+
+	c := cron.New()
+
 	config := &config.Config{}
 	configFile := "./config.yaml"
 
@@ -58,6 +69,10 @@ func main() {
 
 	handler := handler.NewHandler(config, assets)
 
+	if err := handler.Watch(); err != nil {
+		logrus.Fatalf("Error initiate watcher : %v", err)
+	}
+
 	cronList := strings.Split(config.Cron, ",")
 
 	for _, each := range cronList {
@@ -65,8 +80,7 @@ func main() {
 			counter := 0
 			for counter < 4 {
 				counter++
-				handler.IndodanaHandler()
-				handler.OvoHandler()
+				handler.Run()
 				// duration := time.Duration()
 				time.Sleep(time.Duration(config.JobLoopDelay) * time.Minute)
 			}
@@ -104,7 +118,95 @@ func initCommands() {
 
 			},
 		},
+		{
+			Name:        "run",
+			Usage:       "run [--channel ovo] [--force FILE]...",
+			Description: "Process the channels once and exit. A forced file is delivered even when it is a duplicate, a file of an archive is named ARCHIVE/FILE",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config", Value: "./config.yaml"},
+				cli.StringFlag{Name: "views", Value: "./views"},
+				cli.StringSliceFlag{Name: "channel", Usage: "run only this channel, can be repeated"},
+				cli.StringSliceFlag{Name: "force", Usage: "deliver this source file even when it is a duplicate, can be repeated"},
+			},
+			Action: runOnce,
+		},
+		{
+			Name:        "rename-preview",
+			Usage:       "rename-preview --channel ovo FILE...",
+			Description: "Show the output filename of each given source filename",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config", Value: "./config.yaml"},
+				cli.StringFlag{Name: "channel"},
+			},
+			Action: renamePreview,
+		},
+	}
+}
+
+func runOnce(c *cli.Context) error {
+	config := &config.Config{}
+	configFile := c.String("config")
+	if err := config.LoadYAML(&configFile); err != nil {
+		return err
+	}
+	for _, channelName := range c.StringSlice("channel") {
+		if _, ok := config.Channels()[channelName]; !ok {
+			return fmt.Errorf("unknown channel %q", channelName)
+		}
 	}
+
+	assets, err := mail.NewAssets(c.String("views"), mail.NotifConverted)
+	if err != nil {
+		return err
+	}
+
+	summary := handler.NewHandler(config, assets).RunWith(handler.RunOptions{
+		Channels: c.StringSlice("channel"),
+		Force:    c.StringSlice("force"),
+	})
+
+	failed := 0
+	for _, channel := range summary.Channels {
+		failed += len(channel.Failed)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files failed", failed)
+	}
+	return nil
+}
+
+func renamePreview(c *cli.Context) error {
+	config := &config.Config{}
+	configFile := c.String("config")
+	if err := config.LoadYAML(&configFile); err != nil {
+		return err
+	}
+
+	rules, err := handler.NewFilenameRules(config)
+	if err != nil {
+		return err
+	}
+	rule, ok := rules[c.String("channel")]
+	if !ok {
+		return fmt.Errorf("unknown channel %q", c.String("channel"))
+	}
+	if rule.UsesMeta() {
+		fmt.Println("The output names use values above the header of the files, they are rendered once the files are read")
+		return nil
+	}
+
+	for _, result := range rule.MapFilenames(c.Args(), handler.Sequence(c.Args())) {
+		switch {
+		case result.Err != nil:
+			fmt.Printf("%v -> ERROR: %v\n", result.Source, result.Err)
+		case result.Collision:
+			fmt.Printf("%v -> %v (COLLISION)\n", result.Source, result.Output)
+		default:
+			fmt.Printf("%v -> %v\n", result.Source, result.Output)
+		}
+	}
+
+	return nil
 }
 
 func ovoHandler(path, originalFilename string) error {
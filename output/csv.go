@@ -0,0 +1,95 @@
+package output
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reconconverter/config"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	QuoteMinimal = "minimal"
+	QuoteAll     = "all"
+	QuoteNone    = "none"
+)
+
+// delimited writes csv, quoting fields like encoding/csv, every field or none
+type delimited struct {
+	comma      rune
+	quote      string
+	header     bool
+	lineEnding string
+}
+
+func newCsv(cfg config.Output, header bool, lineEnding string) (*delimited, error) {
+	comma := ';'
+	if cfg.Delimiter != "" {
+		if cfg.Delimiter == `\t` {
+			cfg.Delimiter = "\t"
+		}
+		if utf8.RuneCountInString(cfg.Delimiter) != 1 || strings.ContainsAny(cfg.Delimiter, "\"\r\n") {
+			return nil, fmt.Errorf("invalid csv delimiter %q", cfg.Delimiter)
+		}
+		comma, _ = utf8.DecodeRuneInString(cfg.Delimiter)
+	}
+
+	quote := strings.ToLower(cfg.Quote)
+	switch quote {
+	case "":
+		quote = QuoteMinimal
+	case QuoteMinimal, QuoteAll, QuoteNone:
+	default:
+		return nil, fmt.Errorf("unknown csv quote %q", cfg.Quote)
+	}
+
+	return &delimited{comma: comma, quote: quote, header: header, lineEnding: lineEnding}, nil
+}
+
+func (d *delimited) Write(w io.Writer, content [][]string) error {
+	if !d.header && len(content) > 0 {
+		content = content[1:]
+	}
+
+	if d.quote == QuoteMinimal {
+		writer := csv.NewWriter(w)
+		writer.Comma = d.comma
+		writer.UseCRLF = d.lineEnding == "\r\n"
+		return writer.WriteAll(content)
+	}
+
+	comma := string(d.comma)
+	for idx, row := range content {
+		fields := make([]string, len(row))
+		for i, field := range row {
+			if d.quote == QuoteAll {
+				fields[i] = `"` + strings.ReplaceAll(field, `"`, `""`) + `"`
+				continue
+			}
+			if strings.Contains(field, comma) || strings.ContainsAny(field, "\r\n") {
+				return fmt.Errorf("row %d: %q can't be written without quotes", idx+1, field)
+			}
+			fields[i] = field
+		}
+		if _, err := io.WriteString(w, strings.Join(fields, comma)+d.lineEnding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *delimited) Count(r io.Reader) (int, error) {
+	reader := csv.NewReader(r)
+	reader.Comma = d.comma
+	reader.LazyQuotes = d.quote == QuoteNone
+	records, err := reader.ReadAll()
+	if err != nil {
+		return 0, err
+	}
+
+	if d.header {
+		return len(records) - 1, nil
+	}
+	return len(records), nil
+}
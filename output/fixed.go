@@ -0,0 +1,135 @@
+package output
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reconconverter/config"
+	"strings"
+	"unicode/utf8"
+)
+
+type fixedField struct {
+	name  string
+	width int
+	right bool
+	pad   string
+}
+
+// fixedWidth writes one record per line, every field padded to its width
+type fixedWidth struct {
+	fields     []fixedField
+	header     bool
+	lineEnding string
+}
+
+func newFixedWidth(cfg config.Output, header bool, lineEnding string) (*fixedWidth, error) {
+	if len(cfg.Fields) == 0 {
+		return nil, fmt.Errorf("fixedwidth output has no fields")
+	}
+
+	format := &fixedWidth{header: header, lineEnding: lineEnding}
+	for _, field := range cfg.Fields {
+		if field.Name == "" || field.Width < 1 {
+			return nil, fmt.Errorf("fixedwidth field %q needs a name and a positive width", field.Name)
+		}
+
+		compiled := fixedField{name: field.Name, width: field.Width, pad: field.Pad}
+		switch strings.ToLower(field.Align) {
+		case "", "left":
+		case "right":
+			compiled.right = true
+		default:
+			return nil, fmt.Errorf("unknown align %q of fixedwidth field %v", field.Align, field.Name)
+		}
+		if compiled.pad == "" {
+			compiled.pad = " "
+		}
+		if utf8.RuneCountInString(compiled.pad) != 1 {
+			return nil, fmt.Errorf("pad of fixedwidth field %v must be a single character", field.Name)
+		}
+		format.fields = append(format.fields, compiled)
+	}
+	return format, nil
+}
+
+func (f *fixedWidth) Write(w io.Writer, content [][]string) error {
+	if len(content) == 0 {
+		return nil
+	}
+
+	columns := make([]int, len(f.fields))
+	for i, field := range f.fields {
+		columns[i] = -1
+		for col, name := range content[0] {
+			if name == field.name {
+				columns[i] = col
+				break
+			}
+		}
+		if columns[i] < 0 {
+			return fmt.Errorf("fixedwidth field %v is not a column of the file", field.name)
+		}
+	}
+
+	buffered := bufio.NewWriter(w)
+	for idx, row := range content {
+		if idx == 0 && !f.header {
+			continue
+		}
+
+		var record strings.Builder
+		for i, field := range f.fields {
+			value := field.name
+			if idx > 0 {
+				value = ""
+				if columns[i] < len(row) {
+					value = row[columns[i]]
+				}
+			}
+
+			padded, err := field.fit(value)
+			if err != nil {
+				return fmt.Errorf("row %d: %v", idx+1, err)
+			}
+			record.WriteString(padded)
+		}
+		record.WriteString(f.lineEnding)
+
+		if _, err := buffered.WriteString(record.String()); err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
+
+func (field fixedField) fit(value string) (string, error) {
+	length := utf8.RuneCountInString(value)
+	if length > field.width {
+		return "", fmt.Errorf("%q is longer than the %d characters of %v", value, field.width, field.name)
+	}
+
+	padding := strings.Repeat(field.pad, field.width-length)
+	if field.right {
+		return padding + value, nil
+	}
+	return value + padding, nil
+}
+
+func (f *fixedWidth) Count(r io.Reader) (int, error) {
+	count := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if strings.TrimRight(scanner.Text(), "\r") != "" {
+			count++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	if f.header && count > 0 {
+		count--
+	}
+	return count, nil
+}
@@ -0,0 +1,71 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// jsonl writes every row as an object keyed by the column names, in column order
+type jsonl struct {
+	lineEnding string
+}
+
+func (j *jsonl) Write(w io.Writer, content [][]string) error {
+	if len(content) == 0 {
+		return nil
+	}
+	header := content[0]
+
+	buffered := bufio.NewWriter(w)
+	for _, row := range content[1:] {
+		var record bytes.Buffer
+		record.WriteByte('{')
+		for col, name := range header {
+			if col > 0 {
+				record.WriteByte(',')
+			}
+			key, err := json.Marshal(name)
+			if err != nil {
+				return err
+			}
+			var value string
+			if col < len(row) {
+				value = row[col]
+			}
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			record.Write(key)
+			record.WriteByte(':')
+			record.Write(encoded)
+		}
+		record.WriteByte('}')
+		record.WriteString(j.lineEnding)
+
+		if _, err := buffered.Write(record.Bytes()); err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
+
+func (j *jsonl) Count(r io.Reader) (int, error) {
+	count := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !json.Valid([]byte(line)) {
+			return 0, &json.SyntaxError{Offset: int64(count + 1)}
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
@@ -0,0 +1,170 @@
+// Package output encodes the converted rows of a file in the formats the
+// downstream consumers read.
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reconconverter/config"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
+)
+
+const (
+	FormatCsv        = "csv"
+	FormatFixedWidth = "fixedwidth"
+	FormatJsonl      = "jsonl"
+	FormatXlsx       = "xlsx"
+)
+
+var extensions = map[string]string{
+	FormatCsv:        ".csv",
+	FormatFixedWidth: ".txt",
+	FormatJsonl:      ".jsonl",
+	FormatXlsx:       ".xlsx",
+}
+
+// Format encodes rows as text, or as bytes for binary formats, and counts the records of
+// what it encoded. content starts with the header.
+type Format interface {
+	Write(w io.Writer, content [][]string) error
+	Count(r io.Reader) (int, error)
+}
+
+// Writer writes the rows of a file in the format of an output, in its encoding.
+type Writer struct {
+	Extension string
+	// csv outputs without extension keep the name given by the filename rule
+	keepName bool
+	format   Format
+	encoding encoding.Encoding
+	bom      bool
+}
+
+// Default is the output of a channel that doesn't configure any.
+var Default = config.Output{Format: FormatCsv}
+
+// Outputs returns the outputs of a channel, the default output when it has none.
+func Outputs(channel config.Channel) []config.Output {
+	if len(channel.Outputs) == 0 {
+		return []config.Output{Default}
+	}
+	return channel.Outputs
+}
+
+// New checks the settings of an output and returns its writer.
+func New(cfg config.Output) (*Writer, error) {
+	if cfg.Format == "" {
+		cfg.Format = FormatCsv
+	}
+	extension, ok := extensions[cfg.Format]
+	if !ok {
+		return nil, fmt.Errorf("unknown output format %q", cfg.Format)
+	}
+	if cfg.Extension != "" {
+		extension = "." + strings.TrimPrefix(cfg.Extension, ".")
+	}
+
+	var lineEnding string
+	switch strings.ToLower(cfg.LineEnding) {
+	case "", "lf":
+		lineEnding = "\n"
+	case "crlf":
+		lineEnding = "\r\n"
+	default:
+		return nil, fmt.Errorf("unknown line ending %q", cfg.LineEnding)
+	}
+
+	header := cfg.Format == FormatCsv || cfg.Format == FormatXlsx
+	if cfg.Header != nil {
+		header = *cfg.Header
+	}
+
+	writer := &Writer{Extension: extension, bom: cfg.BOM, keepName: cfg.Format == FormatCsv && cfg.Extension == ""}
+	if cfg.Encoding != "" && !strings.EqualFold(cfg.Encoding, "utf-8") && !strings.EqualFold(cfg.Encoding, "utf8") {
+		enc, err := ianaindex.IANA.Encoding(cfg.Encoding)
+		if err != nil || enc == nil {
+			return nil, fmt.Errorf("unknown encoding %q", cfg.Encoding)
+		}
+		writer.encoding = enc
+	}
+	if writer.bom && writer.encoding != nil {
+		if _, err := writer.encoding.NewEncoder().String("\ufeff"); err != nil {
+			return nil, fmt.Errorf("encoding %v has no byte order mark", cfg.Encoding)
+		}
+	}
+
+	var err error
+	switch cfg.Format {
+	case FormatCsv:
+		writer.format, err = newCsv(cfg, header, lineEnding)
+	case FormatFixedWidth:
+		writer.format, err = newFixedWidth(cfg, header, lineEnding)
+	case FormatJsonl:
+		writer.format = &jsonl{lineEnding: lineEnding}
+	case FormatXlsx:
+		if writer.encoding != nil || writer.bom || cfg.LineEnding != "" {
+			return nil, fmt.Errorf("xlsx has no encoding, bom or line ending")
+		}
+		writer.format = newXlsx(cfg, header)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// Write encodes content to w
+func (writer *Writer) Write(w io.Writer, content [][]string) error {
+	if writer.encoding == nil {
+		return writer.write(w, content)
+	}
+
+	encoder := transform.NewWriter(w, writer.encoding.NewEncoder())
+	if err := writer.write(encoder, content); err != nil {
+		encoder.Close()
+		return err
+	}
+	return encoder.Close()
+}
+
+func (writer *Writer) write(w io.Writer, content [][]string) error {
+	if writer.bom {
+		if _, err := io.WriteString(w, "\ufeff"); err != nil {
+			return err
+		}
+	}
+	return writer.format.Write(w, content)
+}
+
+// Count returns the number of records of a file written by Write
+func (writer *Writer) Count(r io.Reader) (int, error) {
+	if writer.encoding != nil {
+		r = transform.NewReader(r, writer.encoding.NewDecoder())
+	}
+	if writer.bom {
+		buffered := bufio.NewReader(r)
+		if bom, err := buffered.Peek(3); err == nil && bytes.Equal(bom, []byte("\ufeff")) {
+			buffered.Discard(3)
+		}
+		r = buffered
+	}
+	return writer.format.Count(r)
+}
+
+// Filename replaces the extension of name with the extension of the output
+func (writer *Writer) Filename(name string) string {
+	if writer.keepName {
+		return name
+	}
+	if idx := strings.LastIndex(name, "."); idx > 0 {
+		name = name[:idx]
+	}
+	return name + writer.Extension
+}
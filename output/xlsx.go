@@ -0,0 +1,120 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"reconconverter/config"
+	"strconv"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// xlsx writes a single sheet workbook with the header frozen and filterable
+type xlsx struct {
+	sheet   string
+	header  bool
+	numbers map[string]bool
+}
+
+func newXlsx(cfg config.Output, header bool) *xlsx {
+	format := &xlsx{sheet: cfg.Sheet, header: header, numbers: make(map[string]bool)}
+	if format.sheet == "" {
+		format.sheet = "Sheet1"
+	}
+	for _, name := range cfg.NumberColumns {
+		format.numbers[name] = true
+	}
+	return format
+}
+
+func (x *xlsx) Write(w io.Writer, content [][]string) error {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	if err := f.SetSheetName("Sheet1", x.sheet); err != nil {
+		return err
+	}
+
+	var header []string
+	if len(content) > 0 {
+		header = content[0]
+	}
+
+	stream, err := f.NewStreamWriter(x.sheet)
+	if err != nil {
+		return err
+	}
+
+	rowNumber := 1
+	if x.header && len(header) > 0 {
+		bold, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+		if err != nil {
+			return err
+		}
+		// panes must be set before the first row
+		if err := stream.SetPanes(&excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft"}); err != nil {
+			return err
+		}
+		cells := make([]interface{}, len(header))
+		for i, name := range header {
+			cells[i] = excelize.Cell{StyleID: bold, Value: name}
+		}
+		if err := stream.SetRow("A1", cells); err != nil {
+			return err
+		}
+		rowNumber++
+	}
+
+	for idx, row := range content {
+		if idx == 0 {
+			continue
+		}
+		cells := make([]interface{}, len(row))
+		for col, value := range row {
+			cells[col] = value
+			if col < len(header) && x.numbers[header[col]] && value != "" {
+				number, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return fmt.Errorf("row %d column %v: %q is not a number", idx+1, header[col], value)
+				}
+				cells[col] = number
+			}
+		}
+		cell, _ := excelize.CoordinatesToCellName(1, rowNumber)
+		if err := stream.SetRow(cell, cells); err != nil {
+			return err
+		}
+		rowNumber++
+	}
+
+	if err := stream.Flush(); err != nil {
+		return err
+	}
+	if x.header && len(header) > 0 && rowNumber > 2 {
+		last, _ := excelize.CoordinatesToCellName(len(header), rowNumber-1)
+		if err := f.AutoFilter(x.sheet, "A1:"+last, nil); err != nil {
+			return err
+		}
+	}
+
+	_, err = f.WriteTo(w)
+	return err
+}
+
+func (x *xlsx) Count(r io.Reader) (int, error) {
+	f, err := excelize.OpenReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	rows, err := f.GetRows(x.sheet)
+	if err != nil {
+		return 0, err
+	}
+
+	if x.header && len(rows) > 0 {
+		return len(rows) - 1, nil
+	}
+	return len(rows), nil
+}
@@ -0,0 +1,338 @@
+// Package pgp decrypts and verifies the OpenPGP messages partners send and encrypts and
+// signs the outputs delivered to recon. Keys are read from keyring files, armored or binary,
+// once when the converter starts.
+package pgp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reconconverter/config"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// results of the signature check of a decrypted message
+const (
+	SignatureVerified = "verified"
+	SignatureUnsigned = "unsigned"
+	// signed, but the channel has no verify keyring to check it with
+	SignatureUnchecked = "unchecked"
+)
+
+var armorPrefix = []byte("-----BEGIN PGP")
+
+// Verification is what is known about a decrypted message
+type Verification struct {
+	// fingerprint of the primary key of the key that decrypted the message
+	DecryptedWith string
+	// fingerprint of the primary key of the signing key, or the key id when the key is unknown
+	SignedBy  string
+	Signature string
+}
+
+// Keys are the keys of a channel
+type Keys struct {
+	decrypt bool
+	// our keys, unlocked
+	private openpgp.EntityList
+	// the partner's keys, a signature of one of them is required when set
+	verify openpgp.EntityList
+}
+
+// NewKeys reads the keyrings of a channel and unlocks its private keys
+func NewKeys(cfg config.Pgp) (*Keys, error) {
+	keys := &Keys{decrypt: cfg.Decrypt}
+
+	if cfg.PrivateKeyring != "" {
+		passphrase, err := cfg.Passphrase.Load()
+		if err != nil {
+			return nil, fmt.Errorf("passphrase: %v", err)
+		}
+		if keys.private, err = readKeyring(cfg.PrivateKeyring); err != nil {
+			return nil, err
+		}
+		for _, entity := range keys.private {
+			if err := unlock(entity, passphrase); err != nil {
+				return nil, fmt.Errorf("%v: key %v: %v", cfg.PrivateKeyring, Fingerprint(entity), err)
+			}
+		}
+	} else if cfg.Passphrase.IsSet() {
+		return nil, fmt.Errorf("passphrase needs a private keyring")
+	}
+
+	if cfg.Decrypt && len(keys.private) == 0 {
+		return nil, fmt.Errorf("decrypt needs a private keyring")
+	}
+	if cfg.VerifyKeyring != "" {
+		if !cfg.Decrypt {
+			return nil, fmt.Errorf("verify keyring needs decrypt")
+		}
+		var err error
+		if keys.verify, err = readKeyring(cfg.VerifyKeyring); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// Enabled reports whether the source files of the channel are decrypted
+func (keys *Keys) Enabled() bool {
+	return keys.decrypt
+}
+
+// Decrypt writes the content of the message at src to dst. The signature is checked once the
+// whole message is read, dst must not be used when an error is returned.
+func (keys *Keys) Decrypt(src string, dst string) (Verification, error) {
+	var verification Verification
+
+	in, err := os.Open(src)
+	if err != nil {
+		return verification, err
+	}
+	defer in.Close()
+
+	buffered := bufio.NewReader(in)
+	var message io.Reader = buffered
+	if head, _ := buffered.Peek(len(armorPrefix)); bytes.Equal(head, armorPrefix) {
+		block, err := armor.Decode(buffered)
+		if err != nil {
+			return verification, fmt.Errorf("invalid armor: %v", err)
+		}
+		if block.Type != "PGP MESSAGE" {
+			return verification, fmt.Errorf("armored %v is not a message", strings.ToLower(block.Type))
+		}
+		message = block.Body
+	}
+
+	// signatures are looked up in the same keyring, our own keys only count as signers
+	// when nothing is verified
+	keyring := keys.private
+	if len(keys.verify) > 0 {
+		keyring = append(append(openpgp.EntityList{}, keys.private...), keys.verify...)
+	}
+	md, err := openpgp.ReadMessage(message, keyring, nil, nil)
+	if err != nil {
+		return verification, fmt.Errorf("not a pgp message for our keys: %v", err)
+	}
+	if !md.IsEncrypted {
+		return verification, fmt.Errorf("pgp message is not encrypted")
+	}
+	verification.DecryptedWith = Fingerprint(md.DecryptedWith.Entity)
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return verification, err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, md.UnverifiedBody); err != nil {
+		return verification, fmt.Errorf("decrypt: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return verification, err
+	}
+
+	switch {
+	case !md.IsSigned:
+		verification.Signature = SignatureUnsigned
+	case md.SignedBy == nil:
+		verification.Signature = SignatureUnchecked
+		verification.SignedBy = fmt.Sprintf("%016X", md.SignedByKeyId)
+		if len(md.SignedByFingerprint) > 0 {
+			verification.SignedBy = fingerprint(md.SignedByFingerprint)
+		}
+	case md.SignatureError != nil:
+		return verification, fmt.Errorf("invalid signature of %v: %v", Fingerprint(md.SignedBy.Entity), md.SignatureError)
+	default:
+		verification.Signature = SignatureVerified
+		verification.SignedBy = Fingerprint(md.SignedBy.Entity)
+	}
+
+	if len(keys.verify) > 0 {
+		switch {
+		case verification.Signature == SignatureUnsigned:
+			return verification, fmt.Errorf("message is not signed, a signature of the partner's key is required")
+		case verification.Signature != SignatureVerified || !contains(keys.verify, md.SignedBy.Entity):
+			return verification, fmt.Errorf("message is signed by %v, not by a key of the partner", verification.SignedBy)
+		}
+	}
+	return verification, nil
+}
+
+// Encryptor encrypts the files of an output
+type Encryptor struct {
+	to     openpgp.EntityList
+	signer *openpgp.Entity
+	armor  bool
+}
+
+// NewEncryptor reads the keyring an output is encrypted to. It returns nil when the output is
+// not encrypted. Outputs are signed with the first private key of the channel.
+func NewEncryptor(cfg config.PgpEncrypt, keys *Keys) (*Encryptor, error) {
+	if cfg.Keyring == "" {
+		if cfg.Sign || cfg.Armor {
+			return nil, fmt.Errorf("encrypt needs a keyring")
+		}
+		return nil, nil
+	}
+
+	to, err := readKeyring(cfg.Keyring)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, entity := range to {
+		if _, ok := entity.EncryptionKey(now); !ok {
+			return nil, fmt.Errorf("%v: key %v can't encrypt, it is expired, revoked or has no encryption key", cfg.Keyring, Fingerprint(entity))
+		}
+	}
+
+	encryptor := &Encryptor{to: to, armor: cfg.Armor}
+	if cfg.Sign {
+		if keys == nil || len(keys.private) == 0 {
+			return nil, fmt.Errorf("sign needs the private keyring of the channel")
+		}
+		encryptor.signer = keys.private[0]
+		if _, ok := encryptor.signer.SigningKey(now); !ok {
+			return nil, fmt.Errorf("key %v can't sign, it is expired, revoked or has no signing key", Fingerprint(encryptor.signer))
+		}
+	}
+	return encryptor, nil
+}
+
+// Extension is appended to the filename of an encrypted output
+func (encryptor *Encryptor) Extension() string {
+	if encryptor.armor {
+		return ".asc"
+	}
+	return ".pgp"
+}
+
+// Recipients returns the fingerprints of the keys outputs are encrypted to
+func (encryptor *Encryptor) Recipients() []string {
+	var fingerprints []string
+	for _, entity := range encryptor.to {
+		fingerprints = append(fingerprints, Fingerprint(entity))
+	}
+	return fingerprints
+}
+
+// Signer returns the fingerprint of the key outputs are signed with, empty when they are not signed
+func (encryptor *Encryptor) Signer() string {
+	if encryptor.signer == nil {
+		return ""
+	}
+	return Fingerprint(encryptor.signer)
+}
+
+// Encrypt writes the file at src encrypted, and signed when configured, to dst
+func (encryptor *Encryptor) Encrypt(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var w io.Writer = out
+	var armored io.WriteCloser
+	if encryptor.armor {
+		if armored, err = armor.Encode(out, "PGP MESSAGE", nil); err != nil {
+			return err
+		}
+		w = armored
+	}
+
+	hints := &openpgp.FileHints{IsBinary: true, FileName: filepath.Base(src)}
+	plaintext, err := openpgp.Encrypt(w, encryptor.to, encryptor.signer, hints, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(plaintext, in); err != nil {
+		plaintext.Close()
+		return err
+	}
+	if err := plaintext.Close(); err != nil {
+		return err
+	}
+	if armored != nil {
+		if err := armored.Close(); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// Fingerprint returns the fingerprint of the primary key of entity in upper case hex
+func Fingerprint(entity *openpgp.Entity) string {
+	return fingerprint(entity.PrimaryKey.Fingerprint)
+}
+
+func fingerprint(raw []byte) string {
+	return strings.ToUpper(hex.EncodeToString(raw))
+}
+
+// readKeyring reads a keyring file, armored or binary
+func readKeyring(path string) (openpgp.EntityList, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyring openpgp.EntityList
+	if bytes.HasPrefix(bytes.TrimSpace(raw), armorPrefix) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(raw))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(raw))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("%v has no keys", path)
+	}
+	return keyring, nil
+}
+
+// unlock decrypts the private keys of entity with passphrase
+func unlock(entity *openpgp.Entity, passphrase string) error {
+	if entity.PrivateKey == nil {
+		return fmt.Errorf("not a private key")
+	}
+	locked := entity.PrivateKey.Encrypted
+	for _, subkey := range entity.Subkeys {
+		locked = locked || (subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted)
+	}
+	if !locked {
+		return nil
+	}
+	if passphrase == "" {
+		return fmt.Errorf("private key is locked and no passphrase is configured")
+	}
+	if err := entity.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+		return fmt.Errorf("wrong passphrase: %v", err)
+	}
+	return nil
+}
+
+// contains reports whether keyring has the key of entity, the same key may be read from several keyrings
+func contains(keyring openpgp.EntityList, entity *openpgp.Entity) bool {
+	for _, each := range keyring {
+		if Fingerprint(each) == Fingerprint(entity) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,359 @@
+// Package s3test runs an in-process fake of the part of the S3 API the transports use,
+// so uploads, renames and tags can be exercised without an object storage.
+package s3test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reconconverter/config"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Object is an object stored by the server
+type Object struct {
+	Data     []byte
+	Tags     map[string]string
+	Modified time.Time
+	// the number of parts of a multipart upload, 0 for a single put
+	Parts int
+}
+
+type upload struct {
+	key   string
+	parts map[int][]byte
+}
+
+// Server serves a single bucket over plain HTTP on a random local port
+type Server struct {
+	Bucket string
+
+	http    *httptest.Server
+	mu      sync.Mutex
+	objects map[string]*Object
+	uploads map[string]*upload
+	aborted int
+	nextID  int
+}
+
+// NewServer starts serving an empty bucket
+func NewServer(bucket string) *Server {
+	server := &Server{
+		Bucket:  bucket,
+		objects: make(map[string]*Object),
+		uploads: make(map[string]*upload),
+	}
+	server.http = httptest.NewServer(http.HandlerFunc(server.serve))
+	return server
+}
+
+// S3 returns the config a channel uses to connect to the server
+func (server *Server) S3() config.S3 {
+	return config.S3{
+		Endpoint:  strings.TrimPrefix(server.http.URL, "http://"),
+		Region:    "us-east-1",
+		Bucket:    server.Bucket,
+		AccessKey: "recon",
+		SecretKey: "reconrecon",
+		PathStyle: true,
+	}
+}
+
+func (server *Server) Close() {
+	server.http.Close()
+}
+
+// Object returns a copy of the object of key
+func (server *Server) Object(key string) (Object, bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	object, ok := server.objects[key]
+	if !ok {
+		return Object{}, false
+	}
+	copied := *object
+	copied.Tags = make(map[string]string, len(object.Tags))
+	for k, v := range object.Tags {
+		copied.Tags[k] = v
+	}
+	return copied, true
+}
+
+// Put stores an object directly
+func (server *Server) Put(key string, data []byte) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.objects[key] = &Object{Data: data, Modified: time.Now()}
+}
+
+// Keys returns the keys of the stored objects in order
+func (server *Server) Keys() []string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	keys := make([]string, 0, len(server.objects))
+	for key := range server.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Uploads returns the number of multipart uploads started and neither completed nor aborted
+func (server *Server) Uploads() int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return len(server.uploads)
+}
+
+// Aborted returns the number of aborted multipart uploads
+func (server *Server) Aborted() int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.aborted
+}
+
+func (server *Server) serve(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != server.Bucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", r.URL.Path)
+		return
+	}
+	query := r.URL.Query()
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		server.list(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		server.nextID++
+		id := strconv.Itoa(server.nextID)
+		server.uploads[id] = &upload{key: key, parts: make(map[int][]byte)}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		upload, ok := server.uploads[query.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", key)
+			return
+		}
+		data, err := readBody(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		part, _ := strconv.Atoi(query.Get("partNumber"))
+		upload.parts[part] = data
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		id := query.Get("uploadId")
+		upload, ok := server.uploads[id]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", key)
+			return
+		}
+		numbers := make([]int, 0, len(upload.parts))
+		for number := range upload.parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, number := range numbers {
+			data = append(data, upload.parts[number]...)
+		}
+		delete(server.uploads, id)
+		server.objects[key] = &Object{Data: data, Modified: time.Now(), Parts: len(numbers)}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: etag(data)})
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(server.uploads, query.Get("uploadId"))
+		server.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && query.Has("tagging"):
+		object, ok := server.objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", key)
+			return
+		}
+		var tagging struct {
+			Tags []struct {
+				Key   string
+				Value string
+			} `xml:"TagSet>Tag"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&tagging); err != nil {
+			writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+			return
+		}
+		object.Tags = make(map[string]string)
+		for _, tag := range tagging.Tags {
+			object.Tags[tag.Key] = tag.Value
+		}
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		_, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+		object, ok := server.objects[sourceKey]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", sourceKey)
+			return
+		}
+		server.objects[key] = &Object{Data: object.Data, Modified: time.Now()}
+		writeXML(w, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			ETag         string
+			LastModified string
+		}{ETag: etag(object.Data), LastModified: time.Now().UTC().Format(time.RFC3339)})
+	case r.Method == http.MethodPut:
+		data, err := readBody(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		server.objects[key] = &Object{Data: data, Modified: time.Now()}
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := server.objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", key)
+			return
+		}
+		w.Header().Set("ETag", etag(object.Data))
+		w.Header().Set("Last-Modified", object.Modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.Data)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if r.Method == http.MethodGet {
+			w.Write(object.Data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(server.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.String())
+	}
+}
+
+// list answers ListObjectsV2, keys below a delimiter are listed as common prefixes
+func (server *Server) list(w http.ResponseWriter, query url.Values) {
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+		ETag         string
+	}
+	type prefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		KeyCount       int
+		IsTruncated    bool
+		Contents       []content
+		CommonPrefixes []prefix
+	}{Name: server.Bucket, Prefix: query.Get("prefix")}
+
+	keys := make([]string, 0, len(server.objects))
+	for key := range server.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	seen := make(map[string]bool)
+	delimiter := query.Get("delimiter")
+	for _, key := range keys {
+		if !strings.HasPrefix(key, result.Prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(result.Prefix):], delimiter); i >= 0 {
+				common := key[:len(result.Prefix)+i+len(delimiter)]
+				if !seen[common] {
+					seen[common] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, prefix{common})
+				}
+				continue
+			}
+		}
+		object := server.objects[key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			Size:         len(object.Data),
+			LastModified: object.Modified.UTC().Format(time.RFC3339),
+			ETag:         etag(object.Data),
+		})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	writeXML(w, result)
+}
+
+// readBody reads the payload of a request, decoding the chunks of a streaming signature
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	reader := bufio.NewReader(r.Body)
+	var data bytes.Buffer
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeField, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeField, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk size %q", sizeField)
+		}
+		if size == 0 {
+			return data.Bytes(), nil
+		}
+		if _, err := io.CopyN(&data, reader, size); err != nil {
+			return nil, err
+		}
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
@@ -0,0 +1,204 @@
+// Package sftptest runs an in-process SFTP server on the local filesystem,
+// so the pipeline can be exercised without a partner server.
+package sftptest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reconconverter/config"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	User     = "recon"
+	Password = "recon"
+)
+
+// Server serves Root over SFTP on a random local port
+type Server struct {
+	Root     string
+	listener net.Listener
+	config   *ssh.ServerConfig
+	wg       sync.WaitGroup
+	// sessions accepted per connection, unlimited when 0
+	maxSessions atomic.Int32
+	// whether global requests like keepalives are left unanswered
+	hang atomic.Bool
+}
+
+// LimitSessions makes the server reject the sessions of a connection beyond max, like servers
+// limiting the sessions of a client do
+func (server *Server) LimitSessions(max int) {
+	server.maxSessions.Store(int32(max))
+}
+
+// Hang leaves the keepalives of the clients unanswered, like a server that stopped responding
+func (server *Server) Hang() {
+	server.hang.Store(true)
+}
+
+// NewServer starts serving root. Relative paths of clients resolve against root.
+func NewServer(root string) (*Server, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	sshConfig := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == User && string(password) == Password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("invalid credentials for %v", conn.User())
+		},
+	}
+	sshConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		Root:     root,
+		listener: listener,
+		config:   sshConfig,
+	}
+	server.wg.Add(1)
+	go server.serve()
+
+	return server, nil
+}
+
+// Sftp returns the config a channel uses to connect to the server
+func (server *Server) Sftp() config.Sftp {
+	return config.Sftp{
+		Host:     "127.0.0.1",
+		Port:     server.listener.Addr().(*net.TCPAddr).Port,
+		User:     User,
+		Password: Password,
+	}
+}
+
+// Close stops accepting connections. Open connections end with their clients.
+func (server *Server) Close() error {
+	err := server.listener.Close()
+	server.wg.Wait()
+	return err
+}
+
+// OpenFiles returns the files below Root this process holds open, which are the handles the
+// server keeps for its clients unless the caller opens files there itself. It reads /proc and
+// fails where there is none.
+func (server *Server) OpenFiles() ([]string, error) {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return nil, err
+	}
+	root, err := filepath.EvalSymlinks(server.Root)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err != nil {
+			// closed since it was listed
+			continue
+		}
+		if strings.HasPrefix(target, root+string(filepath.Separator)) {
+			files = append(files, target)
+		}
+	}
+	return files, nil
+}
+
+func (server *Server) serve() {
+	defer server.wg.Done()
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.handleConn(conn)
+	}
+}
+
+func (server *Server) handleConn(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, server.config)
+	if err != nil {
+		logrus.Errorf("sftptest: handshake failed: %v", err)
+		return
+	}
+	go func() {
+		for request := range requests {
+			if request.WantReply && !server.hang.Load() {
+				request.Reply(false, nil)
+			}
+		}
+	}()
+
+	sessions := 0
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		if max := int(server.maxSessions.Load()); max > 0 && sessions >= max {
+			newChannel.Reject(ssh.ResourceShortage, "too many sessions")
+			continue
+		}
+		sessions++
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			logrus.Errorf("sftptest: failed to accept channel: %v", err)
+			continue
+		}
+		go server.handleSession(channel, requests)
+	}
+}
+
+func (server *Server) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	for request := range requests {
+		if request.Type != "subsystem" || !isSftp(request.Payload) {
+			request.Reply(false, nil)
+			continue
+		}
+		request.Reply(true, nil)
+
+		sftpServer, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(server.Root))
+		if err != nil {
+			logrus.Errorf("sftptest: failed to start sftp: %v", err)
+			channel.Close()
+			return
+		}
+		go func() {
+			sftpServer.Serve()
+			sftpServer.Close()
+		}()
+	}
+}
+
+// isSftp reads the subsystem name of a subsystem request
+func isSftp(payload []byte) bool {
+	if len(payload) < 4 {
+		return false
+	}
+	size := binary.BigEndian.Uint32(payload)
+	return int(size) == len(payload)-4 && string(payload[4:]) == "sftp"
+}
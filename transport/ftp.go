@@ -0,0 +1,177 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reconconverter/config"
+	"strconv"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// ftpTransport is a Transport on its own FTP control connection.
+// FTP connections can't run commands concurrently, so they are not shared.
+type ftpTransport struct {
+	conn *ftp.ServerConn
+}
+
+func dialFtp(ftpConfig config.Ftp) (*ftpTransport, error) {
+	timeout := time.Duration(ftpConfig.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	options := []ftp.DialOption{
+		ftp.DialWithTimeout(timeout),
+		ftp.DialWithDisabledEPSV(ftpConfig.DisableEPSV),
+	}
+
+	if ftpConfig.TLS {
+		tlsConfig, err := ftpTLSConfig(ftpConfig)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, ftp.DialWithExplicitTLS(tlsConfig))
+	}
+
+	port := ftpConfig.Port
+	if port == 0 {
+		port = 21
+	}
+
+	conn, err := ftp.Dial(ftpConfig.Host+":"+strconv.Itoa(port), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.Login(ftpConfig.User, ftpConfig.Password); err != nil {
+		conn.Quit()
+		return nil, err
+	}
+
+	return &ftpTransport{conn: conn}, nil
+}
+
+func ftpTLSConfig(ftpConfig config.Ftp) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         ftpConfig.Host,
+		InsecureSkipVerify: ftpConfig.InsecureSkipVerify,
+		// most servers require the data connection to resume the control connection session
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+
+	if ftpConfig.CAFile != "" {
+		raw, err := os.ReadFile(ftpConfig.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(raw) {
+			return nil, fmt.Errorf("no certificate found in %v", ftpConfig.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if ftpConfig.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(ftpConfig.CertFile, ftpConfig.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func (t *ftpTransport) List(dir string) ([]os.FileInfo, error) {
+	entries, err := t.conn.List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		files = append(files, ftpFileInfo{entry})
+	}
+	return files, nil
+}
+
+func (t *ftpTransport) Open(path string) (io.ReadCloser, error) {
+	return t.conn.Retr(path)
+}
+
+// Create streams the upload while the caller writes, Close reports the result of the transfer
+func (t *ftpTransport) Create(path string) (io.WriteCloser, error) {
+	return newPipeUpload(func(reader io.Reader) error {
+		return t.conn.Stor(path, reader)
+	}), nil
+}
+
+func (t *ftpTransport) Rename(oldPath string, newPath string) error {
+	return t.conn.Rename(oldPath, newPath)
+}
+
+func (t *ftpTransport) Remove(path string) error {
+	return t.conn.Delete(path)
+}
+
+func (t *ftpTransport) Stat(name string) (os.FileInfo, error) {
+	if entry, err := t.conn.GetEntry(name); err == nil {
+		return ftpFileInfo{entry}, nil
+	}
+
+	// server without MLST
+	entries, err := t.conn.List(path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Name == path.Base(name) {
+			return ftpFileInfo{entry}, nil
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (t *ftpTransport) Close() error {
+	return t.conn.Quit()
+}
+
+type ftpFileInfo struct {
+	entry *ftp.Entry
+}
+
+func (info ftpFileInfo) Name() string {
+	return path.Base(info.entry.Name)
+}
+
+func (info ftpFileInfo) Size() int64 {
+	return int64(info.entry.Size)
+}
+
+func (info ftpFileInfo) Mode() os.FileMode {
+	if info.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (info ftpFileInfo) ModTime() time.Time {
+	return info.entry.Time
+}
+
+func (info ftpFileInfo) IsDir() bool {
+	return info.entry.Type == ftp.EntryTypeFolder
+}
+
+func (info ftpFileInfo) Sys() interface{} {
+	return info.entry
+}
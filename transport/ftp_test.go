@@ -0,0 +1,171 @@
+package transport
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reconconverter/config"
+	"reconconverter/ftptest"
+	"strings"
+	"testing"
+)
+
+func newFtpServer(t *testing.T, secure bool) *ftptest.Server {
+	t.Helper()
+	var server *ftptest.Server
+	var err error
+	if secure {
+		server, err = ftptest.NewTLSServer(t.TempDir(), t.TempDir())
+	} else {
+		server, err = ftptest.NewServer(t.TempDir())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func TestFtpPassive(t *testing.T) {
+	server := newFtpServer(t, false)
+	cfg := server.Ftp()
+	cfg.DisableEPSV = true
+
+	testFtp(t, server, cfg)
+
+	commands := strings.Join(server.Commands(), " ")
+	if !strings.Contains(commands, "PASV") || strings.Contains(commands, "EPSV") {
+		t.Errorf("data connections opened with %v, want PASV only", commands)
+	}
+}
+
+func TestFtpExplicitTLS(t *testing.T) {
+	server := newFtpServer(t, true)
+
+	testFtp(t, server, server.Ftp())
+
+	commands := strings.Join(server.Commands(), " ")
+	if !strings.HasPrefix(commands, "AUTH") || !strings.Contains(commands, "PROT") {
+		t.Errorf("commands %v, want the session secured before login", commands)
+	}
+}
+
+func TestFtpTLSRejected(t *testing.T) {
+	server := newFtpServer(t, true)
+
+	// the server certificate is issued by a CA the system doesn't trust
+	untrusted := server.Ftp()
+	untrusted.CAFile = ""
+	if conn, err := dialFtp(untrusted); err == nil {
+		conn.Close()
+		t.Errorf("dialed a server of an unknown CA")
+	}
+
+	// the server requires a client certificate
+	anonymous := server.Ftp()
+	anonymous.CertFile, anonymous.KeyFile = "", ""
+	if conn, err := dialFtp(anonymous); err == nil {
+		conn.Close()
+		t.Errorf("logged in without a client certificate")
+	}
+
+	missing := server.Ftp()
+	missing.CAFile = filepath.Join(t.TempDir(), "ca.pem")
+	if _, err := dialFtp(missing); !os.IsNotExist(err) {
+		t.Errorf("dial with a missing CA file returned %v", err)
+	}
+}
+
+// testFtp lists, downloads, uploads, renames and removes files of the server
+func testFtp(t *testing.T, server *ftptest.Server, cfg config.Ftp) {
+	t.Helper()
+	for _, dir := range []string{"ovo/source", "ovo/backup"} {
+		if err := os.MkdirAll(filepath.Join(server.Root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(server.Root, "ovo/source/settlement.xlsx"), []byte("workbook"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ftp, err := dialFtp(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ftp.Close()
+
+	files, err := ftp.List("/ovo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name() != "backup" || !files[0].IsDir() || files[1].Name() != "source" {
+		t.Errorf("listed %v", fileNames(files))
+	}
+	files, err = ftp.List("/ovo/source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "settlement.xlsx" || files[0].Size() != 8 || files[0].IsDir() {
+		t.Errorf("listed %v", fileNames(files))
+	}
+	if files, err := ftp.List("/ovo/backup"); err != nil || len(files) != 0 {
+		t.Errorf("listed %v from an empty folder, %v", fileNames(files), err)
+	}
+
+	reader, err := ftp.Open("/ovo/source/settlement.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "workbook" {
+		t.Errorf("downloaded %q", data)
+	}
+
+	writer, err := ftp.Create("/ovo/source/settlement.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(writer, "a;b\n1;2\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(server.Root, "ovo/source/settlement.csv")); string(data) != "a;b\n1;2\n" {
+		t.Errorf("uploaded %q", data)
+	}
+
+	if err := ftp.Rename("/ovo/source/settlement.xlsx", "/ovo/backup/settlement.xlsx"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := ftp.Stat("/ovo/backup/settlement.xlsx"); err != nil || info.Size() != 8 {
+		t.Errorf("stat of the renamed file: %v, %v", info, err)
+	}
+	if _, err := ftp.Stat("/ovo/source/settlement.xlsx"); !os.IsNotExist(err) {
+		t.Errorf("stat of the old name returned %v, want not exist", err)
+	}
+	if err := ftp.Rename("/ovo/source/missing.xlsx", "/ovo/backup/missing.xlsx"); err == nil {
+		t.Errorf("rename of a missing file succeeded")
+	}
+
+	if err := ftp.Remove("/ovo/source/settlement.csv"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(server.Root, "ovo/source/settlement.csv")); !os.IsNotExist(err) {
+		t.Errorf("removed file still exists: %v", err)
+	}
+}
+
+func fileNames(files []os.FileInfo) []string {
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	return names
+}
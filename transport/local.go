@@ -0,0 +1,53 @@
+package transport
+
+import (
+	"io"
+	"os"
+)
+
+// Local is a Transport on the local filesystem, e.g. a drop folder or a shared mount
+type Local struct{}
+
+func (Local) List(dir string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue // removed while listing
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, info)
+	}
+	return files, nil
+}
+
+func (Local) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (Local) Create(path string) (io.WriteCloser, error) {
+	return os.Create(path)
+}
+
+func (Local) Rename(oldPath string, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (Local) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (Local) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (Local) Close() error {
+	return nil
+}
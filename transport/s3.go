@@ -0,0 +1,169 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"reconconverter/config"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// uploads are split in parts of this size, so a large csv never has to fit in memory at once
+const s3PartSize = 16 * 1024 * 1024
+
+// StatusTag is the object tag that records the processing status of a file
+const StatusTag = "reconconverter-status"
+
+// StatusTagger is implemented by transports that can record the processing status on the file itself
+type StatusTagger interface {
+	TagStatus(path string, status string) error
+}
+
+// s3Transport is a Transport on a bucket of an S3 compatible object storage.
+// Paths are object keys below the configured prefix; directories are key prefixes.
+type s3Transport struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func dialS3(s3Config config.S3) (*s3Transport, error) {
+	lookup := minio.BucketLookupDNS
+	if s3Config.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(s3Config.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(s3Config.AccessKey, s3Config.SecretKey, ""),
+		Secure:       s3Config.UseSSL,
+		Region:       s3Config.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Transport{
+		client: client,
+		bucket: s3Config.Bucket,
+		prefix: s3Config.Prefix,
+	}, nil
+}
+
+func (t *s3Transport) key(name string) string {
+	return strings.TrimPrefix(path.Join(t.prefix, name), "/")
+}
+
+func (t *s3Transport) List(dir string) ([]os.FileInfo, error) {
+	prefix := t.key(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var files []os.FileInfo
+	for object := range t.client.ListObjects(context.Background(), t.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		files = append(files, s3FileInfo{object})
+	}
+	return files, nil
+}
+
+func (t *s3Transport) Open(name string) (io.ReadCloser, error) {
+	object, err := t.client.GetObject(context.Background(), t.bucket, t.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy, stat so a missing object fails here instead of on the first read
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, err
+	}
+	return object, nil
+}
+
+// Create streams a multipart upload while the caller writes, Close reports the result of the upload
+func (t *s3Transport) Create(name string) (io.WriteCloser, error) {
+	return newPipeUpload(func(reader io.Reader) error {
+		_, err := t.client.PutObject(context.Background(), t.bucket, t.key(name), reader, -1, minio.PutObjectOptions{
+			PartSize: s3PartSize,
+		})
+		return err
+	}), nil
+}
+
+func (t *s3Transport) Rename(oldPath string, newPath string) error {
+	_, err := t.client.CopyObject(context.Background(),
+		minio.CopyDestOptions{Bucket: t.bucket, Object: t.key(newPath)},
+		minio.CopySrcOptions{Bucket: t.bucket, Object: t.key(oldPath)},
+	)
+	if err != nil {
+		return err
+	}
+	return t.Remove(oldPath)
+}
+
+func (t *s3Transport) Remove(name string) error {
+	return t.client.RemoveObject(context.Background(), t.bucket, t.key(name), minio.RemoveObjectOptions{})
+}
+
+func (t *s3Transport) Stat(name string) (os.FileInfo, error) {
+	object, err := t.client.StatObject(context.Background(), t.bucket, t.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+		}
+		return nil, err
+	}
+	return s3FileInfo{object}, nil
+}
+
+func (t *s3Transport) TagStatus(name string, status string) error {
+	objectTags, err := tags.MapToObjectTags(map[string]string{StatusTag: status})
+	if err != nil {
+		return err
+	}
+	return t.client.PutObjectTagging(context.Background(), t.bucket, t.key(name), objectTags, minio.PutObjectTaggingOptions{})
+}
+
+func (t *s3Transport) Close() error {
+	return nil
+}
+
+type s3FileInfo struct {
+	object minio.ObjectInfo
+}
+
+func (info s3FileInfo) Name() string {
+	return path.Base(strings.TrimSuffix(info.object.Key, "/"))
+}
+
+func (info s3FileInfo) Size() int64 {
+	return info.object.Size
+}
+
+func (info s3FileInfo) Mode() os.FileMode {
+	if info.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (info s3FileInfo) ModTime() time.Time {
+	return info.object.LastModified
+}
+
+func (info s3FileInfo) IsDir() bool {
+	return strings.HasSuffix(info.object.Key, "/")
+}
+
+func (info s3FileInfo) Sys() interface{} {
+	return info.object
+}
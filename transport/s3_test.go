@@ -0,0 +1,157 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"reconconverter/s3test"
+	"testing"
+)
+
+func newS3(t *testing.T, prefix string) (*s3test.Server, *s3Transport) {
+	t.Helper()
+	server := s3test.NewServer("recon")
+	t.Cleanup(server.Close)
+
+	cfg := server.S3()
+	cfg.Prefix = prefix
+	s3, err := dialS3(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, s3
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	server, s3 := newS3(t, "converted")
+
+	// one byte more than a part
+	data := bytes.Repeat([]byte("0123456789abcdef"), s3PartSize/16)
+	data = append(data, '!')
+
+	file, err := s3.Create("ovo/large.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(file, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	object, ok := server.Object("converted/ovo/large.csv")
+	if !ok {
+		t.Fatalf("object not stored, keys %v", server.Keys())
+	}
+	if object.Parts != 2 {
+		t.Errorf("uploaded in %d parts, want 2", object.Parts)
+	}
+	if !bytes.Equal(object.Data, data) {
+		t.Errorf("stored %d bytes, want %d", len(object.Data), len(data))
+	}
+
+	info, err := s3.Stat("ovo/large.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Errorf("stat size %d, want %d", info.Size(), len(data))
+	}
+}
+
+func TestS3AbortedUpload(t *testing.T) {
+	server, s3 := newS3(t, "")
+
+	file, err := s3.Create("partial.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("a;b\n1;")); err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("source connection lost")
+	Abort(file, failure)
+	if err := file.Close(); !errors.Is(err, failure) {
+		t.Errorf("close after abort returned %v, want %v", err, failure)
+	}
+
+	if _, ok := server.Object("partial.csv"); ok {
+		t.Errorf("aborted upload was completed")
+	}
+	if server.Uploads() != 0 || server.Aborted() != 1 {
+		t.Errorf("%d multipart uploads left open, %d aborted", server.Uploads(), server.Aborted())
+	}
+}
+
+func TestS3TagStatus(t *testing.T) {
+	server, s3 := newS3(t, "backup")
+	server.Put("backup/ovo.xlsx", []byte("workbook"))
+
+	if err := s3.TagStatus("ovo.xlsx", "processed"); err != nil {
+		t.Fatal(err)
+	}
+	object, _ := server.Object("backup/ovo.xlsx")
+	if object.Tags[StatusTag] != "processed" {
+		t.Errorf("tags %v", object.Tags)
+	}
+}
+
+func TestS3Rename(t *testing.T) {
+	server, s3 := newS3(t, "")
+	server.Put("source/ovo.xlsx", []byte("workbook"))
+
+	if err := s3.Rename("source/ovo.xlsx", "backup/ovo.xlsx"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := server.Keys(); len(keys) != 1 || keys[0] != "backup/ovo.xlsx" {
+		t.Fatalf("keys %v, want [backup/ovo.xlsx]", keys)
+	}
+	if object, _ := server.Object("backup/ovo.xlsx"); string(object.Data) != "workbook" {
+		t.Errorf("renamed object holds %q", object.Data)
+	}
+
+	if _, err := s3.Stat("source/ovo.xlsx"); !os.IsNotExist(err) {
+		t.Errorf("stat of the old name returned %v, want not exist", err)
+	}
+	if err := s3.Rename("source/missing.xlsx", "backup/missing.xlsx"); err == nil {
+		t.Errorf("rename of a missing object succeeded")
+	}
+}
+
+func TestS3ListAndOpen(t *testing.T) {
+	server, s3 := newS3(t, "partner")
+	server.Put("partner/ovo/a.xlsx", []byte("a"))
+	server.Put("partner/ovo/b.xlsx", []byte("bb"))
+	server.Put("partner/ovo/done/c.xlsx", []byte("c"))
+	server.Put("partner/indodana/d.xlsx", []byte("d"))
+
+	files, err := s3.List("ovo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+		if file.Name() == "done" && !file.IsDir() {
+			t.Errorf("done is not a directory")
+		}
+	}
+	if len(names) != 3 || names[0] != "a.xlsx" || names[1] != "b.xlsx" || names[2] != "done" {
+		t.Errorf("listed %v", names)
+	}
+
+	reader, err := s3.Open("ovo/b.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if data, err := io.ReadAll(reader); err != nil || string(data) != "bb" {
+		t.Errorf("read %q, %v", data, err)
+	}
+
+	if _, err := s3.Open("ovo/missing.xlsx"); err == nil {
+		t.Errorf("open of a missing object succeeded")
+	}
+}
@@ -0,0 +1,365 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reconconverter/config"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// ConnectionPool shares ssh connections between channels, keyed by host and user.
+// Each connection multiplexes up to MaxSessions sftp sessions that are borrowed
+// per file and reused afterwards.
+type ConnectionPool struct {
+	MaxSessions int
+	IdleTimeout time.Duration
+	KeepAlive   time.Duration
+	WaitTimeout time.Duration
+
+	mu     sync.Mutex
+	conns  map[string]*pooledConn
+	owners map[*sftp.Client]*pooledConn
+	stop   chan struct{}
+	closed sync.Once
+}
+
+// keepAliveTimeout is how long a keepalive may take before the connection is taken for broken
+var keepAliveTimeout = 15 * time.Second
+
+// pooledConn is the shared connection of a server. mu guards the fields below it and is never
+// held across network I/O, a slow server doesn't block the other sessions of the connection.
+type pooledConn struct {
+	key    string
+	config config.Sftp
+	slots  chan struct{}
+
+	mu       sync.Mutex
+	ssh      *ssh.Client
+	idle     []*sftp.Client
+	lastUsed time.Time
+}
+
+func NewConnectionPool(poolConfig config.SftpPool) *ConnectionPool {
+	pool := &ConnectionPool{
+		MaxSessions: poolConfig.MaxSessions,
+		IdleTimeout: time.Duration(poolConfig.IdleTimeout) * time.Second,
+		KeepAlive:   time.Duration(poolConfig.KeepAlive) * time.Second,
+		WaitTimeout: time.Duration(poolConfig.WaitTimeout) * time.Second,
+		conns:       make(map[string]*pooledConn),
+		owners:      make(map[*sftp.Client]*pooledConn),
+		stop:        make(chan struct{}),
+	}
+	if pool.MaxSessions < 1 {
+		pool.MaxSessions = 8
+	}
+	if pool.IdleTimeout <= 0 {
+		pool.IdleTimeout = 5 * time.Minute
+	}
+	if pool.KeepAlive <= 0 {
+		pool.KeepAlive = 30 * time.Second
+	}
+	if pool.WaitTimeout <= 0 {
+		pool.WaitTimeout = 5 * time.Minute
+	}
+
+	go pool.maintain()
+
+	return pool
+}
+
+// PoolKey identifies the shared connection of a server
+func PoolKey(sftpConfig config.Sftp) string {
+	return sftpConfig.User + "@" + sftpConfig.Host + ":" + strconv.Itoa(sftpConfig.Port)
+}
+
+// Borrow returns an sftp session to the server. It waits for a free session when
+// the connection already has MaxSessions in use. Sessions must be given back with Release.
+func (pool *ConnectionPool) Borrow(sftpConfig config.Sftp) (*sftp.Client, error) {
+	key := PoolKey(sftpConfig)
+
+	pool.mu.Lock()
+	conn, ok := pool.conns[key]
+	if !ok {
+		conn = &pooledConn{
+			key:    key,
+			config: sftpConfig,
+			slots:  make(chan struct{}, pool.MaxSessions),
+		}
+		pool.conns[key] = conn
+	}
+	pool.mu.Unlock()
+
+	timer := time.NewTimer(pool.WaitTimeout)
+	defer timer.Stop()
+	select {
+	case conn.slots <- struct{}{}:
+	case <-timer.C:
+		return nil, fmt.Errorf("no free sftp session to %v after %v", key, pool.WaitTimeout)
+	}
+
+	client, err := conn.session()
+	if err != nil {
+		<-conn.slots
+		return nil, err
+	}
+
+	pool.mu.Lock()
+	pool.owners[client] = conn
+	pool.mu.Unlock()
+
+	return client, nil
+}
+
+// Release gives a borrowed session back to the pool.
+func (pool *ConnectionPool) Release(client *sftp.Client) {
+	pool.mu.Lock()
+	conn, ok := pool.owners[client]
+	delete(pool.owners, client)
+	pool.mu.Unlock()
+
+	if !ok {
+		client.Close()
+		return
+	}
+
+	conn.mu.Lock()
+	conn.idle = append(conn.idle, client)
+	conn.lastUsed = time.Now()
+	conn.mu.Unlock()
+
+	<-conn.slots
+}
+
+// Close closes every connection of the pool. It may be called more than once.
+func (pool *ConnectionPool) Close() {
+	pool.closed.Do(func() { close(pool.stop) })
+
+	pool.mu.Lock()
+	conns := make([]*pooledConn, 0, len(pool.conns))
+	for _, conn := range pool.conns {
+		conns = append(conns, conn)
+	}
+	pool.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.mu.Lock()
+		closeAll := conn.detach()
+		conn.mu.Unlock()
+		closeAll()
+	}
+}
+
+// session returns a healthy idle session or opens a new one, reconnecting when needed
+func (conn *pooledConn) session() (*sftp.Client, error) {
+	for {
+		conn.mu.Lock()
+		conn.lastUsed = time.Now()
+		var client *sftp.Client
+		if n := len(conn.idle); n > 0 {
+			client = conn.idle[n-1]
+			conn.idle = conn.idle[:n-1]
+		}
+		conn.mu.Unlock()
+
+		if client == nil {
+			break
+		}
+		if _, err := client.Getwd(); err == nil {
+			return client, nil
+		}
+		client.Close()
+	}
+
+	sshClient, err := conn.connect()
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(sshClient)
+	if err == nil {
+		return client, nil
+	}
+	// the sessions of other files share the connection, it is only replaced when it is broken
+	if alive(sshClient) {
+		return nil, err
+	}
+	logrus.Errorf("Failed to open sftp session to %v, reconnecting: %v", conn.key, err)
+	conn.drop(sshClient)
+	if sshClient, err = conn.connect(); err != nil {
+		return nil, err
+	}
+	return sftp.NewClient(sshClient)
+}
+
+// connect returns the ssh connection of conn, dialing a new one when there is none or it is
+// broken
+func (conn *pooledConn) connect() (*ssh.Client, error) {
+	conn.mu.Lock()
+	sshClient := conn.ssh
+	conn.mu.Unlock()
+
+	if sshClient != nil {
+		if alive(sshClient) {
+			return sshClient, nil
+		}
+		logrus.Errorf("Connection to %v is broken, reconnecting", conn.key)
+		conn.drop(sshClient)
+	}
+
+	dialed, err := DialSsh(conn.config)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	// another session dialed meanwhile
+	if conn.ssh != nil {
+		dialed.Close()
+		return conn.ssh, nil
+	}
+	conn.ssh = dialed
+	return dialed, nil
+}
+
+// drop disconnects conn when sshClient is still its connection
+func (conn *pooledConn) drop(sshClient *ssh.Client) {
+	conn.mu.Lock()
+	var closeAll func()
+	if conn.ssh == sshClient {
+		closeAll = conn.detach()
+	}
+	conn.mu.Unlock()
+
+	if closeAll != nil {
+		closeAll()
+	}
+}
+
+// detach takes the idle sessions and the ssh connection from conn and returns the function
+// closing them, called once conn.mu is released. conn.mu must be held.
+func (conn *pooledConn) detach() func() {
+	idle, sshClient := conn.idle, conn.ssh
+	conn.idle, conn.ssh = nil, nil
+	return func() {
+		for _, client := range idle {
+			client.Close()
+		}
+		if sshClient != nil {
+			sshClient.Close()
+		}
+	}
+}
+
+// maintain sends keepalives and closes connections that are broken or idle for too long
+func (pool *ConnectionPool) maintain() {
+	ticker := time.NewTicker(pool.KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pool.stop:
+			return
+		case <-ticker.C:
+		}
+
+		pool.mu.Lock()
+		conns := make([]*pooledConn, 0, len(pool.conns))
+		for _, conn := range pool.conns {
+			conns = append(conns, conn)
+		}
+		pool.mu.Unlock()
+
+		for _, conn := range conns {
+			conn.mu.Lock()
+			sshClient := conn.ssh
+			var closeAll func()
+			if sshClient != nil && len(conn.slots) == 0 && time.Since(conn.lastUsed) > pool.IdleTimeout {
+				logrus.Infof("Closing idle connection to %v", conn.key)
+				closeAll = conn.detach()
+			}
+			conn.mu.Unlock()
+
+			switch {
+			case closeAll != nil:
+				closeAll()
+			case sshClient != nil && !alive(sshClient):
+				logrus.Errorf("Keepalive to %v failed, closing connection", conn.key)
+				conn.drop(sshClient)
+			}
+		}
+	}
+}
+
+// alive sends a keepalive, a connection that doesn't answer within keepAliveTimeout is broken
+func alive(sshClient *ssh.Client) bool {
+	answered := make(chan error, 1)
+	go func() {
+		// returns once the connection is closed when the server never answers
+		_, _, err := sshClient.SendRequest("keepalive@openssh.com", true, nil)
+		answered <- err
+	}()
+
+	timer := time.NewTimer(keepAliveTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-answered:
+		return err == nil
+	case <-timer.C:
+		return false
+	}
+}
+
+func DialSsh(sftpConfig config.Sftp) (*ssh.Client, error) {
+	sshConfig := &ssh.ClientConfig{
+		User: sftpConfig.User,
+		Auth: []ssh.AuthMethod{
+			ssh.Password(sftpConfig.Password),
+		},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         30 * time.Second,
+	}
+
+	return ssh.Dial("tcp", sftpConfig.Host+":"+strconv.Itoa(sftpConfig.Port), sshConfig)
+}
+
+// sftpTransport is a Transport on a session borrowed from the pool
+type sftpTransport struct {
+	pool   *ConnectionPool
+	client *sftp.Client
+}
+
+func (t *sftpTransport) List(dir string) ([]os.FileInfo, error) {
+	return t.client.ReadDir(dir)
+}
+
+func (t *sftpTransport) Open(path string) (io.ReadCloser, error) {
+	return t.client.Open(path)
+}
+
+func (t *sftpTransport) Create(path string) (io.WriteCloser, error) {
+	return t.client.Create(path)
+}
+
+func (t *sftpTransport) Rename(oldPath string, newPath string) error {
+	return t.client.Rename(oldPath, newPath)
+}
+
+func (t *sftpTransport) Remove(path string) error {
+	return t.client.Remove(path)
+}
+
+func (t *sftpTransport) Stat(path string) (os.FileInfo, error) {
+	return t.client.Stat(path)
+}
+
+func (t *sftpTransport) Close() error {
+	t.pool.Release(t.client)
+	return nil
+}
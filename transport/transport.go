@@ -0,0 +1,237 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reconconverter/config"
+	"sort"
+)
+
+const (
+	TypeSftp  = "sftp"
+	TypeLocal = "local"
+	TypeFtp   = "ftp"
+	TypeS3    = "s3"
+)
+
+// Transport is the file access a channel needs on its source and destination.
+// Close gives the transport back; it doesn't remove anything.
+type Transport interface {
+	List(dir string) ([]os.FileInfo, error)
+	Open(path string) (io.ReadCloser, error)
+	Create(path string) (io.WriteCloser, error)
+	Rename(oldPath string, newPath string) error
+	Remove(path string) error
+	Stat(path string) (os.FileInfo, error)
+	Close() error
+}
+
+// Dialer opens the transports of the channels
+type Dialer struct {
+	Pool *ConnectionPool
+}
+
+func NewDialer(cfg *config.Config) *Dialer {
+	return &Dialer{
+		Pool: NewConnectionPool(cfg.SftpPool),
+	}
+}
+
+// endpoint holds the settings of every transport type, only the one of the selected type is used
+type endpoint struct {
+	sftp config.Sftp
+	ftp  config.Ftp
+	s3   config.S3
+}
+
+// Source opens the source transport of a channel
+func (dialer *Dialer) Source(channel config.Channel) (Transport, error) {
+	return dialer.open(channel.SourceType, endpoint{sftp: channel.SftpSource, ftp: channel.FtpSource, s3: channel.S3Source})
+}
+
+// Destination opens the destination transport of a channel
+func (dialer *Dialer) Destination(channel config.Channel) (Transport, error) {
+	return dialer.open(channel.DestinationType, endpoint{sftp: channel.SftpDestination, ftp: channel.FtpDestination, s3: channel.S3Destination})
+}
+
+// Archive opens the transport processed source files are moved to.
+// It returns nil when the channel keeps its backups next to the source.
+func (dialer *Dialer) Archive(channel config.Channel) (Transport, error) {
+	if channel.ArchiveType == "" {
+		return nil, nil
+	}
+	return dialer.open(channel.ArchiveType, endpoint{s3: channel.S3Archive})
+}
+
+// Borrow opens the source of channel and the destinations a single file is delivered to, one
+// transport per destination. Sftp sessions are borrowed in the order of their pool key, one per
+// server shared by every transport on it, so workers that need sessions of several servers never
+// hold one while waiting in a cycle for another. Equal destinations share their transport.
+// Closing every returned transport gives the sessions back.
+func (dialer *Dialer) Borrow(channel config.Channel, destinations []config.Channel) (Transport, []Transport, error) {
+	type opening struct {
+		transportType string
+		endpoint      endpoint
+	}
+	openings := []opening{{kind(channel.SourceType), endpoint{sftp: channel.SftpSource, ftp: channel.FtpSource, s3: channel.S3Source}}}
+	for _, destination := range destinations {
+		openings = append(openings, opening{kind(destination.DestinationType), endpoint{sftp: destination.SftpDestination, ftp: destination.FtpDestination, s3: destination.S3Destination}})
+	}
+
+	servers := make(map[string]config.Sftp)
+	var keys []string
+	for _, o := range openings {
+		if o.transportType != TypeSftp {
+			continue
+		}
+		if _, ok := servers[PoolKey(o.endpoint.sftp)]; !ok {
+			keys = append(keys, PoolKey(o.endpoint.sftp))
+		}
+		servers[PoolKey(o.endpoint.sftp)] = o.endpoint.sftp
+	}
+	sort.Strings(keys)
+
+	sessions := make(map[string]Transport, len(keys))
+	for _, key := range keys {
+		client, err := dialer.Pool.Borrow(servers[key])
+		if err != nil {
+			for _, session := range sessions {
+				session.Close()
+			}
+			return nil, nil, err
+		}
+		sessions[key] = &sftpTransport{pool: dialer.Pool, client: client}
+	}
+
+	transports := make([]Transport, len(openings))
+	closeAll := func() {
+		for _, t := range transports {
+			if t != nil {
+				t.Close()
+			}
+		}
+	}
+	// the first transport on a server gives its session back, the others share it
+	shared := make(map[string]bool)
+	for i, o := range openings {
+		if o.transportType != TypeSftp {
+			continue
+		}
+		key := PoolKey(o.endpoint.sftp)
+		transports[i] = sessions[key]
+		if shared[key] {
+			transports[i] = nopCloser{sessions[key]}
+		}
+		shared[key] = true
+	}
+	opened := make(map[opening]Transport)
+	for i, o := range openings {
+		if transports[i] != nil {
+			continue
+		}
+		if t, ok := opened[o]; ok && i > 0 {
+			transports[i] = nopCloser{t}
+			continue
+		}
+		t, err := dialer.open(o.transportType, o.endpoint)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		transports[i] = t
+		if i > 0 {
+			opened[o] = t
+		}
+	}
+
+	return transports[0], transports[1:], nil
+}
+
+func (dialer *Dialer) Close() {
+	dialer.Pool.Close()
+}
+
+func (dialer *Dialer) open(transportType string, endpoint endpoint) (Transport, error) {
+	switch kind(transportType) {
+	case TypeSftp:
+		client, err := dialer.Pool.Borrow(endpoint.sftp)
+		if err != nil {
+			return nil, err
+		}
+		return &sftpTransport{pool: dialer.Pool, client: client}, nil
+	case TypeLocal:
+		return Local{}, nil
+	case TypeFtp:
+		return dialFtp(endpoint.ftp)
+	case TypeS3:
+		return dialS3(endpoint.s3)
+	}
+	return nil, fmt.Errorf("unknown transport type %q", transportType)
+}
+
+func kind(transportType string) string {
+	if transportType == "" {
+		return TypeSftp
+	}
+	return transportType
+}
+
+// nopCloser shares a transport without giving it back twice
+type nopCloser struct {
+	Transport
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// pipeUpload streams what is written to an upload running in the background
+type pipeUpload struct {
+	writer *io.PipeWriter
+	done   chan error
+	closed bool
+	err    error
+}
+
+func newPipeUpload(upload func(reader io.Reader) error) *pipeUpload {
+	reader, writer := io.Pipe()
+	pipe := &pipeUpload{writer: writer, done: make(chan error, 1)}
+	go func() {
+		err := upload(reader)
+		reader.CloseWithError(err)
+		pipe.done <- err
+	}()
+	return pipe
+}
+
+func (pipe *pipeUpload) Write(p []byte) (int, error) {
+	return pipe.writer.Write(p)
+}
+
+// Close finishes the upload and returns its result
+func (pipe *pipeUpload) Close() error {
+	return pipe.CloseWithError(nil)
+}
+
+// CloseWithError fails the upload with err instead of completing it with what was written.
+// Without err it finishes the upload like Close.
+func (pipe *pipeUpload) CloseWithError(err error) error {
+	if !pipe.closed {
+		pipe.closed = true
+		pipe.writer.CloseWithError(err)
+		pipe.err = <-pipe.done
+	}
+	return pipe.err
+}
+
+// Abort gives up a file written through Create after err. An upload is failed rather than
+// completed with what was written so far, other files are closed. Transports that write in
+// place may keep the partial file, callers remove it.
+func Abort(file io.WriteCloser, err error) {
+	if aborter, ok := file.(interface{ CloseWithError(error) error }); ok {
+		aborter.CloseWithError(err)
+		return
+	}
+	file.Close()
+}
@@ -0,0 +1,144 @@
+package transport
+
+import (
+	"reconconverter/config"
+	"reconconverter/sftptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newSftpServer(t *testing.T) *sftptest.Server {
+	t.Helper()
+	server, err := sftptest.NewServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+// Channels moving files from A to B and from B to A must not each hold the session of one
+// server while waiting for the other.
+func TestBorrowCrossedServers(t *testing.T) {
+	a, b := newSftpServer(t), newSftpServer(t)
+	dialer := &Dialer{Pool: NewConnectionPool(config.SftpPool{MaxSessions: 1, WaitTimeout: 5})}
+	defer dialer.Close()
+
+	aToB := config.Channel{SftpSource: a.Sftp(), SftpDestination: b.Sftp()}
+	bToA := config.Channel{SftpSource: b.Sftp(), SftpDestination: a.Sftp()}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		for _, channel := range []config.Channel{aToB, bToA} {
+			wg.Add(1)
+			go func(channel config.Channel) {
+				defer wg.Done()
+				source, destinations, err := dialer.Borrow(channel, []config.Channel{channel, channel})
+				if err != nil {
+					errs <- err
+					return
+				}
+				time.Sleep(time.Millisecond)
+				source.Close()
+				for _, destination := range destinations {
+					destination.Close()
+				}
+			}(channel)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestBorrowSharesSessions(t *testing.T) {
+	a := newSftpServer(t)
+	dialer := &Dialer{Pool: NewConnectionPool(config.SftpPool{MaxSessions: 1, WaitTimeout: 1})}
+	defer dialer.Close()
+
+	// a single session serves the source and both destinations
+	channel := config.Channel{SftpSource: a.Sftp(), SftpDestination: a.Sftp()}
+	other := channel
+	other.DestinationType = TypeLocal
+	source, destinations, err := dialer.Borrow(channel, []config.Channel{channel, other, channel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := destinations[1].(Local); !ok {
+		t.Errorf("local destination opened as %T", destinations[1])
+	}
+	if _, err := destinations[2].List("."); err != nil {
+		t.Errorf("shared session: %v", err)
+	}
+	for _, destination := range destinations {
+		destination.Close()
+	}
+	source.Close()
+
+	// every session is back
+	source, destinations, err = dialer.Borrow(channel, []config.Channel{channel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.Close()
+	destinations[0].Close()
+}
+
+// a session the server refuses leaves the connection to the sessions already open
+func TestBorrowRefusedSession(t *testing.T) {
+	a := newSftpServer(t)
+	a.LimitSessions(1)
+	pool := NewConnectionPool(config.SftpPool{MaxSessions: 2, WaitTimeout: 1})
+	defer pool.Close()
+
+	first, err := pool.Borrow(a.Sftp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Borrow(a.Sftp()); err == nil {
+		t.Fatalf("borrowed a session the server refuses")
+	}
+	if _, err := first.Getwd(); err != nil {
+		t.Errorf("open session broken by the refused one: %v", err)
+	}
+	pool.Release(first)
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	a := newSftpServer(t)
+	sshClient, err := DialSsh(a.Sftp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshClient.Close()
+	if !alive(sshClient) {
+		t.Fatalf("keepalive to a live server failed")
+	}
+
+	defer func(timeout time.Duration) { keepAliveTimeout = timeout }(keepAliveTimeout)
+	keepAliveTimeout = 100 * time.Millisecond
+	a.Hang()
+	start := time.Now()
+	if alive(sshClient) {
+		t.Errorf("unanswered keepalive taken for alive")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("keepalive gave up after %v", elapsed)
+	}
+}
+
+func TestPoolCloseTwice(t *testing.T) {
+	a := newSftpServer(t)
+	pool := NewConnectionPool(config.SftpPool{})
+	client, err := pool.Borrow(a.Sftp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Release(client)
+	pool.Close()
+	pool.Close()
+}